@@ -8,3 +8,13 @@ const (
 	METRIC_IP
 	METRIC_COSINE
 )
+
+// is_similarity returns true for the metrics where more bigger means more similar
+func (metric_type MetricType) is_similarity() bool {
+	return metric_type == METRIC_IP || metric_type == METRIC_COSINE
+}
+
+// is_valid returns true for the supported metrics
+func (metric_type MetricType) is_valid() bool {
+	return metric_type == METRIC_L2 || metric_type == METRIC_IP || metric_type == METRIC_COSINE
+}
@@ -0,0 +1,35 @@
+package nanofaiss
+
+import (
+	"errors"
+
+	"github.com/crowaixyz/nanofaiss/pkg/kmeans"
+)
+
+// errors returned by the indexes, they are wrapped with the name of the index and the method,
+// eg. "IndexFlat: Add: nanofaiss: index is full", use errors.Is to check them
+var (
+	ErrDimensionMismatch = errors.New("nanofaiss: input vector dimension is not equal to index dimension")
+	ErrIndexFull         = errors.New("nanofaiss: index is full")
+	ErrNotTrained        = errors.New("nanofaiss: index is not trained")
+	ErrInvalidMetric     = errors.New("nanofaiss: invalid metric type")
+	ErrMetricMismatch    = errors.New("nanofaiss: metric type is not equal to index metric type")
+	ErrInvalidParameter  = errors.New("nanofaiss: invalid parameter")
+	ErrOutOfRange        = errors.New("nanofaiss: index out of range")
+	ErrDuplicateID       = errors.New("nanofaiss: id already exists")
+	ErrInvalidFormat     = errors.New("nanofaiss: invalid index format")
+	ErrChecksumMismatch  = errors.New("nanofaiss: index checksum mismatch")
+	ErrNotSupported      = errors.New("nanofaiss: operation not supported by the index")
+)
+
+// kmeans_error returns the error of the package matching an error of the kmeans training
+func kmeans_error(err error) error {
+	switch {
+	case errors.Is(err, kmeans.ErrInvalidParameter):
+		return ErrInvalidParameter
+	case errors.Is(err, kmeans.ErrDimensionMismatch):
+		return ErrDimensionMismatch
+	}
+
+	return err
+}
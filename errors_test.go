@@ -0,0 +1,97 @@
+package nanofaiss
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestErrors(t *testing.T) {
+	Convey("Errors", t, func() {
+		var flat IndexFlat
+		flat.Init(int32(len(vecs)), 16)
+		flat.BatchAdd(vecs[:2])
+
+		var hnsw IndexHNSW
+		hnsw.InitWithOptions(1, 16, 4, 40, 16, METRIC_L2)
+
+		var ipq IndexPQ
+		ipq.InitWithOptions(1, 16, 8, 1)
+
+		var ivf IndexIVFFlat
+
+		tests := []struct {
+			name string
+			err  func() error
+			want error
+		}{
+			{
+				name: "test case 1: IndexFlat.Init with invalid dimension",
+				err:  func() error { var iflat IndexFlat; return iflat.Init(10, 0) },
+				want: ErrInvalidParameter,
+			},
+			{
+				name: "test case 2: IndexFlat.Add with dimension mismatch",
+				err:  func() error { return flat.Add(vecs[0][:8]) },
+				want: ErrDimensionMismatch,
+			},
+			{
+				name: "test case 3: IndexFlat.BatchAdd with dimension mismatch",
+				err:  func() error { return flat.BatchAdd([][]float64{vecs[2], vecs[3][:8]}) },
+				want: ErrDimensionMismatch,
+			},
+			{
+				name: "test case 4: IndexFlat.Search with invalid metric",
+				err:  func() error { _, err := flat.Search(vecs[0], 1, MetricType(42)); return err },
+				want: ErrInvalidMetric,
+			},
+			{
+				name: "test case 5: IndexFlat.Search with k = 0",
+				err:  func() error { _, err := flat.Search(vecs[0], 0, METRIC_L2); return err },
+				want: ErrInvalidParameter,
+			},
+			{
+				name: "test case 6: IndexHNSW.Add to a full index",
+				err:  func() error { hnsw.Add(vecs[0]); return hnsw.Add(vecs[1]) },
+				want: ErrIndexFull,
+			},
+			{
+				name: "test case 7: IndexHNSW.Search with another metric",
+				err:  func() error { _, err := hnsw.Search(vecs[0], 1, METRIC_IP); return err },
+				want: ErrMetricMismatch,
+			},
+			{
+				name: "test case 8: IndexPQ.Add before Train",
+				err:  func() error { return ipq.Add(vecs[0]) },
+				want: ErrNotTrained,
+			},
+			{
+				name: "test case 9: IndexPQ.InitWithOptions with d not a multiple of m",
+				err:  func() error { var pq IndexPQ; return pq.InitWithOptions(1, 16, 5, 8) },
+				want: ErrInvalidParameter,
+			},
+			{
+				name: "test case 10: IndexIVFFlat.Search before Train",
+				err:  func() error { _, err := ivf.Search(vecs[0], 1, METRIC_L2); return err },
+				want: ErrNotTrained,
+			},
+			{
+				name: "test case 11: IndexIVFFlat.Train with nlist > size",
+				err:  func() error { return ivf.Train(&flat, 3, 10, 0.001) },
+				want: ErrInvalidParameter,
+			},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				err := tt.err()
+				So(err, ShouldNotBeNil)
+				So(errors.Is(err, tt.want), ShouldBeTrue)
+			})
+		}
+
+		// a failed BatchAdd adds none of the vectors
+		So(flat.Size(), ShouldEqual, 2)
+	})
+}
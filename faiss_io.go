@@ -0,0 +1,850 @@
+package nanofaiss
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/crowaixyz/nanofaiss/pkg/kmeans"
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+// fourcc of the Faiss index types and inverted lists, see faiss/impl/index_write.cpp
+const (
+	faiss_flat_l2_fourcc         = "IxF2"
+	faiss_flat_ip_fourcc         = "IxFI"
+	faiss_ivf_flat_fourcc        = "IwFl"
+	faiss_pq_fourcc              = "IxPq"
+	faiss_ivf_pq_fourcc          = "IwPQ"
+	faiss_hnsw_flat_fourcc       = "IHNf"
+	faiss_array_invlists_fourcc  = "ilar"
+	faiss_full_invlists_fourcc   = "full"
+	faiss_sparse_invlists_fourcc = "sprs"
+)
+
+// metric types of Faiss, there is no cosine metric in Faiss
+const (
+	faiss_metric_inner_product int32 = 0
+	faiss_metric_l2            int32 = 1
+)
+
+// dummy fields of the Faiss index header, kept for backward compatibility by Faiss
+const faiss_header_dummy int64 = 1 << 20
+
+// ReadFaissIndex reads an index written by the C++ / Python Faiss write_index.
+// The supported types are IndexFlatL2 / IndexFlatIP (IxF2 / IxFI) read as *IndexFlat, IndexIVFFlat (IwFl) as
+// *IndexIVFFlat, IndexPQ (IxPq) as *IndexPQ, IndexIVFPQ (IwPQ) as *IndexIVFPQ and IndexHNSWFlat (IHNf) as
+// *IndexHNSW, the metric of the index is returned with it.
+// Faiss stores float32 vectors, they are converted to float64. The capacity of the fixed capacity indexes is the
+// number of vectors read. The ids of IndexIVFFlat should be the positions of the vectors, like after Faiss add.
+func ReadFaissIndex(r io.Reader) (any, MetricType, error) {
+	fr := &faiss_reader{r: r}
+
+	var index any
+	var metric_type MetricType
+	switch fourcc := fr.read_fourcc(); fourcc {
+	case faiss_flat_l2_fourcc, faiss_flat_ip_fourcc:
+		index, metric_type = fr.read_index_flat(fourcc)
+	case faiss_ivf_flat_fourcc:
+		index, metric_type = fr.read_index_ivf_flat()
+	case faiss_pq_fourcc:
+		index, metric_type = fr.read_index_pq()
+	case faiss_ivf_pq_fourcc:
+		index, metric_type = fr.read_index_ivf_pq()
+	case faiss_hnsw_flat_fourcc:
+		index, metric_type = fr.read_index_hnsw()
+	default:
+		fr.fail(fmt.Errorf("unsupported index type %q: %w", fourcc, ErrInvalidFormat))
+	}
+
+	if fr.err != nil {
+		return nil, 0, fmt.Errorf("ReadFaissIndex: %w", fr.err)
+	}
+
+	return index, metric_type, nil
+}
+
+// WriteFaissIndex writes index in the format of Faiss, so that it can be read by the C++ / Python Faiss read_index.
+// index should be an *IndexFlat, *IndexIVFFlat, *IndexPQ, *IndexIVFPQ or *IndexHNSW, metric_type is the metric
+// stored in the Faiss index: METRIC_L2 or METRIC_IP, IndexIVFPQ only supports METRIC_L2 and IndexIVFFlat and
+// IndexHNSW the metric they are built with. The vectors are converted to float32.
+func WriteFaissIndex(w io.Writer, index any, metric_type MetricType) error {
+	if metric_type != METRIC_L2 && metric_type != METRIC_IP {
+		return fmt.Errorf("WriteFaissIndex: %w", ErrInvalidMetric)
+	}
+
+	fw := &faiss_writer{w: w}
+	switch idx := index.(type) {
+	case *IndexFlat:
+		fw.write_index_flat(idx.vec_views(), idx.dim, metric_type)
+	case *IndexIVFFlat:
+		if idx.clusters == nil {
+			return fmt.Errorf("WriteFaissIndex: %w", ErrNotTrained)
+		}
+		if metric_type != idx.metric_type {
+			return fmt.Errorf("WriteFaissIndex: %w", ErrMetricMismatch)
+		}
+		fw.write_index_ivf_flat(idx)
+	case *IndexPQ:
+		if !idx.is_trained {
+			return fmt.Errorf("WriteFaissIndex: %w", ErrNotTrained)
+		}
+		fw.write_index_pq(idx, metric_type)
+	case *IndexIVFPQ:
+		if !idx.is_trained {
+			return fmt.Errorf("WriteFaissIndex: %w", ErrNotTrained)
+		}
+		if metric_type != METRIC_L2 {
+			return fmt.Errorf("WriteFaissIndex: %w", ErrInvalidMetric)
+		}
+		fw.write_index_ivf_pq(idx)
+	case *IndexHNSW:
+		if metric_type != idx.metric_type {
+			return fmt.Errorf("WriteFaissIndex: %w", ErrMetricMismatch)
+		}
+		fw.write_index_hnsw(idx)
+	default:
+		return fmt.Errorf("WriteFaissIndex: unsupported index type %T: %w", index, ErrInvalidParameter)
+	}
+
+	if fw.err != nil {
+		return fmt.Errorf("WriteFaissIndex: %w", fw.err)
+	}
+
+	return nil
+}
+
+// faiss_writer writes the fields of a Faiss index, all numbers are little-endian like on the platforms of Faiss.
+// The first error is sticky, the following writes are no-ops.
+type faiss_writer struct {
+	w   io.Writer
+	err error
+}
+
+func (fw *faiss_writer) write(data any) {
+	if fw.err != nil {
+		return
+	}
+	fw.err = binary.Write(fw.w, binary.LittleEndian, data)
+}
+
+func (fw *faiss_writer) write_fourcc(fourcc string) {
+	fw.write([]byte(fourcc))
+}
+
+// write_vector writes a std::vector like WRITEVECTOR: the number of elements as size_t, then the elements
+func (fw *faiss_writer) write_vector(data any, n int) {
+	fw.write(uint64(n))
+	fw.write(data)
+}
+
+// write_vecs writes the vectors as a std::vector<float> of len(vecs) * d elements
+func (fw *faiss_writer) write_vecs(vecs []mat.VecDense, d int32) {
+	fw.write(uint64(len(vecs)) * uint64(d))
+	for i := range vecs {
+		fw.write(to_float32(vecs[i].RawVector().Data))
+	}
+}
+
+// write_header writes the fields of faiss::Index like write_index_header
+func (fw *faiss_writer) write_header(d int32, ntotal int32, metric_type MetricType) {
+	fw.write(d)
+	fw.write(int64(ntotal))
+	fw.write(faiss_header_dummy)
+	fw.write(faiss_header_dummy)
+	fw.write(uint8(1)) // is_trained
+	if metric_type == METRIC_IP {
+		fw.write(faiss_metric_inner_product)
+	} else {
+		fw.write(faiss_metric_l2)
+	}
+}
+
+func (fw *faiss_writer) write_index_flat(vecs []mat.VecDense, d int32, metric_type MetricType) {
+	if metric_type == METRIC_IP {
+		fw.write_fourcc(faiss_flat_ip_fourcc)
+	} else {
+		fw.write_fourcc(faiss_flat_l2_fourcc)
+	}
+	fw.write_header(d, int32(len(vecs)), metric_type)
+	fw.write_vecs(vecs, d)
+}
+
+// write_ivf_header writes the fields of faiss::IndexIVF like write_ivf_header, the quantizer is an IndexFlatL2
+// of the centroids and there is no direct map
+func (fw *faiss_writer) write_ivf_header(d int32, ntotal int32, centroids []mat.VecDense, metric_type MetricType) {
+	fw.write_header(d, ntotal, metric_type)
+	fw.write(uint64(len(centroids))) // nlist
+	fw.write(uint64(1))              // nprobe
+	fw.write_index_flat(centroids, d, metric_type)
+	fw.write(uint8(0)) // direct map type: NoMap
+	fw.write_vector([]int64{}, 0)
+}
+
+// write_invlists writes an ArrayInvertedLists like write_InvertedLists, the list sizes are stored sparse when
+// at most half of the lists are non empty. codes returns the codes of the vectors of list i.
+func (fw *faiss_writer) write_invlists(ids [][]int32, code_size int, codes func(i int) []byte) {
+	nlist := len(ids)
+	fw.write_fourcc(faiss_array_invlists_fourcc)
+	fw.write(uint64(nlist))
+	fw.write(uint64(code_size))
+
+	non_empty := 0
+	for i := range ids {
+		if len(ids[i]) > 0 {
+			non_empty++
+		}
+	}
+
+	var sizes []uint64
+	if non_empty > nlist/2 {
+		fw.write_fourcc(faiss_full_invlists_fourcc)
+		for i := range ids {
+			sizes = append(sizes, uint64(len(ids[i])))
+		}
+	} else {
+		fw.write_fourcc(faiss_sparse_invlists_fourcc)
+		for i := range ids {
+			if len(ids[i]) > 0 {
+				sizes = append(sizes, uint64(i), uint64(len(ids[i])))
+			}
+		}
+	}
+	fw.write_vector(sizes, len(sizes))
+
+	for i := range ids {
+		if len(ids[i]) == 0 {
+			continue
+		}
+		fw.write(codes(i))
+		list_ids := make([]int64, len(ids[i]))
+		for j, id := range ids[i] {
+			list_ids[j] = int64(id)
+		}
+		fw.write(list_ids)
+	}
+}
+
+func (fw *faiss_writer) write_index_ivf_flat(ivf *IndexIVFFlat) {
+	centroids := make([]mat.VecDense, len(ivf.clusters))
+	for i := range ivf.clusters {
+		centroids[i] = *ivf.clusters[i].Center()
+	}
+
+	fw.write_fourcc(faiss_ivf_flat_fourcc)
+	fw.write_ivf_header(ivf.dim, ivf.size, centroids, ivf.metric_type)
+	fw.write_invlists(ivf.invlists, int(ivf.dim)*4, func(i int) []byte {
+		codes := make([]byte, 0, len(ivf.invlists_vecs[i])*4)
+		for _, v := range ivf.invlists_vecs[i] {
+			codes = binary.LittleEndian.AppendUint32(codes, math.Float32bits(float32(v)))
+		}
+		return codes
+	})
+}
+
+// write_pq writes a faiss::ProductQuantizer like write_ProductQuantizer
+func (fw *faiss_writer) write_pq(pq *product_quantizer) {
+	fw.write(uint64(pq.dim))
+	fw.write(uint64(pq.m))
+	fw.write(uint64(pq.nbits))
+	fw.write_vector(to_float32(pq.centroids), len(pq.centroids))
+}
+
+func (fw *faiss_writer) write_index_pq(ipq *IndexPQ, metric_type MetricType) {
+	fw.write_fourcc(faiss_pq_fourcc)
+	fw.write_header(ipq.dim, ipq.size, metric_type)
+	fw.write_pq(&ipq.pq)
+	fw.write_vector(ipq.codes, len(ipq.codes))
+	fw.write(int32(0))                         // search_type: ST_PQ
+	fw.write(uint8(0))                         // encode_signs
+	fw.write(ipq.pq.m*ipq.pq.nbits + int32(1)) // polysemous_ht, the default of Faiss
+}
+
+func (fw *faiss_writer) write_index_ivf_pq(ivfpq *IndexIVFPQ) {
+	fw.write_fourcc(faiss_ivf_pq_fourcc)
+	fw.write_ivf_header(ivfpq.dim, ivfpq.size, ivfpq.centroids, METRIC_L2)
+	fw.write(uint8(1)) // by_residual
+	fw.write(uint64(ivfpq.pq.code_size))
+	fw.write_pq(&ivfpq.pq)
+	fw.write_invlists(ivfpq.invlists_ids, int(ivfpq.pq.code_size), func(i int) []byte {
+		return ivfpq.invlists_codes[i]
+	})
+}
+
+// write_index_hnsw writes an IndexHNSWFlat, the graph is stored like faiss::HNSW: the neighbors of all nodes
+// in one array, node i owns cum_nneighbor_per_level[levels[i]] slots from offsets[i], unused slots are -1
+func (fw *faiss_writer) write_index_hnsw(hnsw *IndexHNSW) {
+	// step 1. the level probabilities and neighbor counts of HNSW::set_default_probas, extended to max_level.
+	// Faiss takes level_mult as a float, divides in float and stores every probability in a float.
+	level_mult := float32(1 / math.Log(float64(hnsw.m)))
+	assign_probas := []float64{}
+	cum_nneighbor_per_level := []int32{0}
+	for level := int32(0); ; level++ {
+		proba := float32(math.Exp(float64(-float32(level)/level_mult)) * (1 - math.Exp(float64(-1/level_mult))))
+		if proba < 1e-9 && level > hnsw.max_level {
+			break
+		}
+		assign_probas = append(assign_probas, float64(proba))
+		cum_nneighbor_per_level = append(cum_nneighbor_per_level, cum_nneighbor_per_level[level]+hnsw.max_neighbors(level))
+	}
+
+	// step 2. flatten the adjacency lists
+	levels := make([]int32, hnsw.size)
+	offsets := make([]uint64, hnsw.size+1)
+	neighbors := []int32{}
+	for i := int32(0); i < hnsw.size; i++ {
+		levels[i] = hnsw.levels[i] + 1 // number of layers of the node in Faiss
+		for l := int32(0); l <= hnsw.levels[i]; l++ {
+			neighbors = append(neighbors, hnsw.neighbors[i][l]...)
+			for j := int32(len(hnsw.neighbors[i][l])); j < hnsw.max_neighbors(l); j++ {
+				neighbors = append(neighbors, -1)
+			}
+		}
+		offsets[i+1] = uint64(len(neighbors))
+	}
+
+	fw.write_fourcc(faiss_hnsw_flat_fourcc)
+	fw.write_header(hnsw.dim, hnsw.size, hnsw.metric_type)
+	fw.write_vector(assign_probas, len(assign_probas))
+	fw.write_vector(cum_nneighbor_per_level, len(cum_nneighbor_per_level))
+	fw.write_vector(levels, len(levels))
+	fw.write_vector(offsets, len(offsets))
+	fw.write_vector(neighbors, len(neighbors))
+	fw.write(hnsw.entry_point)
+	fw.write(hnsw.max_level)
+	fw.write(hnsw.ef_construction)
+	fw.write(hnsw.ef_search)
+	fw.write(int32(1)) // upper_beam
+	fw.write_index_flat(hnsw.vecs[:hnsw.size], hnsw.dim, hnsw.metric_type)
+}
+
+// faiss_reader reads the fields of a Faiss index.
+// The first error is sticky, the following reads return zero values.
+type faiss_reader struct {
+	r   io.Reader
+	err error
+}
+
+func (fr *faiss_reader) fail(err error) {
+	if fr.err == nil {
+		fr.err = err
+	}
+}
+
+func (fr *faiss_reader) read(data any) {
+	if fr.err != nil {
+		return
+	}
+
+	fr.err = binary.Read(fr.r, binary.LittleEndian, data)
+	if fr.err == io.EOF {
+		fr.err = io.ErrUnexpectedEOF
+	}
+}
+
+func (fr *faiss_reader) read_fourcc() string {
+	fourcc := make([]byte, 4)
+	fr.read(fourcc)
+	return string(fourcc)
+}
+
+func (fr *faiss_reader) read_int32() int32 {
+	var v int32
+	fr.read(&v)
+	return v
+}
+
+func (fr *faiss_reader) read_uint8() uint8 {
+	var v uint8
+	fr.read(&v)
+	return v
+}
+
+// read_size reads a size_t which should be in [lo, hi]
+func (fr *faiss_reader) read_size(lo int, hi int) int {
+	var v uint64
+	fr.read(&v)
+	if fr.err == nil && (v < uint64(lo) || v > uint64(hi)) {
+		fr.fail(fmt.Errorf("size %d out of [%d, %d]: %w", v, lo, hi, ErrInvalidFormat))
+		return 0
+	}
+	return int(v)
+}
+
+// read_chunks reads n elements of size bytes chunk by chunk, so a corrupted size fails at the end of the data
+// instead of allocating it, fn is called with the bytes of every chunk
+func (fr *faiss_reader) read_chunks(n int, size int, fn func(chunk []byte)) {
+	buf := make([]byte, min(n, index_io_read_chunk)*size)
+	for read := 0; read < n && fr.err == nil; {
+		chunk := buf[:min(n-read, index_io_read_chunk)*size]
+		fr.read(chunk)
+		if fr.err == nil {
+			fn(chunk)
+		}
+		read += len(chunk) / size
+	}
+}
+
+// read_float32s reads n float32 and converts them to float64
+func (fr *faiss_reader) read_float32s(n int) []float64 {
+	data := make([]float64, 0, min(n, index_io_read_chunk))
+	fr.read_chunks(n, 4, func(chunk []byte) {
+		for i := 0; i < len(chunk); i += 4 {
+			data = append(data, float64(math.Float32frombits(binary.LittleEndian.Uint32(chunk[i:]))))
+		}
+	})
+	return data
+}
+
+func (fr *faiss_reader) read_int32s(n int) []int32 {
+	data := make([]int32, 0, min(n, index_io_read_chunk))
+	fr.read_chunks(n, 4, func(chunk []byte) {
+		for i := 0; i < len(chunk); i += 4 {
+			data = append(data, int32(binary.LittleEndian.Uint32(chunk[i:])))
+		}
+	})
+	return data
+}
+
+func (fr *faiss_reader) read_int64s(n int) []int64 {
+	data := make([]int64, 0, min(n, index_io_read_chunk))
+	fr.read_chunks(n, 8, func(chunk []byte) {
+		for i := 0; i < len(chunk); i += 8 {
+			data = append(data, int64(binary.LittleEndian.Uint64(chunk[i:])))
+		}
+	})
+	return data
+}
+
+// skip reads and drops n elements of size bytes
+func (fr *faiss_reader) skip(n int, size int) {
+	fr.read_chunks(n, size, func(chunk []byte) {})
+}
+
+func (fr *faiss_reader) read_bytes(n int) []byte {
+	data := make([]byte, 0, min(n, index_io_read_chunk))
+	fr.read_chunks(n, 1, func(chunk []byte) {
+		data = append(data, chunk...)
+	})
+	return data
+}
+
+// read_vector_size reads the size of a std::vector written by WRITEVECTOR
+func (fr *faiss_reader) read_vector_size() int {
+	return fr.read_size(0, math.MaxInt32)
+}
+
+// read_vecs reads a std::vector<float> of n vectors of dimension d
+func (fr *faiss_reader) read_vecs(n int, d int32) []mat.VecDense {
+	if size := fr.read_size(0, math.MaxInt64); fr.err == nil && uint64(size) != uint64(n)*uint64(d) {
+		fr.fail(fmt.Errorf("vectors size %d is not %d * %d: %w", size, n, d, ErrInvalidFormat))
+	}
+
+	vecs := make([]mat.VecDense, 0, min(n, index_io_read_chunk))
+	for i := 0; i < n && fr.err == nil; i++ {
+		data := fr.read_float32s(int(d))
+		if fr.err == nil {
+			vecs = append(vecs, *mat.NewVecDense(int(d), data))
+		}
+	}
+	return vecs
+}
+
+// faiss_index_header is the header of every faiss::Index
+type faiss_index_header struct {
+	d           int32
+	ntotal      int32
+	metric_type MetricType
+}
+
+// read_header reads the fields of faiss::Index like read_index_header
+func (fr *faiss_reader) read_header() faiss_index_header {
+	var h faiss_index_header
+	h.d = fr.read_int32()
+	var ntotal int64
+	fr.read(&ntotal)
+	fr.read(make([]int64, 2)) // dummy
+	is_trained := fr.read_uint8()
+	metric := fr.read_int32()
+	if fr.err != nil {
+		return h
+	}
+
+	if h.d <= 0 || ntotal < 0 || ntotal > math.MaxInt32 {
+		fr.fail(fmt.Errorf("invalid dimension %d or number of vectors %d: %w", h.d, ntotal, ErrInvalidFormat))
+	}
+	if is_trained == 0 {
+		fr.fail(ErrNotTrained)
+	}
+	switch metric {
+	case faiss_metric_l2:
+		h.metric_type = METRIC_L2
+	case faiss_metric_inner_product:
+		h.metric_type = METRIC_IP
+	default:
+		fr.fail(fmt.Errorf("unsupported Faiss metric %d: %w", metric, ErrInvalidMetric))
+	}
+	h.ntotal = int32(ntotal)
+
+	return h
+}
+
+func (fr *faiss_reader) read_index_flat(fourcc string) (*IndexFlat, MetricType) {
+	h := fr.read_header()
+	if fr.err == nil && (fourcc == faiss_flat_l2_fourcc) != (h.metric_type == METRIC_L2) {
+		fr.fail(fmt.Errorf("metric of %q is not %d: %w", fourcc, h.metric_type, ErrInvalidFormat))
+	}
+	vecs := fr.read_vecs(int(h.ntotal), h.d)
+	if fr.err != nil {
+		return nil, 0
+	}
+
+	data := make([]float64, 0, len(vecs)*int(h.d))
+	for i := range vecs {
+		data = append(data, vecs[i].RawVector().Data...)
+	}
+
+	return &IndexFlat{IndexFlatT[float64]{size: h.ntotal, dim: h.d, data: data}}, h.metric_type
+}
+
+// read_quantizer reads the flat L2 coarse quantizer of an IVF index of dimension d, it returns the centroids
+func (fr *faiss_reader) read_quantizer(h faiss_index_header, nlist int) []mat.VecDense {
+	d := h.d
+	fourcc := fr.read_fourcc()
+	if fr.err == nil && (h.metric_type == METRIC_L2 && fourcc != faiss_flat_l2_fourcc || h.metric_type == METRIC_IP && fourcc != faiss_flat_ip_fourcc) {
+		fr.fail(fmt.Errorf("unsupported quantizer type %q: %w", fourcc, ErrInvalidFormat))
+	}
+
+	quantizer, _ := fr.read_index_flat(fourcc)
+	if fr.err == nil && (quantizer.dim != d || int(quantizer.size) != nlist) {
+		fr.fail(fmt.Errorf("quantizer is not %d centroids of dimension %d: %w", nlist, d, ErrInvalidFormat))
+	}
+	if fr.err != nil {
+		return nil
+	}
+
+	return quantizer.vec_views()
+}
+
+// read_ivf_header reads the fields of faiss::IndexIVF like read_ivf_header, the quantizer should be a flat index
+// of the metric of the IVF index
+func (fr *faiss_reader) read_ivf_header() (faiss_index_header, []mat.VecDense) {
+	h := fr.read_header()
+	nlist := fr.read_size(1, math.MaxInt32)
+	fr.read_size(0, math.MaxInt64) // nprobe
+	centroids := fr.read_quantizer(h, nlist)
+
+	// direct map, not used
+	direct_map_type := fr.read_uint8()
+	if direct_map_type > 2 {
+		fr.fail(fmt.Errorf("unsupported direct map type %d: %w", direct_map_type, ErrInvalidFormat))
+	}
+	fr.skip(fr.read_vector_size(), 8)
+	if direct_map_type == 2 { // hashtable, pairs of int64
+		fr.skip(fr.read_vector_size(), 16)
+	}
+
+	return h, centroids
+}
+
+// read_invlists reads ArrayInvertedLists like read_InvertedLists, it returns the ids and codes of every list
+func (fr *faiss_reader) read_invlists(nlist int, code_size int) ([][]int64, [][]byte) {
+	fourcc := fr.read_fourcc()
+	if fr.err == nil && fourcc != faiss_array_invlists_fourcc {
+		fr.fail(fmt.Errorf("unsupported inverted lists type %q: %w", fourcc, ErrInvalidFormat))
+	}
+	fr.read_size(nlist, nlist)
+	fr.read_size(code_size, code_size)
+
+	sizes := make([]int, nlist)
+	list_type := fr.read_fourcc()
+	switch {
+	case fr.err != nil:
+	case list_type == faiss_full_invlists_fourcc:
+		fr.read_size(nlist, nlist)
+		for i := 0; i < nlist && fr.err == nil; i++ {
+			sizes[i] = fr.read_size(0, math.MaxInt32)
+		}
+	case list_type == faiss_sparse_invlists_fourcc:
+		n := fr.read_size(0, 2*nlist)
+		for i := 0; i < n/2 && fr.err == nil; i++ {
+			list_no := fr.read_size(0, nlist-1)
+			sizes[list_no] = fr.read_size(0, math.MaxInt32)
+		}
+	default:
+		fr.fail(fmt.Errorf("unsupported inverted lists sizes %q: %w", list_type, ErrInvalidFormat))
+	}
+
+	ids := make([][]int64, nlist)
+	codes := make([][]byte, nlist)
+	for i := 0; i < nlist && fr.err == nil; i++ {
+		if sizes[i] > 0 {
+			codes[i] = fr.read_bytes(sizes[i] * code_size)
+			ids[i] = fr.read_int64s(sizes[i])
+		}
+	}
+
+	return ids, codes
+}
+
+// read_ids converts the ids of the inverted lists to int32, they should be in [0, math.MaxInt32) and there
+// should be ntotal of them
+func (fr *faiss_reader) read_ids(lists [][]int64, ntotal int32) [][]int32 {
+	ids := make([][]int32, len(lists))
+	size := 0
+	for i := range lists {
+		for _, id := range lists[i] {
+			if id < 0 || id >= math.MaxInt32 {
+				fr.fail(fmt.Errorf("id %d out of range: %w", id, ErrInvalidFormat))
+				return nil
+			}
+			ids[i] = append(ids[i], int32(id))
+		}
+		size += len(ids[i])
+	}
+	if fr.err == nil && size != int(ntotal) {
+		fr.fail(fmt.Errorf("inverted lists have %d vectors instead of %d: %w", size, ntotal, ErrInvalidFormat))
+	}
+	return ids
+}
+
+func (fr *faiss_reader) read_index_ivf_flat() (*IndexIVFFlat, MetricType) {
+	h, centroids := fr.read_ivf_header()
+	lists, codes := fr.read_invlists(len(centroids), int(h.d)*4)
+	invlists := fr.read_ids(lists, h.ntotal)
+	if fr.err != nil {
+		return nil, 0
+	}
+
+	// the vectors stay in their lists, which are sorted by id, the ids should be unique
+	d := int(h.d)
+	next_id := int32(0)
+	seen := make(map[int32]bool, h.ntotal)
+	invlists_vecs := make([][]float64, len(invlists))
+	for i := range invlists {
+		order := make([]int, len(invlists[i]))
+		for j, id := range invlists[i] {
+			if seen[id] {
+				fr.fail(fmt.Errorf("id %d: %w", id, ErrDuplicateID))
+				return nil, 0
+			}
+			seen[id] = true
+			next_id = max(next_id, id+1)
+			order[j] = j
+		}
+		sort.Slice(order, func(a, b int) bool {
+			return invlists[i][order[a]] < invlists[i][order[b]]
+		})
+
+		ids := make([]int32, len(order))
+		invlists_vecs[i] = make([]float64, len(order)*d)
+		for j, k := range order {
+			ids[j] = invlists[i][k]
+			for l := 0; l < d; l++ {
+				invlists_vecs[i][j*d+l] = float64(math.Float32frombits(binary.LittleEndian.Uint32(codes[i][(k*d+l)*4:])))
+			}
+		}
+		invlists[i] = ids
+	}
+
+	ivf := &IndexIVFFlat{
+		size:          h.ntotal,
+		cap:           h.ntotal,
+		dim:           h.d,
+		next_id:       next_id,
+		metric_type:   h.metric_type,
+		nlist:         int32(len(centroids)),
+		clusters:      make([]kmeans.Cluster, len(centroids)),
+		invlists:      invlists,
+		invlists_vecs: invlists_vecs,
+	}
+	for i := range ivf.clusters {
+		ivf.clusters[i] = kmeans.NewCluster(centroids[i], invlists[i])
+	}
+	if err := ivf.build_quantizer(nil); err != nil {
+		fr.fail(err)
+		return nil, 0
+	}
+
+	return ivf, h.metric_type
+}
+
+// read_pq reads a faiss::ProductQuantizer like read_ProductQuantizer
+func (fr *faiss_reader) read_pq(pq *product_quantizer) {
+	d := fr.read_size(1, math.MaxInt32)
+	m := fr.read_size(1, math.MaxInt32)
+	nbits := fr.read_size(1, math.MaxInt32)
+	if fr.err != nil {
+		return
+	}
+	if err := pq.init(int32(d), int32(m), int32(nbits)); err != nil {
+		fr.fail(fmt.Errorf("unsupported product quantizer d = %d, M = %d, nbits = %d: %w", d, m, nbits, ErrInvalidFormat))
+		return
+	}
+
+	n := fr.read_vector_size()
+	if fr.err == nil && n != int(pq.m*pq.ksub*pq.dsub) {
+		fr.fail(fmt.Errorf("centroids size %d is not M * ksub * dsub: %w", n, ErrInvalidFormat))
+	}
+	pq.centroids = fr.read_float32s(n)
+	if fr.err != nil {
+		return
+	}
+
+	pq.centroid_norms = make([]float64, pq.m*pq.ksub)
+	for i := int32(0); i < pq.m; i++ {
+		for j := int32(0); j < pq.ksub; j++ {
+			c := pq.centroid(i, j)
+			pq.centroid_norms[i*pq.ksub+j] = utils.InnerProductT(c, c)
+		}
+	}
+}
+
+func (fr *faiss_reader) read_index_pq() (*IndexPQ, MetricType) {
+	h := fr.read_header()
+	ipq := &IndexPQ{size: h.ntotal, cap: h.ntotal, dim: h.d, is_trained: true}
+	fr.read_pq(&ipq.pq)
+	if fr.err == nil && ipq.pq.dim != h.d {
+		fr.fail(fmt.Errorf("product quantizer dimension %d is not %d: %w", ipq.pq.dim, h.d, ErrInvalidFormat))
+	}
+
+	n := fr.read_vector_size()
+	if fr.err == nil && n != int(h.ntotal)*int(ipq.pq.code_size) {
+		fr.fail(fmt.Errorf("codes size %d is not ntotal * code_size: %w", n, ErrInvalidFormat))
+	}
+	ipq.codes = fr.read_bytes(n)
+	fr.read_int32() // search_type
+	fr.read_uint8() // encode_signs
+	fr.read_int32() // polysemous_ht
+	if fr.err != nil {
+		return nil, 0
+	}
+
+	return ipq, h.metric_type
+}
+
+func (fr *faiss_reader) read_index_ivf_pq() (*IndexIVFPQ, MetricType) {
+	h, centroids := fr.read_ivf_header()
+	if fr.err == nil && h.metric_type != METRIC_L2 {
+		fr.fail(fmt.Errorf("IVFPQ index only supports L2: %w", ErrInvalidMetric))
+	}
+	if by_residual := fr.read_uint8(); fr.err == nil && by_residual == 0 {
+		fr.fail(fmt.Errorf("IVFPQ without residual encoding is not supported: %w", ErrInvalidFormat))
+	}
+	code_size := fr.read_size(0, math.MaxInt32)
+
+	ivfpq := &IndexIVFPQ{
+		size:       h.ntotal,
+		cap:        h.ntotal,
+		dim:        h.d,
+		nlist:      int32(len(centroids)),
+		centroids:  centroids,
+		is_trained: true,
+	}
+	fr.read_pq(&ivfpq.pq)
+	if fr.err == nil && (ivfpq.pq.dim != h.d || int(ivfpq.pq.code_size) != code_size) {
+		fr.fail(fmt.Errorf("product quantizer does not match the index: %w", ErrInvalidFormat))
+	}
+
+	lists, codes := fr.read_invlists(len(centroids), code_size)
+	ivfpq.invlists_ids = fr.read_ids(lists, h.ntotal)
+	ivfpq.invlists_codes = codes
+	if fr.err != nil {
+		return nil, 0
+	}
+
+	return ivfpq, h.metric_type
+}
+
+func (fr *faiss_reader) read_index_hnsw() (*IndexHNSW, MetricType) {
+	h := fr.read_header()
+
+	// step 1. read the graph
+	fr.skip(fr.read_vector_size(), 8) // assign_probas
+	cum_nneighbor_per_level := fr.read_int32s(fr.read_vector_size())
+	levels := fr.read_int32s(fr.read_vector_size())
+	offsets := fr.read_int64s(fr.read_vector_size())
+	neighbors := fr.read_int32s(fr.read_vector_size())
+	entry_point := fr.read_int32()
+	max_level := fr.read_int32()
+	ef_construction := fr.read_int32()
+	ef_search := fr.read_int32()
+	fr.read_int32() // upper_beam
+
+	// step 2. read the storage, it has the same metric as the index
+	fourcc := fr.read_fourcc()
+	if fr.err == nil && fourcc != faiss_flat_l2_fourcc && fourcc != faiss_flat_ip_fourcc {
+		fr.fail(fmt.Errorf("unsupported HNSW storage type %q: %w", fourcc, ErrInvalidFormat))
+	}
+	storage, storage_metric_type := fr.read_index_flat(fourcc)
+	if fr.err != nil {
+		return nil, 0
+	}
+
+	// step 3. check the graph
+	n := int(h.ntotal)
+	if storage.dim != h.d || storage.size != h.ntotal || storage_metric_type != h.metric_type ||
+		len(cum_nneighbor_per_level) < 2 || cum_nneighbor_per_level[0] != 0 || cum_nneighbor_per_level[1] < 2 ||
+		len(levels) != n || len(offsets) != n+1 || offsets[0] != 0 || offsets[n] != int64(len(neighbors)) ||
+		(n == 0) != (entry_point < 0) || entry_point >= h.ntotal || max_level >= int32(len(cum_nneighbor_per_level)) {
+		fr.fail(fmt.Errorf("invalid HNSW graph: %w", ErrInvalidFormat))
+		return nil, 0
+	}
+	for l := 1; l < len(cum_nneighbor_per_level); l++ {
+		if cum_nneighbor_per_level[l] < cum_nneighbor_per_level[l-1] {
+			fr.fail(fmt.Errorf("invalid HNSW neighbor counts: %w", ErrInvalidFormat))
+			return nil, 0
+		}
+	}
+
+	// step 4. split the neighbors of every node by layer, up to the first unused slot
+	hnsw := &IndexHNSW{}
+	if err := hnsw.InitWithOptions(h.ntotal, h.d, cum_nneighbor_per_level[1]/2, ef_construction, ef_search, h.metric_type); err != nil {
+		fr.fail(fmt.Errorf("invalid HNSW parameters: %w", ErrInvalidFormat))
+		return nil, 0
+	}
+	copy(hnsw.vecs, storage.vec_views())
+	hnsw.size = h.ntotal
+	hnsw.entry_point = entry_point
+	hnsw.max_level = max_level
+	for i := 0; i < n; i++ {
+		if levels[i] < 1 || levels[i] >= int32(len(cum_nneighbor_per_level)) ||
+			offsets[i+1]-offsets[i] != int64(cum_nneighbor_per_level[levels[i]]) {
+			fr.fail(fmt.Errorf("invalid HNSW levels of node %d: %w", i, ErrInvalidFormat))
+			return nil, 0
+		}
+
+		hnsw.levels = append(hnsw.levels, levels[i]-1)
+		hnsw.neighbors = append(hnsw.neighbors, make([][]int32, levels[i]))
+		for l := int32(0); l < levels[i]; l++ {
+			begin := offsets[i] + int64(cum_nneighbor_per_level[l])
+			end := offsets[i] + int64(cum_nneighbor_per_level[l+1])
+			hnsw.neighbors[i][l] = []int32{}
+			for _, nb := range neighbors[begin:end] {
+				if nb < 0 {
+					break
+				}
+				if nb >= h.ntotal {
+					fr.fail(fmt.Errorf("invalid HNSW neighbor %d: %w", nb, ErrInvalidFormat))
+					return nil, 0
+				}
+				hnsw.neighbors[i][l] = append(hnsw.neighbors[i][l], nb)
+			}
+		}
+	}
+
+	return hnsw, h.metric_type
+}
+
+// to_float32 converts x to float32, Faiss stores float32 vectors
+func to_float32(x []float64) []float32 {
+	y := make([]float32, len(x))
+	for i := range x {
+		y[i] = float32(x[i])
+	}
+	return y
+}
@@ -0,0 +1,269 @@
+package nanofaiss
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// the golden files are packed by hand with struct in testdata/faiss/pack_golden.py, following the layout of
+// faiss/impl/index_write.cpp, they are not written by Faiss itself yet: testdata/faiss/gen_golden.py writes the
+// same indexes with faiss.write_index and should replace them once it is run with faiss-cpu
+func read_golden(name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", "faiss", name))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestReadFaissIndex(t *testing.T) {
+	Convey("ReadFaissIndex", t, func() {
+		golden_vecs := [][]float64{{0.5, 1.25, -2.0, 3.0}, {-1.5, 0.25, 4.0, -0.75}, {2.0, -3.5, 0.125, 1.0}}
+
+		tests := []struct {
+			name        string
+			file        string
+			metric_type MetricType
+		}{
+			{name: "test case 1: IndexFlatL2", file: "flat_l2.faissindex", metric_type: METRIC_L2},
+			{name: "test case 2: IndexFlatIP", file: "flat_ip.faissindex", metric_type: METRIC_IP},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				data := read_golden(tt.file)
+				index, metric_type, err := ReadFaissIndex(bytes.NewReader(data))
+				So(err, ShouldBeNil)
+				So(metric_type, ShouldEqual, tt.metric_type)
+
+				flat, ok := index.(*IndexFlat)
+				So(ok, ShouldBeTrue)
+				So(flat.Size(), ShouldEqual, len(golden_vecs))
+				for i := range golden_vecs {
+					So(flat.vector(int32(i)), ShouldResemble, golden_vecs[i])
+				}
+
+				// writing the index back gives the same bytes
+				var buf bytes.Buffer
+				So(WriteFaissIndex(&buf, flat, metric_type), ShouldBeNil)
+				So(buf.Bytes(), ShouldResemble, data)
+			})
+		}
+
+		Convey("test case 3: IndexIVFFlat", func() {
+			data := read_golden("ivf_flat.faissindex")
+			index, metric_type, err := ReadFaissIndex(bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			So(metric_type, ShouldEqual, METRIC_L2)
+
+			ivf, ok := index.(*IndexIVFFlat)
+			So(ok, ShouldBeTrue)
+			So(ivf.invlists, ShouldResemble, [][]int32{{0, 2}, {1, 3}})
+			So(ivf.list_vector(1, 1), ShouldResemble, []float64{11, 10})
+
+			result, err := ivf.Search([]float64{10.5, 10.6}, 2, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(result.Vecs, ShouldResemble, [][]float64{{10, 11}, {11, 10}})
+
+			var buf bytes.Buffer
+			So(WriteFaissIndex(&buf, ivf, METRIC_L2), ShouldBeNil)
+			So(buf.Bytes(), ShouldResemble, data)
+		})
+
+		Convey("test case 4: IndexPQ", func() {
+			data := read_golden("pq.faissindex")
+			index, metric_type, err := ReadFaissIndex(bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			So(metric_type, ShouldEqual, METRIC_L2)
+
+			ipq, ok := index.(*IndexPQ)
+			So(ok, ShouldBeTrue)
+			So(ipq.IsTrained(), ShouldBeTrue)
+			So(ipq.pq.ksub, ShouldEqual, 4)
+
+			// code 1 of sub-quantizer 0 and code 2 of sub-quantizer 1
+			x, err := ipq.Reconstruct(0)
+			So(err, ShouldBeNil)
+			So(x, ShouldResemble, []float64{0.5, 0.75, 3, 3.25})
+
+			var buf bytes.Buffer
+			So(WriteFaissIndex(&buf, ipq, METRIC_L2), ShouldBeNil)
+			So(buf.Bytes(), ShouldResemble, data)
+		})
+
+		Convey("test case 5: IndexIVFPQ", func() {
+			data := read_golden("ivf_pq.faissindex")
+			index, metric_type, err := ReadFaissIndex(bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			So(metric_type, ShouldEqual, METRIC_L2)
+
+			ivfpq, ok := index.(*IndexIVFPQ)
+			So(ok, ShouldBeTrue)
+			So(ivfpq.invlists_ids, ShouldResemble, [][]int32{nil, {0, 2}, nil, {1}})
+			So(ivfpq.invlists_codes[3], ShouldResemble, []byte{4})
+
+			// the residual of id 1 is code 0 of sub-quantizer 0 and code 1 of sub-quantizer 1, plus centroid 3
+			So(ivfpq.SetNprobe(4), ShouldBeNil)
+			result, err := ivfpq.Search([]float64{3, 3, 5, 5}, 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(result.Idxs, ShouldResemble, []int32{1})
+			So(result.Vecs, ShouldResemble, [][]float64{{3, 3.25, 5.5, 5.75}})
+
+			var buf bytes.Buffer
+			So(WriteFaissIndex(&buf, ivfpq, METRIC_L2), ShouldBeNil)
+			So(buf.Bytes(), ShouldResemble, data)
+		})
+
+		Convey("test case 6: IndexHNSWFlat", func() {
+			data := read_golden("hnsw_flat.faissindex")
+			index, metric_type, err := ReadFaissIndex(bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			So(metric_type, ShouldEqual, METRIC_L2)
+
+			hnsw, ok := index.(*IndexHNSW)
+			So(ok, ShouldBeTrue)
+			So(hnsw.m, ShouldEqual, 2)
+			So(hnsw.levels, ShouldResemble, []int32{0, 1, 0})
+			So(hnsw.neighbors, ShouldResemble, [][][]int32{{{1, 2}}, {{0, 2}, {}}, {{0, 1}}})
+			So(hnsw.entry_point, ShouldEqual, 1)
+
+			result, err := hnsw.Search([]float64{1.9, 0.1}, 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(result.Idxs, ShouldResemble, []int32{2})
+
+			// the level probabilities are computed in float32 by Faiss, so the graph is compared instead of the bytes
+			var buf bytes.Buffer
+			So(WriteFaissIndex(&buf, hnsw, METRIC_L2), ShouldBeNil)
+			index, _, err = ReadFaissIndex(&buf)
+			So(err, ShouldBeNil)
+			So(index.(*IndexHNSW).neighbors, ShouldResemble, hnsw.neighbors)
+			So(index.(*IndexHNSW).vecs, ShouldResemble, hnsw.vecs)
+		})
+	})
+}
+
+func TestWriteFaissIndex(t *testing.T) {
+	// training is done once, goconvey runs the top-level func for every leaf Convey
+	n, d := 1000, 16
+	xb := random_vecs(n, d, 11)
+	for i := range xb {
+		for j := range xb[i] {
+			xb[i][j] = float64(float32(xb[i][j])) // exactly representable in the float32 files
+		}
+	}
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	var ivf IndexIVFFlat
+	ivf.Train(&flat, 8, 10, 0.001)
+
+	var index_hnsw IndexHNSW
+	index_hnsw.InitWithOptions(int32(n), int32(d), 8, 40, 16, METRIC_IP)
+	index_hnsw.BatchAdd(xb)
+
+	Convey("WriteFaissIndex", t, func() {
+		Convey("test case 1: IndexIVFFlat", func() {
+			var buf bytes.Buffer
+			So(WriteFaissIndex(&buf, &ivf, METRIC_L2), ShouldBeNil)
+			index, _, err := ReadFaissIndex(&buf)
+			So(err, ShouldBeNil)
+
+			got := index.(*IndexIVFFlat)
+			So(got.invlists, ShouldResemble, ivf.invlists)
+			for i, ids := range got.invlists {
+				for j, id := range ids {
+					So(got.list_vector(int32(i), j), ShouldResemble, xb[id])
+				}
+			}
+		})
+
+		Convey("test case 2: IndexIVFFlat with removed and large ids", func() {
+			var removed IndexIVFFlat
+			So(removed.Train(&flat, 8, 10, 0.001), ShouldBeNil)
+			So(removed.SetNprobe(8), ShouldBeNil)
+			So(removed.RemoveIDs(NewIDSelectorRange(0, 50)), ShouldEqual, 50)
+
+			// read it back from the Faiss file, then through the native format
+			var buf bytes.Buffer
+			So(WriteFaissIndex(&buf, &removed, METRIC_L2), ShouldBeNil)
+			index, _, err := ReadFaissIndex(&buf)
+			So(err, ShouldBeNil)
+			got := index.(*IndexIVFFlat)
+			So(got.WriteIndex(&buf), ShouldBeNil)
+			So(got.ReadIndex(&buf), ShouldBeNil)
+			So(got.size, ShouldEqual, n-50)
+			So(got.invlists, ShouldResemble, removed.invlists)
+			So(got.SetNprobe(8), ShouldBeNil)
+			for _, q := range xb[:20] {
+				want, err := removed.Search(q, 5, METRIC_L2)
+				So(err, ShouldBeNil)
+				result, err := got.Search(q, 5, METRIC_L2)
+				So(err, ShouldBeNil)
+				So(result, ShouldResemble, want)
+			}
+
+			// the ids of a Faiss index are not bounded by the number of vectors
+			for i := range removed.invlists {
+				for j := range removed.invlists[i] {
+					removed.invlists[i][j] += math.MaxInt32 - int32(n)
+				}
+			}
+			So(WriteFaissIndex(&buf, &removed, METRIC_L2), ShouldBeNil)
+			index, _, err = ReadFaissIndex(&buf)
+			So(err, ShouldBeNil)
+			got = index.(*IndexIVFFlat)
+			So(got.next_id, ShouldEqual, math.MaxInt32)
+			So(got.invlists, ShouldResemble, removed.invlists)
+			So(got.WriteIndex(&buf), ShouldBeNil)
+			So(got.ReadIndex(&buf), ShouldBeNil)
+			So(got.invlists_vecs, ShouldResemble, removed.invlists_vecs)
+
+			// but they should be unique
+			removed.invlists[1][0] = removed.invlists[0][0]
+			So(WriteFaissIndex(&buf, &removed, METRIC_L2), ShouldBeNil)
+			_, _, err = ReadFaissIndex(&buf)
+			So(errors.Is(err, ErrDuplicateID), ShouldBeTrue)
+		})
+
+		Convey("test case 3: IndexHNSW", func() {
+			var buf bytes.Buffer
+			So(WriteFaissIndex(&buf, &index_hnsw, METRIC_IP), ShouldBeNil)
+			index, metric_type, err := ReadFaissIndex(&buf)
+			So(err, ShouldBeNil)
+			So(metric_type, ShouldEqual, METRIC_IP)
+
+			got := index.(*IndexHNSW)
+			So(got.levels, ShouldResemble, index_hnsw.levels)
+			So(got.neighbors, ShouldResemble, index_hnsw.neighbors)
+			for _, q := range xb[:20] {
+				want, err := index_hnsw.Search(q, 5, METRIC_IP)
+				So(err, ShouldBeNil)
+				result, err := got.Search(q, 5, METRIC_IP)
+				So(err, ShouldBeNil)
+				So(result.Idxs, ShouldResemble, want.Idxs)
+			}
+		})
+
+		Convey("test case 4: errors", func() {
+			var buf bytes.Buffer
+			So(errors.Is(WriteFaissIndex(&buf, &flat, METRIC_COSINE), ErrInvalidMetric), ShouldBeTrue)
+			So(errors.Is(WriteFaissIndex(&buf, &ivf, METRIC_IP), ErrMetricMismatch), ShouldBeTrue)
+			So(errors.Is(WriteFaissIndex(&buf, &index_hnsw, METRIC_L2), ErrMetricMismatch), ShouldBeTrue)
+			So(errors.Is(WriteFaissIndex(&buf, &IndexLSH{}, METRIC_L2), ErrInvalidParameter), ShouldBeTrue)
+
+			data := read_golden("ivf_flat.faissindex")
+			_, _, err := ReadFaissIndex(bytes.NewReader(data[:len(data)-3]))
+			So(err, ShouldNotBeNil)
+			_, _, err = ReadFaissIndex(bytes.NewReader(append([]byte("IxXX"), data[4:]...)))
+			So(errors.Is(err, ErrInvalidFormat), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,61 @@
+package nanofaiss
+
+// IDSelector selects a subset of vectors by their ids, eg. the vectors to remove
+type IDSelector interface {
+	IsMember(id int64) bool
+}
+
+// IDSelectorBatch selects the ids of a list
+type IDSelectorBatch struct {
+	ids map[int64]bool
+}
+
+func NewIDSelectorBatch(ids []int64) *IDSelectorBatch {
+	sel := &IDSelectorBatch{
+		ids: make(map[int64]bool, len(ids)),
+	}
+	for _, id := range ids {
+		sel.ids[id] = true
+	}
+
+	return sel
+}
+
+func (sel *IDSelectorBatch) IsMember(id int64) bool {
+	return sel.ids[id]
+}
+
+// IDSelectorRange selects the ids in [min, max)
+type IDSelectorRange struct {
+	min int64
+	max int64
+}
+
+func NewIDSelectorRange(min int64, max int64) *IDSelectorRange {
+	return &IDSelectorRange{
+		min: min,
+		max: max,
+	}
+}
+
+func (sel *IDSelectorRange) IsMember(id int64) bool {
+	return id >= sel.min && id < sel.max
+}
+
+// IDSelectorBitmap selects the ids whose bit is set in a bitmap, id i is the (i%8)-th bit of byte i/8
+type IDSelectorBitmap struct {
+	bitmap []uint8
+}
+
+func NewIDSelectorBitmap(bitmap []uint8) *IDSelectorBitmap {
+	return &IDSelectorBitmap{
+		bitmap: bitmap,
+	}
+}
+
+func (sel *IDSelectorBitmap) IsMember(id int64) bool {
+	if id < 0 || id>>3 >= int64(len(sel.bitmap)) {
+		return false
+	}
+	return sel.bitmap[id>>3]&(1<<(id&7)) != 0
+}
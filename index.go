@@ -1,9 +1,145 @@
 package nanofaiss
 
+import (
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
 type Index interface {
-	Init(n int32, d int32)
-	Search(x []float64, k int32, metric_type MetricType) ([]int32, [][]float64)
-	Add(x []float64)
-	BatchAdd(x [][]float64)
+	Init(n int32, d int32) error
+	Search(x []float64, k int32, metric_type MetricType) (SearchResult, error)
+	Add(x []float64) error
+	BatchAdd(x [][]float64) error
 	Remove()
+	Size() int32
+}
+
+// SearchResult is the result of a knn search, ranked best-first: ascending distance for L2, descending
+// similarity for IP and cosine, ties are broken by ascending idx.
+// Distances[i] is the distance (L2) or similarity (IP, cosine) between the query and the vector Idxs[i],
+// Vecs[i] is the vector Idxs[i] when the index keeps the vectors, compressed indexes return the
+// reconstructed vectors and indexes without any vector return nil Vecs.
+type SearchResult struct {
+	Idxs      []int32
+	Distances []float64
+	Vecs      [][]float64
+}
+
+// RangeSearchResult is the result of a range search of nq queries, like the RangeSearchResult of Faiss.
+// The results of query i are Idxs[Lims[i]:Lims[i+1]] and Distances[Lims[i]:Lims[i+1]], ranked best-first,
+// so Lims has nq+1 entries and Lims[nq] is the total number of results.
+type RangeSearchResult struct {
+	Lims      []int
+	Idxs      []int32
+	Distances []float64
+}
+
+// append adds the results of the next query
+func (rsr *RangeSearchResult) append(result SearchResult) {
+	rsr.Idxs = append(rsr.Idxs, result.Idxs...)
+	rsr.Distances = append(rsr.Distances, result.Distances...)
+	rsr.Lims = append(rsr.Lims, len(rsr.Idxs))
+}
+
+// in_range returns true if distance is within radius: L2 distance < radius, IP / cosine similarity > radius
+func in_range(distance float64, radius float64, metric_type MetricType) bool {
+	if metric_type.is_similarity() {
+		return distance > radius
+	}
+	return distance < radius
+}
+
+// block sizes of batch search, a block of distances takes 256 * 4096 * 8 bytes = 8MB
+const (
+	BATCH_SEARCH_QUERY_BLOCK    = 256
+	BATCH_SEARCH_DATABASE_BLOCK = 4096
+)
+
+// new_heap returns the heap keeping the k best distances of metric_type
+func new_heap(metric_type MetricType, k int32) utils.Heap {
+	var h utils.Heap
+	if metric_type.is_similarity() {
+		h = &utils.DistanceMinHeap{}
+	} else {
+		h = &utils.DistanceMaxHeap{}
+	}
+	h.Init(k)
+
+	return h
+}
+
+// distance_matrix returns the matrix of metric_type distances between the rows of q and the rows of x
+func distance_matrix(q, x *mat.Dense, metric_type MetricType) *mat.Dense {
+	switch metric_type {
+	case METRIC_IP:
+		return utils.InnerProductMatrix(q, x)
+	case METRIC_COSINE:
+		return utils.CosineDistanceMatrix(q, x)
+	default:
+		return utils.L2DistanceMatrix(q, x)
+	}
+}
+
+// check_dims returns true if all vectors of x are of dimension d
+func check_dims(x [][]float64, d int32) bool {
+	for i := range x {
+		if len(x[i]) != int(d) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rows_to_dense copies the vectors x of dimension d into the rows of a matrix
+func rows_to_dense(x [][]float64, d int32) *mat.Dense {
+	m := mat.NewDense(len(x), int(d), nil)
+	for i := range x {
+		m.SetRow(i, x[i])
+	}
+
+	return m
+}
+
+// new_search_result copies the idxs and distances drained from a heap into a SearchResult ranked by metric_type
+func new_search_result(idxs []int32, distances []float64, metric_type MetricType) SearchResult {
+	result := SearchResult{
+		Idxs:      make([]int32, len(idxs)),
+		Distances: make([]float64, len(distances)),
+	}
+	copy(result.Idxs, idxs)
+	copy(result.Distances, distances)
+
+	sort.Sort(search_result_sorter{result: result, descending: metric_type.is_similarity()})
+
+	return result
+}
+
+// search_result_sorter ranks the idxs and distances of a SearchResult together
+type search_result_sorter struct {
+	result     SearchResult
+	descending bool // true for similarity metrics
+}
+
+func (s search_result_sorter) Len() int {
+	return len(s.result.Idxs)
+}
+
+func (s search_result_sorter) Less(i, j int) bool {
+	di, dj := s.result.Distances[i], s.result.Distances[j]
+	if di == dj {
+		return s.result.Idxs[i] < s.result.Idxs[j]
+	}
+	if s.descending {
+		return di > dj
+	}
+	return di < dj
+}
+
+func (s search_result_sorter) Swap(i, j int) {
+	s.result.Idxs[i], s.result.Idxs[j] = s.result.Idxs[j], s.result.Idxs[i]
+	s.result.Distances[i], s.result.Distances[j] = s.result.Distances[j], s.result.Distances[i]
 }
@@ -1,164 +1,166 @@
 package nanofaiss
 
 import (
-	"sort"
+	"fmt"
+	"io"
+	"math"
 
 	"gonum.org/v1/gonum/mat"
 
 	"github.com/crowaixyz/nanofaiss/utils"
 )
 
+// IndexFlat is the flat index of float64 vectors, ie. IndexFlatT[float64] plus the BLAS batch and range searches
+// and the serialization of index_io.go. Init, Search, Add, BatchAdd, Reserve, Shrink, Size, Capacity, Remove and
+// RemoveIDs are the ones of IndexFlatT.
 type IndexFlat struct {
-	size int32
-	cap  int32
-	dim  int32
-	vecs []mat.VecDense // vecs is a slice of vectors, each represented as a gonum VecDense
+	IndexFlatT[float64]
 }
 
-func (iflat *IndexFlat) Init(n int32, d int32) {
-	iflat.size = 0
-	iflat.cap = n
-	iflat.dim = d
-	iflat.vecs = make([]mat.VecDense, n) // TODO: provide alternative way to store data in disk files, eg. lance??
-}
-
-func (iflat *IndexFlat) Search(x []float64, k int32, metric_type MetricType) ([]int32, [][]float64) {
-	if len(x) != int(iflat.dim) {
-		panic("IndexFlat: Search: input vector dimension is not equal to index dimension")
-	}
-
-	// L2(Euclidean) distance, more bigger, more different
-	if metric_type == METRIC_L2 {
-		return iflat.knn_search_l2_metric(x, k)
-	} else if metric_type == METRIC_IP { // inner product, more bigger, more similar
-		return iflat.knn_search_ip_metric(x, k)
-	} else if metric_type == METRIC_COSINE { // cosine similarity, more bigger, more similar
-		return iflat.knn_search_cosine_metric(x, k)
-	} else {
-		panic("IndexFlat: Search: invalid metric type")
+// BatchSearch searches the k nearest neighbors of every row of the nq x d query matrix x.
+// The distances are computed block by block with BLAS matrix multiplications instead of one pair at a time.
+func (iflat *IndexFlat) BatchSearch(x [][]float64, k int32, metric_type MetricType) ([]SearchResult, error) {
+	if !check_dims(x, iflat.dim) {
+		return nil, fmt.Errorf("IndexFlat: BatchSearch: %w", ErrDimensionMismatch)
 	}
-}
-
-func (iflat *IndexFlat) Add(x []float64) {
-	if len(x) != int(iflat.dim) {
-		panic("IndexFlat: Add: input vector dimension is not equal to index dimension")
-	}
-
-	if iflat.size >= iflat.cap {
-		panic("IndexFlat: Add: index is full")
+	if k <= 0 {
+		return nil, fmt.Errorf("IndexFlat: BatchSearch: %w", ErrInvalidParameter)
 	}
-	if len(x) != int(iflat.dim) {
-		panic("IndexFlat: Add: input vector dimension is not equal to index dimension")
+	if !metric_type.is_valid() {
+		return nil, fmt.Errorf("IndexFlat: BatchSearch: %w", ErrInvalidMetric)
 	}
 
-	iflat.size++
-	iflat.vecs[iflat.size-1] = *mat.NewVecDense(int(iflat.dim), x)
-}
+	results := make([]SearchResult, len(x))
+	for q0 := 0; q0 < len(x); q0 += BATCH_SEARCH_QUERY_BLOCK {
+		q1 := min(q0+BATCH_SEARCH_QUERY_BLOCK, len(x))
+		q := rows_to_dense(x[q0:q1], iflat.dim)
 
-func (iflat *IndexFlat) BatchAdd(x [][]float64) {
-	if iflat.size+int32(len(x)) > iflat.cap {
-		panic("IndexFlat: BatchAdd: index is full")
-	}
+		heaps := make([]utils.Heap, q1-q0)
+		for i := range heaps {
+			heaps[i] = new_heap(metric_type, k)
+		}
 
-	for i := range x {
-		iflat.Add(x[i])
+		// step 1. compute the distances between the query block and every database block
+		iflat.scan_blocks(q, metric_type, func(b0 int32, distances *mat.Dense) {
+			for i := range heaps {
+				for j, distance := range distances.RawRowView(i) {
+					heaps[i].Push(distance, b0+int32(j))
+				}
+			}
+		})
+
+		// step 2. rank the neighbors of every query and select vectors by idxs
+		for i := range heaps {
+			result := new_search_result(heaps[i].Idxs(), heaps[i].Distance(), metric_type)
+			result.Vecs = make([][]float64, len(result.Idxs))
+			for j := range result.Idxs {
+				result.Vecs[j] = utils.ToFloat64(iflat.vector(result.Idxs[j]))
+			}
+			results[q0+i] = result
+		}
 	}
-}
 
-func (iflat *IndexFlat) Remove() {
-	iflat.size = 0
-	iflat.vecs = nil
+	return results, nil
 }
 
-func (iflat *IndexFlat) knn_search_l2_metric(x []float64, k int32) ([]int32, [][]float64) {
-	var distance_max_heap utils.DistanceMaxHeap
-	distance_max_heap.Init(k)
-
-	for i := int32(0); i < iflat.size; i++ {
-		distance := utils.L2Distance(iflat.vecs[i], *mat.NewVecDense(int(iflat.dim), x))
-
-		if distance_max_heap.Size() < k {
-			distance_max_heap.Push(distance, i)
-		} else {
-			if distance < distance_max_heap.Peek() {
-				distance_max_heap.Pop()
-				distance_max_heap.Push(distance, i)
-			}
-		}
+// RangeSearch searches all the vectors within radius of every row of the nq x d query matrix x, ie. with
+// L2 distance < radius, or with IP / cosine similarity > radius. The results of each query are ranked best-first.
+func (iflat *IndexFlat) RangeSearch(x [][]float64, radius float64, metric_type MetricType) (RangeSearchResult, error) {
+	if !check_dims(x, iflat.dim) {
+		return RangeSearchResult{}, fmt.Errorf("IndexFlat: RangeSearch: %w", ErrDimensionMismatch)
+	}
+	if !metric_type.is_valid() {
+		return RangeSearchResult{}, fmt.Errorf("IndexFlat: RangeSearch: %w", ErrInvalidMetric)
 	}
 
-	// sort the idxs and select vectors by idxs
-	idxs := distance_max_heap.Idxs()
-	sort.Slice(idxs, func(i, j int) bool {
-		return idxs[i] < idxs[j]
-	})
+	var result RangeSearchResult
+	result.Lims = make([]int, 1, len(x)+1)
+	for q0 := 0; q0 < len(x); q0 += BATCH_SEARCH_QUERY_BLOCK {
+		q1 := min(q0+BATCH_SEARCH_QUERY_BLOCK, len(x))
+		q := rows_to_dense(x[q0:q1], iflat.dim)
+
+		// step 1. collect the vectors within radius of every query in the block
+		idxs := make([][]int32, q1-q0)
+		distances := make([][]float64, q1-q0)
+		iflat.scan_blocks(q, metric_type, func(b0 int32, block_distances *mat.Dense) {
+			for i := range idxs {
+				for j, distance := range block_distances.RawRowView(i) {
+					if in_range(distance, radius, metric_type) {
+						idxs[i] = append(idxs[i], b0+int32(j))
+						distances[i] = append(distances[i], distance)
+					}
+				}
+			}
+		})
 
-	vecs := make([][]float64, len(idxs))
-	for i := range idxs {
-		vecs[i] = iflat.vecs[idxs[i]].RawVector().Data
+		// step 2. rank the results of every query
+		for i := range idxs {
+			result.append(new_search_result(idxs[i], distances[i], metric_type))
+		}
 	}
 
-	return idxs, vecs
+	return result, nil
 }
 
-func (iflat *IndexFlat) knn_search_ip_metric(x []float64, k int32) ([]int32, [][]float64) {
-	var distance_min_heap utils.DistanceMinHeap
-	distance_min_heap.Init(k)
+// scan_blocks computes the metric_type distances between the query block q and the stored vectors block by block,
+// fn is called with the idx of the first vector of the database block and the distance matrix
+func (iflat *IndexFlat) scan_blocks(q *mat.Dense, metric_type MetricType, fn func(b0 int32, distances *mat.Dense)) {
+	for b0 := int32(0); b0 < iflat.size; b0 += BATCH_SEARCH_DATABASE_BLOCK {
+		b1 := min(b0+BATCH_SEARCH_DATABASE_BLOCK, iflat.size)
 
-	for i := int32(0); i < iflat.size; i++ {
-		distance := utils.InnerProductDistance(iflat.vecs[i], *mat.NewVecDense(int(iflat.dim), x))
-
-		if distance_min_heap.Size() < k {
-			distance_min_heap.Push(distance, i)
-		} else {
-			if distance > distance_min_heap.Peek() {
-				distance_min_heap.Pop()
-				distance_min_heap.Push(distance, i)
-			}
-		}
+		// the rows of the database block are a view of the contiguous storage, there is no copy
+		d := int(iflat.dim)
+		x := mat.NewDense(int(b1-b0), d, iflat.data[int(b0)*d:int(b1)*d])
+		fn(b0, distance_matrix(q, x, metric_type))
 	}
+}
 
-	// sort the idxs and select vectors by idxs
-	idxs := distance_min_heap.Idxs()
-	sort.Slice(idxs, func(i, j int) bool {
-		return idxs[i] < idxs[j]
-	})
-
-	vecs := make([][]float64, len(idxs))
-	for i := range idxs {
-		vecs[i] = iflat.vecs[idxs[i]].RawVector().Data
+// vec_views returns the vectors as VecDense views of the storage, they are valid until the index is changed
+func (iflat *IndexFlat) vec_views() []mat.VecDense {
+	vecs := make([]mat.VecDense, iflat.size)
+	for i := range vecs {
+		vecs[i] = *mat.NewVecDense(int(iflat.dim), iflat.vector(int32(i)))
 	}
 
-	return idxs, vecs
+	return vecs
 }
 
-func (iflat *IndexFlat) knn_search_cosine_metric(x []float64, k int32) ([]int32, [][]float64) {
-	var distance_min_heap utils.DistanceMinHeap
-	distance_min_heap.Init(k)
+// WriteIndex writes the index to w in the binary format of index_io.go, body:
+//
+//	dim  int32
+//	size int32
+//	vecs size * dim float64
+func (iflat *IndexFlat) WriteIndex(w io.Writer) error {
+	iw := new_index_writer(w, index_flat_fourcc)
+	iw.write(iflat.dim)
+	iw.write(iflat.size)
+	iw.write(iflat.data[:int(iflat.size)*int(iflat.dim)])
+
+	if err := iw.close(); err != nil {
+		return fmt.Errorf("IndexFlat: WriteIndex: %w", err)
+	}
 
-	for i := int32(0); i < iflat.size; i++ {
-		distance := utils.CosineDistance(iflat.vecs[i], *mat.NewVecDense(int(iflat.dim), x))
+	return nil
+}
 
-		if distance_min_heap.Size() < k {
-			distance_min_heap.Push(distance, i)
-		} else {
-			if distance > distance_min_heap.Peek() {
-				distance_min_heap.Pop()
-				distance_min_heap.Push(distance, i)
-			}
-		}
+// ReadIndex replaces the index with the index written by WriteIndex, the index is not changed if it fails
+func (iflat *IndexFlat) ReadIndex(r io.Reader) error {
+	ir, err := new_index_reader(r, index_flat_fourcc)
+	if err != nil {
+		return fmt.Errorf("IndexFlat: ReadIndex: %w", err)
 	}
 
-	// sort the idxs and select vectors by idxs
-	idxs := distance_min_heap.Idxs()
-	sort.Slice(idxs, func(i, j int) bool {
-		return idxs[i] < idxs[j]
-	})
+	dim := ir.read_int32(1, math.MaxInt32)
+	size := ir.read_int32(0, math.MaxInt32)
+	data := ir.read_float64s(int(size) * int(dim))
 
-	vecs := make([][]float64, len(idxs))
-	for i := range idxs {
-		vecs[i] = iflat.vecs[idxs[i]].RawVector().Data
+	if err := ir.close(); err != nil {
+		return fmt.Errorf("IndexFlat: ReadIndex: %w", err)
 	}
 
-	return idxs, vecs
+	iflat.size = size
+	iflat.dim = dim
+	iflat.data = data
+
+	return nil
 }
@@ -0,0 +1,169 @@
+package nanofaiss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+// IndexFlatMmap is a read-only flat index over a Faiss IndexFlatL2 / IndexFlatIP file (see WriteFaissIndex),
+// the file is memory-mapped and searched in place, so opening it does not read the vectors and the pages are
+// shared with the other processes mapping the same file. The float32 vectors are decoded on the fly.
+type IndexFlatMmap struct {
+	size        int32
+	dim         int32
+	metric_type MetricType // metric stored in the file
+	mapping     []byte
+	data        []byte // float32 vectors in the mapping, little-endian, size * dim * 4 bytes
+}
+
+// OpenIndexFlatMmap maps the Faiss flat index file path, Close should be called to unmap it
+func OpenIndexFlatMmap(path string) (*IndexFlatMmap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("IndexFlatMmap: Open: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("IndexFlatMmap: Open: %w", err)
+	}
+	if fi.Size() == 0 || fi.Size() > math.MaxInt {
+		return nil, fmt.Errorf("IndexFlatMmap: Open: file size %d: %w", fi.Size(), ErrInvalidFormat)
+	}
+
+	mapping, err := mmap_file(f, int(fi.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("IndexFlatMmap: Open: %w", err)
+	}
+
+	iflat := &IndexFlatMmap{mapping: mapping}
+	if err := iflat.parse(); err != nil {
+		munmap_file(mapping)
+		return nil, fmt.Errorf("IndexFlatMmap: Open: %w", err)
+	}
+
+	return iflat, nil
+}
+
+// parse reads the header of the mapped file and locates the vectors
+func (iflat *IndexFlatMmap) parse() error {
+	r := bytes.NewReader(iflat.mapping)
+	fr := &faiss_reader{r: r}
+
+	fourcc := fr.read_fourcc()
+	if fr.err == nil && fourcc != faiss_flat_l2_fourcc && fourcc != faiss_flat_ip_fourcc {
+		return fmt.Errorf("index type %q is not a flat index: %w", fourcc, ErrInvalidFormat)
+	}
+	h := fr.read_header()
+	n := fr.read_size(0, math.MaxInt)
+	if fr.err != nil {
+		return fr.err
+	}
+
+	offset := len(iflat.mapping) - r.Len()
+	if uint64(n) != uint64(h.ntotal)*uint64(h.d) || uint64(r.Len()) != uint64(n)*4 {
+		return fmt.Errorf("vectors size %d is not %d * %d: %w", n, h.ntotal, h.d, ErrInvalidFormat)
+	}
+
+	iflat.size = h.ntotal
+	iflat.dim = h.d
+	iflat.metric_type = h.metric_type
+	iflat.data = iflat.mapping[offset:]
+
+	return nil
+}
+
+// Close unmaps the file, the index must not be used anymore
+func (iflat *IndexFlatMmap) Close() error {
+	if iflat.mapping == nil {
+		return nil
+	}
+
+	err := munmap_file(iflat.mapping)
+	iflat.mapping = nil
+	iflat.data = nil
+	iflat.size = 0
+
+	return err
+}
+
+// Size returns the number of vectors in the index
+func (iflat *IndexFlatMmap) Size() int32 {
+	return iflat.size
+}
+
+// MetricType returns the metric stored in the file, Search accepts any metric
+func (iflat *IndexFlatMmap) MetricType() MetricType {
+	return iflat.metric_type
+}
+
+// Search searches the k nearest neighbors of x by scanning the mapped vectors, the returned vectors are copies
+func (iflat *IndexFlatMmap) Search(x []float64, k int32, metric_type MetricType) (SearchResult, error) {
+	if len(x) != int(iflat.dim) {
+		return SearchResult{}, fmt.Errorf("IndexFlatMmap: Search: %w", ErrDimensionMismatch)
+	}
+	if k <= 0 {
+		return SearchResult{}, fmt.Errorf("IndexFlatMmap: Search: %w", ErrInvalidParameter)
+	}
+	if !metric_type.is_valid() {
+		return SearchResult{}, fmt.Errorf("IndexFlatMmap: Search: %w", ErrInvalidMetric)
+	}
+
+	// decode every vector in the same buffer instead of allocating it
+	x_norm := math.Sqrt(utils.InnerProductT(x, x))
+	y := make([]float64, iflat.dim)
+	heap := new_heap(metric_type, k)
+	for i := int32(0); i < iflat.size; i++ {
+		iflat.decode(i, y)
+
+		var distance float64
+		switch metric_type {
+		case METRIC_IP:
+			distance = utils.InnerProductT(x, y)
+		case METRIC_COSINE:
+			distance = utils.InnerProductT(x, y) / (x_norm * math.Sqrt(utils.InnerProductT(y, y)))
+		default:
+			distance = math.Sqrt(utils.L2DistanceSqrT(x, y))
+		}
+		heap.Push(distance, i)
+	}
+
+	// select vectors by idxs
+	result := new_search_result(heap.Idxs(), heap.Distance(), metric_type)
+	result.Vecs = make([][]float64, len(result.Idxs))
+	for i := range result.Idxs {
+		result.Vecs[i] = iflat.vector(result.Idxs[i])
+	}
+
+	return result, nil
+}
+
+// Reconstruct returns a copy of the i-th vector
+func (iflat *IndexFlatMmap) Reconstruct(i int32) ([]float64, error) {
+	if i < 0 || i >= iflat.size {
+		return nil, fmt.Errorf("IndexFlatMmap: Reconstruct: %w", ErrOutOfRange)
+	}
+
+	return iflat.vector(i), nil
+}
+
+// vector returns a copy of the i-th vector
+func (iflat *IndexFlatMmap) vector(i int32) []float64 {
+	x := make([]float64, iflat.dim)
+	iflat.decode(i, x)
+	return x
+}
+
+// decode converts the float32 of the i-th vector into x
+func (iflat *IndexFlatMmap) decode(i int32, x []float64) {
+	v := iflat.data[int(i)*int(iflat.dim)*4:]
+	for j := range x {
+		x[j] = float64(math.Float32frombits(binary.LittleEndian.Uint32(v[j*4:])))
+	}
+}
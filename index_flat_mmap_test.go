@@ -0,0 +1,73 @@
+package nanofaiss
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIndexFlatMmap_Search(t *testing.T) {
+	Convey("IndexFlatMmap_Search", t, func() {
+		n, d := 500, 16
+		xb := random_vecs(n, d, 12)
+		for i := range xb {
+			for j := range xb[i] {
+				xb[i][j] = float64(float32(xb[i][j])) // exactly representable in the float32 file
+			}
+		}
+
+		var flat IndexFlat
+		flat.Init(int32(n), int32(d))
+		flat.BatchAdd(xb)
+
+		path := filepath.Join(t.TempDir(), "flat.faissindex")
+		f, err := os.Create(path)
+		So(err, ShouldBeNil)
+		So(WriteFaissIndex(f, &flat, METRIC_IP), ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		index, err := OpenIndexFlatMmap(path)
+		So(err, ShouldBeNil)
+		defer index.Close()
+		So(index.Size(), ShouldEqual, n)
+		So(index.MetricType(), ShouldEqual, METRIC_IP)
+
+		tests := []struct {
+			name        string
+			metric_type MetricType
+		}{
+			{name: "test case 1: METRIC_L2", metric_type: METRIC_L2},
+			{name: "test case 2: METRIC_IP", metric_type: METRIC_IP},
+			{name: "test case 3: METRIC_COSINE", metric_type: METRIC_COSINE},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				for _, q := range random_vecs(10, d, 13) {
+					want, err := flat.Search(q, 5, tt.metric_type)
+					So(err, ShouldBeNil)
+					got, err := index.Search(q, 5, tt.metric_type)
+					So(err, ShouldBeNil)
+					So(got.Idxs, ShouldResemble, want.Idxs)
+					So(got.Vecs, ShouldResemble, want.Vecs)
+					for i := range want.Distances {
+						So(got.Distances[i], ShouldAlmostEqual, want.Distances[i], 1e-9)
+					}
+				}
+			})
+		}
+
+		Convey("test case 4: errors", func() {
+			_, err := index.Search(xb[0][:8], 5, METRIC_L2)
+			So(errors.Is(err, ErrDimensionMismatch), ShouldBeTrue)
+			_, err = index.Reconstruct(int32(n))
+			So(errors.Is(err, ErrOutOfRange), ShouldBeTrue)
+
+			_, err = OpenIndexFlatMmap(filepath.Join("testdata", "faiss", "pq.faissindex"))
+			So(errors.Is(err, ErrInvalidFormat), ShouldBeTrue)
+		})
+	})
+}
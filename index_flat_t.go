@@ -0,0 +1,178 @@
+package nanofaiss
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+// IndexFlatT is a flat index keeping the vectors of element type T in one contiguous buffer, the i-th vector is
+// data[i*dim:(i+1)*dim]. There is no pointer for the GC to scan, and float32, float16 and int8 vectors take
+// 1/2, 1/4 and 1/8 of the memory of float64 vectors. IndexFlat is IndexFlatT[float64] with the BLAS batch search.
+type IndexFlatT[T utils.Element] struct {
+	size int32
+	dim  int32
+	data []T // len(data) == size * dim
+}
+
+// IndexFlatF32 keeps float32 vectors, the distances are computed in float32
+type IndexFlatF32 = IndexFlatT[float32]
+
+// Init initializes the index with an initial capacity of n vectors, the storage grows automatically when it is full
+func (iflat *IndexFlatT[T]) Init(n int32, d int32) error {
+	if n < 0 || d <= 0 {
+		return fmt.Errorf("IndexFlatT: Init: %w", ErrInvalidParameter)
+	}
+
+	iflat.size = 0
+	iflat.dim = d
+	iflat.data = make([]T, 0, int(n)*int(d))
+
+	return nil
+}
+
+// Search searches the k nearest neighbors of x, the returned vectors are float64 copies
+func (iflat *IndexFlatT[T]) Search(x []T, k int32, metric_type MetricType) (SearchResult, error) {
+	if len(x) != int(iflat.dim) {
+		return SearchResult{}, fmt.Errorf("IndexFlatT: Search: %w", ErrDimensionMismatch)
+	}
+	if k <= 0 {
+		return SearchResult{}, fmt.Errorf("IndexFlatT: Search: %w", ErrInvalidParameter)
+	}
+	if !metric_type.is_valid() {
+		return SearchResult{}, fmt.Errorf("IndexFlatT: Search: %w", ErrInvalidMetric)
+	}
+
+	x_norm := math.Sqrt(utils.InnerProductT(x, x))
+	heap := new_heap(metric_type, k)
+	for i := int32(0); i < iflat.size; i++ {
+		y := iflat.vector(i)
+
+		var distance float64
+		switch metric_type {
+		case METRIC_IP:
+			distance = utils.InnerProductT(x, y)
+		case METRIC_COSINE:
+			distance = utils.InnerProductT(x, y) / (x_norm * math.Sqrt(utils.InnerProductT(y, y)))
+		default:
+			distance = math.Sqrt(utils.L2DistanceSqrT(x, y))
+		}
+		heap.Push(distance, i)
+	}
+
+	// select vectors by idxs
+	result := new_search_result(heap.Idxs(), heap.Distance(), metric_type)
+	result.Vecs = make([][]float64, len(result.Idxs))
+	for i := range result.Idxs {
+		result.Vecs[i] = utils.ToFloat64(iflat.vector(result.Idxs[i]))
+	}
+
+	return result, nil
+}
+
+func (iflat *IndexFlatT[T]) Add(x []T) error {
+	if len(x) != int(iflat.dim) {
+		return fmt.Errorf("IndexFlatT: Add: %w", ErrDimensionMismatch)
+	}
+
+	// append reallocates the storage with amortized growth when it is full, x is copied into the buffer
+	iflat.size++
+	iflat.data = append(iflat.data, x...)
+
+	return nil
+}
+
+// BatchAdd adds all vectors of x, or none of them if one of them is invalid
+func (iflat *IndexFlatT[T]) BatchAdd(x [][]T) error {
+	for i := range x {
+		if len(x[i]) != int(iflat.dim) {
+			return fmt.Errorf("IndexFlatT: BatchAdd: %w", ErrDimensionMismatch)
+		}
+	}
+
+	iflat.Reserve(iflat.size + int32(len(x)))
+
+	for i := range x {
+		iflat.Add(x[i])
+	}
+
+	return nil
+}
+
+// Reconstruct returns the i-th vector, it is a view of the storage which is valid until the index is changed
+func (iflat *IndexFlatT[T]) Reconstruct(i int32) ([]T, error) {
+	if i < 0 || i >= iflat.size {
+		return nil, fmt.Errorf("IndexFlatT: Reconstruct: %w", ErrOutOfRange)
+	}
+
+	return iflat.vector(i), nil
+}
+
+// vector returns the i-th vector as a view of the storage
+func (iflat *IndexFlatT[T]) vector(i int32) []T {
+	d := int(iflat.dim)
+	return iflat.data[int(i)*d : (int(i)+1)*d : (int(i)+1)*d]
+}
+
+// Reserve grows the capacity of the storage to at least n vectors, so that adding vectors up to n does not reallocate
+func (iflat *IndexFlatT[T]) Reserve(n int32) {
+	if int(n)*int(iflat.dim) <= cap(iflat.data) {
+		return
+	}
+
+	data := make([]T, len(iflat.data), int(n)*int(iflat.dim))
+	copy(data, iflat.data)
+	iflat.data = data
+}
+
+// Shrink releases the unused capacity of the storage
+func (iflat *IndexFlatT[T]) Shrink() {
+	if len(iflat.data) == cap(iflat.data) {
+		return
+	}
+
+	data := make([]T, len(iflat.data))
+	copy(data, iflat.data)
+	iflat.data = data
+}
+
+// Size returns the number of vectors in the index
+func (iflat *IndexFlatT[T]) Size() int32 {
+	return iflat.size
+}
+
+// Capacity returns the number of vectors the storage can hold before it grows
+func (iflat *IndexFlatT[T]) Capacity() int32 {
+	if iflat.dim == 0 {
+		return 0
+	}
+	return int32(cap(iflat.data) / int(iflat.dim))
+}
+
+func (iflat *IndexFlatT[T]) Remove() {
+	iflat.size = 0
+	iflat.data = nil
+}
+
+// RemoveIDs removes the vectors selected by sel and returns the number of removed vectors.
+// The remaining vectors are shifted to keep the storage contiguous, so their idxs are renumbered in the same order.
+func (iflat *IndexFlatT[T]) RemoveIDs(sel IDSelector) int32 {
+	j := int32(0)
+	for i := int32(0); i < iflat.size; i++ {
+		if sel.IsMember(int64(i)) {
+			continue
+		}
+
+		if i != j {
+			copy(iflat.vector(j), iflat.vector(i))
+		}
+		j++
+	}
+
+	removed := iflat.size - j
+	iflat.data = iflat.data[:int(j)*int(iflat.dim)]
+	iflat.size = j
+
+	return removed
+}
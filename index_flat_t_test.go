@@ -0,0 +1,163 @@
+package nanofaiss
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+// new_index_flat_t returns the IndexFlatT of the vectors xb converted by conv, and a search func taking float64 queries
+func new_index_flat_t[T utils.Element](xb [][]float64, conv func(x float64) T) func(q []float64, k int32, metric_type MetricType) (SearchResult, error) {
+	to_t := func(x []float64) []T {
+		y := make([]T, len(x))
+		for i := range x {
+			y[i] = conv(x[i])
+		}
+		return y
+	}
+
+	var index IndexFlatT[T]
+	index.Init(int32(len(xb)), int32(len(xb[0])))
+	for i := range xb {
+		index.Add(to_t(xb[i]))
+	}
+
+	return func(q []float64, k int32, metric_type MetricType) (SearchResult, error) {
+		return index.Search(to_t(q), k, metric_type)
+	}
+}
+
+func TestIndexFlatT_Search(t *testing.T) {
+	n, d, k := 500, 16, int32(10)
+	xb := random_vecs(n, d, 12)
+	xq := random_vecs(20, d, 13)
+
+	// the vectors are rounded to each element type first, so IndexFlat gives the reference neighbors
+	to_f32 := func(x float64) float32 { return float32(x) }
+	to_f16 := func(x float64) utils.Float16 { return utils.NewFloat16(float32(x)) }
+	// the values are in [-10, 10], scaled by 12 they fit in int8 without overflow
+	to_i8 := func(x float64) int8 { return int8(math.Round(x * 12)) }
+	tests := []struct {
+		name   string
+		round  func(x float64) float64
+		search func(q []float64, k int32, metric_type MetricType) (SearchResult, error)
+	}{
+		{
+			name:   "test case 1: float32",
+			round:  func(x float64) float64 { return float64(to_f32(x)) },
+			search: new_index_flat_t(xb, to_f32),
+		},
+		{
+			name:   "test case 2: float64",
+			round:  func(x float64) float64 { return x },
+			search: new_index_flat_t(xb, func(x float64) float64 { return x }),
+		},
+		{
+			name:   "test case 3: float16",
+			round:  func(x float64) float64 { return float64(to_f16(x).Float32()) },
+			search: new_index_flat_t(xb, to_f16),
+		},
+		{
+			name:   "test case 4: int8",
+			round:  func(x float64) float64 { return float64(to_i8(x)) },
+			search: new_index_flat_t(xb, to_i8),
+		},
+	}
+
+	Convey("IndexFlatT_Search", t, func() {
+		// run tests
+		for _, tt := range tests {
+			round := func(x []float64) []float64 {
+				y := make([]float64, len(x))
+				for i := range x {
+					y[i] = tt.round(x[i])
+				}
+				return y
+			}
+
+			var flat IndexFlat
+			flat.Init(int32(n), int32(d))
+			for i := range xb {
+				flat.Add(round(xb[i]))
+			}
+
+			Convey(tt.name, func() {
+				for _, metric_type := range []MetricType{METRIC_L2, METRIC_IP, METRIC_COSINE} {
+					for _, q := range xq {
+						want, err := flat.Search(round(q), k, metric_type)
+						So(err, ShouldBeNil)
+						got, err := tt.search(q, k, metric_type)
+						So(err, ShouldBeNil)
+
+						So(got.Vecs, ShouldResemble, want.Vecs)
+						for i := range got.Distances {
+							So(got.Distances[i], ShouldAlmostEqual, want.Distances[i], 1e-4)
+						}
+					}
+				}
+			})
+		}
+
+		Convey("test case 5: int8 distances are exact", func() {
+			// the products of int8 values are accumulated without overflow
+			var flat8 IndexFlatT[int8]
+			flat8.Init(2, 2)
+			flat8.BatchAdd([][]int8{{-128, 127}, {3, 4}})
+
+			got, err := flat8.Search([]int8{0, 0}, 2, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got.Idxs, ShouldResemble, []int32{1, 0})
+			So(got.Distances, ShouldResemble, []float64{5, math.Sqrt(32513)})
+
+			got, err = flat8.Search([]int8{-128, 127}, 1, METRIC_IP)
+			So(err, ShouldBeNil)
+			So(got.Idxs, ShouldResemble, []int32{0})
+			So(got.Distances, ShouldResemble, []float64{32513})
+		})
+	})
+}
+
+func TestIndexFlatT_Storage(t *testing.T) {
+	Convey("IndexFlatT_Storage", t, func() {
+		var flat32 IndexFlatF32
+		So(flat32.Init(2, 4), ShouldBeNil)
+		So(flat32.Capacity(), ShouldEqual, 2)
+
+		x := [][]float32{{1, 2, 3, 4}, {5, 6, 7, 8}, {9, 10, 11, 12}}
+		So(flat32.BatchAdd(x), ShouldBeNil)
+		So(flat32.Size(), ShouldEqual, 3)
+		So(flat32.data, ShouldResemble, []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
+
+		// the added vector is copied
+		x[1][0] = -1
+		got, err := flat32.Reconstruct(1)
+		So(err, ShouldBeNil)
+		So(got, ShouldResemble, []float32{5, 6, 7, 8})
+
+		Convey("test case 1: RemoveIDs", func() {
+			So(flat32.RemoveIDs(NewIDSelectorBatch([]int64{0})), ShouldEqual, 1)
+			So(flat32.data, ShouldResemble, []float32{5, 6, 7, 8, 9, 10, 11, 12})
+
+			flat32.Shrink()
+			So(flat32.Capacity(), ShouldEqual, 2)
+		})
+
+		Convey("test case 2: errors", func() {
+			So(errors.Is(flat32.Init(0, 0), ErrInvalidParameter), ShouldBeTrue)
+			So(errors.Is(flat32.Add([]float32{1}), ErrDimensionMismatch), ShouldBeTrue)
+			So(errors.Is(flat32.BatchAdd([][]float32{{1, 2, 3, 4}, {1}}), ErrDimensionMismatch), ShouldBeTrue)
+			So(flat32.Size(), ShouldEqual, 3)
+
+			_, err := flat32.Search([]float32{1, 2, 3, 4}, 0, METRIC_L2)
+			So(errors.Is(err, ErrInvalidParameter), ShouldBeTrue)
+			_, err = flat32.Search([]float32{1, 2, 3, 4}, 1, MetricType(9))
+			So(errors.Is(err, ErrInvalidMetric), ShouldBeTrue)
+			_, err = flat32.Reconstruct(3)
+			So(errors.Is(err, ErrOutOfRange), ShouldBeTrue)
+		})
+	})
+}
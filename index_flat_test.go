@@ -60,8 +60,8 @@ func TestAdd(t *testing.T) {
 				So(index_flat.size, ShouldEqual, int32(len(tt.args.x)))
 
 				for i := 0; i < len(tt.args.x); i++ {
-					fmt.Println(index_flat.vecs[i])
-					So(index_flat.vecs[i].RawVector().Data, ShouldResemble, tt.args.x[i])
+					fmt.Println(index_flat.vector(int32(i)))
+					So(index_flat.vector(int32(i)), ShouldResemble, tt.args.x[i])
 				}
 			})
 		}
@@ -78,10 +78,11 @@ func TestSearch(t *testing.T) {
 			metric_type MetricType
 		}
 		tests := []struct {
-			name      string
-			args      args
-			want_vecs [][]float64
-			want_idxs []int32
+			name           string
+			args           args
+			want_vecs      [][]float64
+			want_idxs      []int32
+			want_distances []float64
 		}{
 			{
 				name: "test case 1: METRIC_L2",
@@ -91,11 +92,12 @@ func TestSearch(t *testing.T) {
 					metric_type: METRIC_L2,
 				},
 				want_vecs: [][]float64{
+					{-7.2993, 6.4648, 8.8036, -2.8147, -6.3769, -7.2858, -7.9217, -2.2623, -2.7153, 1.9199, 0.9847, 1.8002, -1.0400, 1.1877, -9.9490, 2.4744},
 					{-1.8844, -6.6207, 7.0316, 3.9971, -2.3031, -5.7606, -5.8476, -2.5007, 3.4979, -1.1782, -1.3401, 1.0967, -1.2712, -4.9789, -9.0890, -4.1150},
 					{9.1343, 0.4023, 5.7710, -4.4378, 6.6000, -8.5159, -1.3144, 0.8215, 0.6810, -8.1890, -7.9119, 4.3616, -1.0799, -6.3421, 7.6390, -9.3325},
-					{-7.2993, 6.4648, 8.8036, -2.8147, -6.3769, -7.2858, -7.9217, -2.2623, -2.7153, 1.9199, 0.9847, 1.8002, -1.0400, 1.1877, -9.9490, 2.4744},
 				},
-				want_idxs: []int32{1, 3, 9},
+				want_idxs:      []int32{9, 1, 3},
+				want_distances: []float64{23.040113942209572, 30.966511302050154, 32.89654114523288},
 			},
 			{
 				name: "test case 2: METRIC_IP",
@@ -105,12 +107,13 @@ func TestSearch(t *testing.T) {
 					metric_type: METRIC_IP,
 				},
 				want_vecs: [][]float64{
-					{9.6805, -2.0903, -5.9735, 6.6838, 7.9909, -9.7308, 4.6712, 7.3035, -5.5592, -6.5468, 9.3354, 4.0835, -6.8329, -6.5936, -1.0223, 4.1134},
+					{-7.2993, 6.4648, 8.8036, -2.8147, -6.3769, -7.2858, -7.9217, -2.2623, -2.7153, 1.9199, 0.9847, 1.8002, -1.0400, 1.1877, -9.9490, 2.4744},
 					{9.1343, 0.4023, 5.7710, -4.4378, 6.6000, -8.5159, -1.3144, 0.8215, 0.6810, -8.1890, -7.9119, 4.3616, -1.0799, -6.3421, 7.6390, -9.3325},
+					{9.6805, -2.0903, -5.9735, 6.6838, 7.9909, -9.7308, 4.6712, 7.3035, -5.5592, -6.5468, 9.3354, 4.0835, -6.8329, -6.5936, -1.0223, 4.1134},
 					{-1.9528, -9.4549, 8.5244, -3.5117, 5.1243, -5.5617, 5.3453, 0.6389, 8.6911, 0.7602, -5.8969, 0.4683, 9.5739, 4.1150, -7.2324, -0.4839},
-					{-7.2993, 6.4648, 8.8036, -2.8147, -6.3769, -7.2858, -7.9217, -2.2623, -2.7153, 1.9199, 0.9847, 1.8002, -1.0400, 1.1877, -9.9490, 2.4744},
 				},
-				want_idxs: []int32{2, 3, 5, 9},
+				want_idxs:      []int32{9, 3, 2, 5},
+				want_distances: []float64{270.24788532, 57.61871989, 56.53770498, -5.11728463},
 			},
 			{
 				name: "test case 3: METRIC_COSINE",
@@ -120,22 +123,225 @@ func TestSearch(t *testing.T) {
 					metric_type: METRIC_COSINE,
 				},
 				want_vecs: [][]float64{
-					{-1.8844, -6.6207, 7.0316, 3.9971, -2.3031, -5.7606, -5.8476, -2.5007, 3.4979, -1.1782, -1.3401, 1.0967, -1.2712, -4.9789, -9.0890, -4.1150},
-					{9.6805, -2.0903, -5.9735, 6.6838, 7.9909, -9.7308, 4.6712, 7.3035, -5.5592, -6.5468, 9.3354, 4.0835, -6.8329, -6.5936, -1.0223, 4.1134},
+					{-7.2993, 6.4648, 8.8036, -2.8147, -6.3769, -7.2858, -7.9217, -2.2623, -2.7153, 1.9199, 0.9847, 1.8002, -1.0400, 1.1877, -9.9490, 2.4744},
 					{9.1343, 0.4023, 5.7710, -4.4378, 6.6000, -8.5159, -1.3144, 0.8215, 0.6810, -8.1890, -7.9119, 4.3616, -1.0799, -6.3421, 7.6390, -9.3325},
+					{9.6805, -2.0903, -5.9735, 6.6838, 7.9909, -9.7308, 4.6712, 7.3035, -5.5592, -6.5468, 9.3354, 4.0835, -6.8329, -6.5936, -1.0223, 4.1134},
 					{-1.9528, -9.4549, 8.5244, -3.5117, 5.1243, -5.5617, 5.3453, 0.6389, 8.6911, 0.7602, -5.8969, 0.4683, 9.5739, 4.1150, -7.2324, -0.4839},
-					{-7.2993, 6.4648, 8.8036, -2.8147, -6.3769, -7.2858, -7.9217, -2.2623, -2.7153, 1.9199, 0.9847, 1.8002, -1.0400, 1.1877, -9.9490, 2.4744},
+					{-1.8844, -6.6207, 7.0316, 3.9971, -2.3031, -5.7606, -5.8476, -2.5007, 3.4979, -1.1782, -1.3401, 1.0967, -1.2712, -4.9789, -9.0890, -4.1150},
+				},
+				want_idxs:      []int32{9, 3, 2, 5, 1},
+				want_distances: []float64{0.5089538462477493, 0.09624597518175997, 0.08691393744673413, -0.008971037230309717, -0.02027284806261163},
+			},
+			{
+				name: "test case 4: ties are broken by idx",
+				args: args{
+					x:           vecs[8],
+					k:           2,
+					metric_type: METRIC_L2,
+				},
+				want_vecs: [][]float64{
+					{-6.6470, -8.5638, 8.1416, 0.6188, 6.8358, 2.5415, 5.5035, 2.9408, -6.0126, 3.8511, -3.1609, -9.2893, 9.3241, 3.9992, -0.4900, -1.8301},
+					{-6.6470, -8.5638, 8.1416, 0.6188, 6.8358, 2.5415, 5.5035, 2.9408, -6.0126, 3.8511, -3.1609, -9.2893, 9.3241, 3.9992, -0.4900, -1.8301},
 				},
-				want_idxs: []int32{1, 2, 3, 5, 9},
+				want_idxs:      []int32{7, 8},
+				want_distances: []float64{0, 0},
+			},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				got, err := index_flat.Search(tt.args.x, tt.args.k, tt.args.metric_type)
+				So(err, ShouldBeNil)
+				So(got.Idxs, ShouldResemble, tt.want_idxs)
+				So(got.Vecs, ShouldResemble, tt.want_vecs)
+				So(len(got.Distances), ShouldEqual, len(tt.want_distances))
+				for i := range got.Distances {
+					So(got.Distances[i], ShouldAlmostEqual, tt.want_distances[i])
+				}
+			})
+		}
+	})
+}
+
+func TestBatchSearch(t *testing.T) {
+	Convey("BatchSearch", t, func() {
+		// more than one block of queries and one block of database vectors
+		n, d, k := 5000, 16, int32(10)
+		xb := random_vecs(n, d, 7)
+		xq := random_vecs(260, d, 8)
+
+		var flat IndexFlat
+		flat.Init(int32(n), int32(d))
+		flat.BatchAdd(xb)
+
+		tests := []struct {
+			name        string
+			metric_type MetricType
+		}{
+			{name: "test case 1: METRIC_L2", metric_type: METRIC_L2},
+			{name: "test case 2: METRIC_IP", metric_type: METRIC_IP},
+			{name: "test case 3: METRIC_COSINE", metric_type: METRIC_COSINE},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				got, err := flat.BatchSearch(xq, k, tt.metric_type)
+				So(err, ShouldBeNil)
+				So(len(got), ShouldEqual, len(xq))
+
+				for i := range xq {
+					want, err := flat.Search(xq[i], k, tt.metric_type)
+					So(err, ShouldBeNil)
+					So(got[i].Idxs, ShouldResemble, want.Idxs)
+					So(got[i].Vecs, ShouldResemble, want.Vecs)
+					for j := range want.Distances {
+						So(got[i].Distances[j], ShouldAlmostEqual, want.Distances[j], 1e-6)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestRangeSearch(t *testing.T) {
+	Convey("RangeSearch", t, func() {
+		n, d := 5000, 16
+		xb := random_vecs(n, d, 7)
+		xq := random_vecs(20, d, 8)
+
+		var flat IndexFlat
+		flat.Init(int32(n), int32(d))
+		flat.BatchAdd(xb)
+
+		tests := []struct {
+			name        string
+			radius      float64
+			metric_type MetricType
+		}{
+			{name: "test case 1: METRIC_L2", radius: 40, metric_type: METRIC_L2},
+			{name: "test case 2: METRIC_IP", radius: 250, metric_type: METRIC_IP},
+			{name: "test case 3: METRIC_COSINE", radius: 0.6, metric_type: METRIC_COSINE},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				got, err := flat.RangeSearch(xq, tt.radius, tt.metric_type)
+				So(err, ShouldBeNil)
+				So(len(got.Lims), ShouldEqual, len(xq)+1)
+				So(got.Lims[len(xq)], ShouldEqual, len(got.Idxs))
+				So(len(got.Distances), ShouldEqual, len(got.Idxs))
+
+				// the results are the prefix of the full ranking within radius
+				for i := range xq {
+					all, err := flat.Search(xq[i], int32(n), tt.metric_type)
+					So(err, ShouldBeNil)
+					want := 0
+					for want < n && in_range(all.Distances[want], tt.radius, tt.metric_type) {
+						want++
+					}
+
+					So(want, ShouldBeGreaterThan, 0)
+					So(got.Lims[i+1]-got.Lims[i], ShouldEqual, want)
+					So(got.Idxs[got.Lims[i]:got.Lims[i+1]], ShouldResemble, all.Idxs[:want])
+				}
+			})
+		}
+	})
+}
+
+func TestRemoveIDs(t *testing.T) {
+	Convey("RemoveIDs", t, func() {
+		tests := []struct {
+			name         string
+			sel          IDSelector
+			want_removed int32
+			want_left    []int
+		}{
+			{
+				name:         "test case 1: IDSelectorBatch",
+				sel:          NewIDSelectorBatch([]int64{0, 3, 9, 42}),
+				want_removed: 3,
+				want_left:    []int{1, 2, 4, 5, 6, 7, 8},
+			},
+			{
+				name:         "test case 2: IDSelectorRange",
+				sel:          NewIDSelectorRange(2, 8),
+				want_removed: 6,
+				want_left:    []int{0, 1, 8, 9},
+			},
+			{
+				name:         "test case 3: IDSelectorBitmap",
+				sel:          NewIDSelectorBitmap([]uint8{0b00100101, 0b00000010}),
+				want_removed: 4,
+				want_left:    []int{1, 3, 4, 6, 7, 8},
 			},
 		}
 
 		for _, tt := range tests {
 			Convey(tt.name, func() {
-				got_idxs, got_vecs := index_flat.Search(tt.args.x, tt.args.k, tt.args.metric_type)
-				So(got_idxs, ShouldResemble, tt.want_idxs)
-				So(got_vecs, ShouldResemble, tt.want_vecs)
+				var flat IndexFlat
+				flat.Init(int32(len(vecs)), 16)
+				flat.BatchAdd(vecs)
+
+				So(flat.RemoveIDs(tt.sel), ShouldEqual, tt.want_removed)
+				So(flat.size, ShouldEqual, len(tt.want_left))
+
+				// the remaining vectors are renumbered in the same order
+				for i, left := range tt.want_left {
+					So(flat.vector(int32(i)), ShouldResemble, vecs[left])
+				}
+
+				got, err := flat.Search(vecs[tt.want_left[0]], 1, METRIC_L2)
+				So(err, ShouldBeNil)
+				So(got.Idxs, ShouldResemble, []int32{0})
 			})
 		}
 	})
 }
+
+func TestGrow(t *testing.T) {
+	Convey("Grow", t, func() {
+		var flat IndexFlat
+		flat.Init(2, 16)
+		So(flat.Capacity(), ShouldEqual, 2)
+
+		Convey("test case 1: Add grows the storage", func() {
+			for _, v := range vecs {
+				flat.Add(v)
+			}
+
+			So(flat.Size(), ShouldEqual, len(vecs))
+			So(flat.Capacity(), ShouldBeGreaterThanOrEqualTo, len(vecs))
+			for i := range vecs {
+				So(flat.vector(int32(i)), ShouldResemble, vecs[i])
+			}
+		})
+
+		Convey("test case 2: Reserve and Shrink", func() {
+			flat.BatchAdd(vecs[:3])
+			flat.Reserve(100)
+			So(flat.Capacity(), ShouldEqual, 100)
+			So(flat.Size(), ShouldEqual, 3)
+
+			flat.BatchAdd(vecs[3:])
+			So(flat.Capacity(), ShouldEqual, 100)
+
+			flat.Shrink()
+			So(flat.Capacity(), ShouldEqual, len(vecs))
+			got, err := flat.Search(vecs[9], 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got.Idxs, ShouldResemble, []int32{9})
+		})
+
+		Convey("test case 3: Add after Remove", func() {
+			flat.BatchAdd(vecs)
+			flat.Remove()
+			flat.Add(vecs[1])
+
+			So(flat.Size(), ShouldEqual, 1)
+			got, err := flat.Search(vecs[1], 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got.Idxs, ShouldResemble, []int32{0})
+		})
+	})
+}
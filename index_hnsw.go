@@ -1 +1,417 @@
 package nanofaiss
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+// default parameters of IndexHNSW, same as Faiss
+const (
+	HNSW_DEFAULT_M               int32 = 32
+	HNSW_DEFAULT_EF_CONSTRUCTION int32 = 40
+	HNSW_DEFAULT_EF_SEARCH       int32 = 16
+
+	hnsw_random_seed int64 = 12345
+)
+
+// IndexHNSW is a hierarchical navigable small world graph index.
+// Every vector is a node of a multi-layer proximity graph, upper layers are sparse and used to
+// quickly route the query to the right region, layer 0 contains all nodes.
+type IndexHNSW struct {
+	size int32
+	cap  int32
+	dim  int32
+	vecs []mat.VecDense
+
+	m               int32 // max number of neighbors per node on layer > 0, layer 0 allows 2*m
+	ef_construction int32 // size of the dynamic candidate list when inserting
+	ef_search       int32 // size of the dynamic candidate list when searching
+	metric_type     MetricType
+
+	level_mult  float64
+	levels      []int32     // top layer of each node
+	neighbors   [][][]int32 // neighbors[node][layer] is the adjacency list of node on layer
+	entry_point int32
+	max_level   int32
+	rng         *rand.Rand
+}
+
+func (hnsw *IndexHNSW) Init(n int32, d int32) error {
+	return hnsw.InitWithOptions(n, d, HNSW_DEFAULT_M, HNSW_DEFAULT_EF_CONSTRUCTION, HNSW_DEFAULT_EF_SEARCH, METRIC_L2)
+}
+
+// InitWithOptions initializes the index with the graph parameters and the metric used to build the graph
+func (hnsw *IndexHNSW) InitWithOptions(n int32, d int32, m int32, ef_construction int32, ef_search int32, metric_type MetricType) error {
+	if n < 0 || d <= 0 || m < 2 || ef_construction <= 0 || ef_search <= 0 {
+		return fmt.Errorf("IndexHNSW: Init: %w", ErrInvalidParameter)
+	}
+	if !metric_type.is_valid() {
+		return fmt.Errorf("IndexHNSW: Init: %w", ErrInvalidMetric)
+	}
+
+	hnsw.size = 0
+	hnsw.cap = n
+	hnsw.dim = d
+	hnsw.vecs = make([]mat.VecDense, n)
+
+	hnsw.m = m
+	hnsw.ef_construction = ef_construction
+	hnsw.ef_search = ef_search
+	hnsw.metric_type = metric_type
+
+	hnsw.level_mult = 1 / math.Log(float64(m))
+	hnsw.levels = make([]int32, 0, n)
+	hnsw.neighbors = make([][][]int32, 0, n)
+	hnsw.entry_point = -1
+	hnsw.max_level = -1
+	hnsw.rng = rand.New(rand.NewSource(hnsw_random_seed))
+
+	return nil
+}
+
+// SetEfSearch changes the size of the dynamic candidate list used by Search, larger is more accurate but slower
+func (hnsw *IndexHNSW) SetEfSearch(ef_search int32) error {
+	if ef_search <= 0 {
+		return fmt.Errorf("IndexHNSW: SetEfSearch: %w", ErrInvalidParameter)
+	}
+
+	hnsw.ef_search = ef_search
+
+	return nil
+}
+
+// MetricType returns the metric the graph is built with
+func (hnsw *IndexHNSW) MetricType() MetricType {
+	return hnsw.metric_type
+}
+
+// Search searches the graph for the k nearest neighbors of x.
+// metric_type must be the metric the graph is built with.
+func (hnsw *IndexHNSW) Search(x []float64, k int32, metric_type MetricType) (SearchResult, error) {
+	if len(x) != int(hnsw.dim) {
+		return SearchResult{}, fmt.Errorf("IndexHNSW: Search: %w", ErrDimensionMismatch)
+	}
+	if k <= 0 {
+		return SearchResult{}, fmt.Errorf("IndexHNSW: Search: %w", ErrInvalidParameter)
+	}
+	if metric_type != hnsw.metric_type {
+		return SearchResult{}, fmt.Errorf("IndexHNSW: Search: %w", ErrMetricMismatch)
+	}
+
+	if hnsw.size == 0 {
+		return SearchResult{Idxs: []int32{}, Distances: []float64{}, Vecs: [][]float64{}}, nil
+	}
+
+	q := mat.NewVecDense(int(hnsw.dim), x)
+
+	// step 1. greedy search from the top layer down to layer 1
+	ep := hnsw.entry_point
+	ep_dist := hnsw.distance(q, &hnsw.vecs[ep])
+	for level := hnsw.max_level; level > 0; level-- {
+		ep, ep_dist = hnsw.greedy_search_layer(q, ep, ep_dist, level)
+	}
+
+	// step 2. search layer 0 with a candidate list of size max(ef_search, k)
+	ef := hnsw.ef_search
+	if ef < k {
+		ef = k
+	}
+	results := hnsw.search_layer(q, []hnsw_node{{idx: ep, dist: ep_dist}}, ef, 0)
+
+	// step 3. keep the k nearest and select copies of the vectors by idxs
+	if int32(len(results)) > k {
+		results = results[:k]
+	}
+	idxs := make([]int32, len(results))
+	distances := make([]float64, len(results))
+	for i := range results {
+		idxs[i] = results[i].idx
+		distances[i] = hnsw.metric_distance(results[i].dist)
+	}
+
+	result := new_search_result(idxs, distances, hnsw.metric_type)
+	result.Vecs = make([][]float64, len(result.Idxs))
+	for i := range result.Idxs {
+		result.Vecs[i] = append([]float64(nil), hnsw.vecs[result.Idxs[i]].RawVector().Data...)
+	}
+
+	return result, nil
+}
+
+func (hnsw *IndexHNSW) Add(x []float64) error {
+	if len(x) != int(hnsw.dim) {
+		return fmt.Errorf("IndexHNSW: Add: %w", ErrDimensionMismatch)
+	}
+
+	if hnsw.size >= hnsw.cap {
+		return fmt.Errorf("IndexHNSW: Add: %w", ErrIndexFull)
+	}
+
+	// the vector is copied so the caller may reuse x
+	hnsw.size++
+	hnsw.vecs[hnsw.size-1] = *mat.NewVecDense(int(hnsw.dim), append([]float64(nil), x...))
+	hnsw.insert(hnsw.size - 1)
+
+	return nil
+}
+
+// BatchAdd adds all vectors of x, or none of them if one of them is invalid
+func (hnsw *IndexHNSW) BatchAdd(x [][]float64) error {
+	if !check_dims(x, hnsw.dim) {
+		return fmt.Errorf("IndexHNSW: BatchAdd: %w", ErrDimensionMismatch)
+	}
+	if hnsw.size+int32(len(x)) > hnsw.cap {
+		return fmt.Errorf("IndexHNSW: BatchAdd: %w", ErrIndexFull)
+	}
+
+	for i := range x {
+		hnsw.Add(x[i])
+	}
+
+	return nil
+}
+
+// Size returns the number of vectors in the index
+func (hnsw *IndexHNSW) Size() int32 {
+	return hnsw.size
+}
+
+// Remove removes all the vectors, the storage is reallocated at the capacity like Init so vectors can be added again
+func (hnsw *IndexHNSW) Remove() {
+	hnsw.size = 0
+	hnsw.vecs = make([]mat.VecDense, hnsw.cap)
+	hnsw.levels = make([]int32, 0, hnsw.cap)
+	hnsw.neighbors = make([][][]int32, 0, hnsw.cap)
+	hnsw.entry_point = -1
+	hnsw.max_level = -1
+	hnsw.rng = rand.New(rand.NewSource(hnsw_random_seed))
+}
+
+// insert links the node into the graph, the vector of node must be already stored
+func (hnsw *IndexHNSW) insert(node int32) {
+	level := hnsw.random_level()
+	hnsw.levels = append(hnsw.levels, level)
+	hnsw.neighbors = append(hnsw.neighbors, make([][]int32, level+1))
+
+	// the first node is the entry point
+	if hnsw.entry_point < 0 {
+		hnsw.entry_point = node
+		hnsw.max_level = level
+		return
+	}
+
+	q := &hnsw.vecs[node]
+
+	// step 1. greedy search from the top layer down to the layer above the node's top layer
+	ep := hnsw.entry_point
+	ep_dist := hnsw.distance(q, &hnsw.vecs[ep])
+	for l := hnsw.max_level; l > level; l-- {
+		ep, ep_dist = hnsw.greedy_search_layer(q, ep, ep_dist, l)
+	}
+
+	// step 2. on every layer the node belongs to, connect it with the selected neighbors
+	entry_points := []hnsw_node{{idx: ep, dist: ep_dist}}
+	top := level
+	if top > hnsw.max_level {
+		top = hnsw.max_level
+	}
+	for l := top; l >= 0; l-- {
+		candidates := hnsw.search_layer(q, entry_points, hnsw.ef_construction, l)
+		selected := hnsw.select_neighbors(candidates, hnsw.max_neighbors(l))
+
+		hnsw.neighbors[node][l] = make([]int32, 0, len(selected))
+		for _, nb := range selected {
+			hnsw.neighbors[node][l] = append(hnsw.neighbors[node][l], nb.idx)
+			hnsw.add_link(nb.idx, node, nb.dist, l)
+		}
+
+		entry_points = candidates
+	}
+
+	// step 3. the node becomes the new entry point if it reaches a new top layer
+	if level > hnsw.max_level {
+		hnsw.entry_point = node
+		hnsw.max_level = level
+	}
+}
+
+// add_link adds dst to the adjacency list of src on layer, shrinking the list if it overflows
+func (hnsw *IndexHNSW) add_link(src int32, dst int32, dist float64, level int32) {
+	max_nb := hnsw.max_neighbors(level)
+	if int32(len(hnsw.neighbors[src][level])) < max_nb {
+		hnsw.neighbors[src][level] = append(hnsw.neighbors[src][level], dst)
+		return
+	}
+
+	candidates := make([]hnsw_node, 0, len(hnsw.neighbors[src][level])+1)
+	candidates = append(candidates, hnsw_node{idx: dst, dist: dist})
+	for _, nb := range hnsw.neighbors[src][level] {
+		candidates = append(candidates, hnsw_node{idx: nb, dist: hnsw.distance(&hnsw.vecs[src], &hnsw.vecs[nb])})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].dist < candidates[j].dist
+	})
+
+	selected := hnsw.select_neighbors(candidates, max_nb)
+	hnsw.neighbors[src][level] = hnsw.neighbors[src][level][:0]
+	for _, nb := range selected {
+		hnsw.neighbors[src][level] = append(hnsw.neighbors[src][level], nb.idx)
+	}
+}
+
+// select_neighbors selects at most m neighbors from the candidates sorted by distance with the heuristic of
+// the HNSW paper: a candidate is kept only if it is closer to the base node than to any selected neighbor,
+// so that the neighbors are spread in different directions.
+func (hnsw *IndexHNSW) select_neighbors(candidates []hnsw_node, m int32) []hnsw_node {
+	if int32(len(candidates)) <= m {
+		return candidates
+	}
+
+	selected := make([]hnsw_node, 0, m)
+	for _, c := range candidates {
+		keep := true
+		for _, s := range selected {
+			if hnsw.distance(&hnsw.vecs[c.idx], &hnsw.vecs[s.idx]) < c.dist {
+				keep = false
+				break
+			}
+		}
+
+		if keep {
+			selected = append(selected, c)
+			if int32(len(selected)) >= m {
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// greedy_search_layer moves to the nearest neighbor on layer until no neighbor is closer to q
+func (hnsw *IndexHNSW) greedy_search_layer(q *mat.VecDense, ep int32, ep_dist float64, level int32) (int32, float64) {
+	for changed := true; changed; {
+		changed = false
+		for _, nb := range hnsw.neighbors[ep][level] {
+			dist := hnsw.distance(q, &hnsw.vecs[nb])
+			if dist < ep_dist {
+				ep, ep_dist = nb, dist
+				changed = true
+			}
+		}
+	}
+
+	return ep, ep_dist
+}
+
+// search_layer does a best-first search on layer and returns at most ef nearest nodes sorted by distance
+func (hnsw *IndexHNSW) search_layer(q *mat.VecDense, entry_points []hnsw_node, ef int32, level int32) []hnsw_node {
+	visited := make(map[int32]bool, ef*hnsw.m)
+
+	var candidates hnsw_min_queue
+	var results utils.DistanceMaxHeap
+	results.Init(ef)
+
+	for _, ep := range entry_points {
+		visited[ep.idx] = true
+		heap.Push(&candidates, ep)
+		results.Push(ep.dist, ep.idx)
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(&candidates).(hnsw_node)
+		if results.Size() >= ef && c.dist > results.Peek() {
+			break
+		}
+
+		for _, nb := range hnsw.neighbors[c.idx][level] {
+			if visited[nb] {
+				continue
+			}
+			visited[nb] = true
+
+			dist := hnsw.distance(q, &hnsw.vecs[nb])
+			if results.Size() < ef || dist < results.Peek() {
+				heap.Push(&candidates, hnsw_node{idx: nb, dist: dist})
+				results.Push(dist, nb)
+			}
+		}
+	}
+
+	nodes := make([]hnsw_node, results.Size())
+	for i, idx := range results.Idxs() {
+		nodes[i] = hnsw_node{idx: idx, dist: results.Distance()[i]}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].dist == nodes[j].dist {
+			return nodes[i].idx < nodes[j].idx
+		}
+		return nodes[i].dist < nodes[j].dist
+	})
+
+	return nodes
+}
+
+func (hnsw *IndexHNSW) max_neighbors(level int32) int32 {
+	if level == 0 {
+		return 2 * hnsw.m
+	}
+	return hnsw.m
+}
+
+func (hnsw *IndexHNSW) random_level() int32 {
+	return int32(-math.Log(1-hnsw.rng.Float64()) * hnsw.level_mult)
+}
+
+// distance returns the distance between a and b, more smaller, more similar.
+// IP and cosine similarity are negated so that all metrics are ordered the same way.
+func (hnsw *IndexHNSW) distance(a, b *mat.VecDense) float64 {
+	switch hnsw.metric_type {
+	case METRIC_IP:
+		return -utils.InnerProductDistance(*a, *b)
+	case METRIC_COSINE:
+		return -utils.CosineDistance(*a, *b)
+	default:
+		return utils.L2Distance(*a, *b)
+	}
+}
+
+// metric_distance converts a distance returned by distance back to the distance or similarity of the metric
+func (hnsw *IndexHNSW) metric_distance(dist float64) float64 {
+	if hnsw.metric_type == METRIC_IP || hnsw.metric_type == METRIC_COSINE {
+		return -dist
+	}
+	return dist
+}
+
+// hnsw_node is a node of the graph with its distance to the query
+type hnsw_node struct {
+	idx  int32
+	dist float64
+}
+
+// hnsw_min_queue is a min heap of nodes ordered by distance, used as the candidate list of search_layer
+type hnsw_min_queue []hnsw_node
+
+func (q hnsw_min_queue) Len() int           { return len(q) }
+func (q hnsw_min_queue) Less(i, j int) bool { return q[i].dist < q[j].dist }
+func (q hnsw_min_queue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *hnsw_min_queue) Push(x any) {
+	*q = append(*q, x.(hnsw_node))
+}
+
+func (q *hnsw_min_queue) Pop() any {
+	old := *q
+	n := len(old)
+	node := old[n-1]
+	*q = old[:n-1]
+	return node
+}
@@ -0,0 +1,191 @@
+package nanofaiss
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func random_vecs(n int, d int, seed int64) [][]float64 {
+	r := rand.New(rand.NewSource(seed))
+
+	x := make([][]float64, n)
+	for i := range x {
+		x[i] = make([]float64, d)
+		for j := range x[i] {
+			x[i][j] = r.Float64()*20 - 10
+		}
+	}
+
+	return x
+}
+
+func TestIndexHNSW_Search(t *testing.T) {
+	Convey("IndexHNSW_Search", t, func() {
+		q := []float64{6.6541, 9.1702, 7.5098, -8.3963, 4.3156, -5.5704, -4.3876, -2.0011, -2.1687, 3.2732, 3.5592, 5.8669, -8.0175, 9.9450, -6.2154, 3.7234}
+
+		type args struct {
+			x           []float64
+			k           int32
+			metric_type MetricType
+		}
+		tests := []struct {
+			name      string
+			args      args
+			want_idxs []int32
+		}{
+			{
+				name: "test case 1: METRIC_L2",
+				args: args{
+					x:           q,
+					k:           3,
+					metric_type: METRIC_L2,
+				},
+				want_idxs: []int32{9, 1, 3},
+			},
+			{
+				name: "test case 2: METRIC_IP",
+				args: args{
+					x:           q,
+					k:           4,
+					metric_type: METRIC_IP,
+				},
+				want_idxs: []int32{9, 3, 2, 5},
+			},
+			{
+				name: "test case 3: METRIC_COSINE",
+				args: args{
+					x:           q,
+					k:           5,
+					metric_type: METRIC_COSINE,
+				},
+				want_idxs: []int32{9, 3, 2, 5, 1},
+			},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				var index_hnsw IndexHNSW
+				index_hnsw.InitWithOptions(int32(len(vecs)), 16, 4, 40, 16, tt.args.metric_type)
+				index_hnsw.BatchAdd(vecs)
+
+				// on such a small graph HNSW search is exact, the distances equal the ones of IndexFlat
+				var flat IndexFlat
+				flat.Init(int32(len(vecs)), 16)
+				flat.BatchAdd(vecs)
+				want, err := flat.Search(tt.args.x, tt.args.k, tt.args.metric_type)
+				So(err, ShouldBeNil)
+
+				got, err := index_hnsw.Search(tt.args.x, tt.args.k, tt.args.metric_type)
+				So(err, ShouldBeNil)
+				So(got.Idxs, ShouldResemble, tt.want_idxs)
+				So(got.Distances, ShouldResemble, want.Distances)
+				So(got.Vecs, ShouldResemble, want.Vecs)
+			})
+		}
+	})
+}
+
+func TestIndexHNSW_Recall(t *testing.T) {
+	Convey("IndexHNSW_Recall", t, func() {
+		n, d, k := 2000, 16, int32(10)
+		xb := random_vecs(n, d, 1)
+		xq := random_vecs(50, d, 2)
+
+		var flat IndexFlat
+		flat.Init(int32(n), int32(d))
+		flat.BatchAdd(xb)
+
+		var index_hnsw IndexHNSW
+		index_hnsw.InitWithOptions(int32(n), int32(d), 16, 40, 64, METRIC_L2)
+		index_hnsw.BatchAdd(xb)
+
+		hits := 0
+		for _, q := range xq {
+			want, err := flat.Search(q, k, METRIC_L2)
+			So(err, ShouldBeNil)
+			got, err := index_hnsw.Search(q, k, METRIC_L2)
+			So(err, ShouldBeNil)
+
+			want_set := make(map[int32]bool, len(want.Idxs))
+			for _, idx := range want.Idxs {
+				want_set[idx] = true
+			}
+			for _, idx := range got.Idxs {
+				if want_set[idx] {
+					hits++
+				}
+			}
+		}
+
+		recall := float64(hits) / float64(len(xq)*int(k))
+		So(recall, ShouldBeGreaterThanOrEqualTo, 0.95)
+	})
+}
+
+func TestIndexHNSW_Remove(t *testing.T) {
+	n, d, k := 200, 16, int32(5)
+	xb := random_vecs(n, d, 3)
+	xq := random_vecs(10, d, 4)
+
+	var fresh IndexHNSW
+	fresh.Init(int32(n), int32(d))
+	fresh.BatchAdd(xb)
+
+	Convey("IndexHNSW_Remove", t, func() {
+		var index_hnsw IndexHNSW
+		index_hnsw.Init(int32(n), int32(d))
+		So(index_hnsw.BatchAdd(random_vecs(n, d, 5)), ShouldBeNil)
+		index_hnsw.Remove()
+		So(index_hnsw.size, ShouldEqual, 0)
+
+		// the vectors added after Remove build the same graph as a new index
+		So(index_hnsw.Add(xb[0]), ShouldBeNil)
+		So(index_hnsw.BatchAdd(xb[1:]), ShouldBeNil)
+		So(index_hnsw.size, ShouldEqual, n)
+		for _, q := range xq {
+			want, err := fresh.Search(q, k, METRIC_L2)
+			So(err, ShouldBeNil)
+			got, err := index_hnsw.Search(q, k, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, want)
+		}
+	})
+}
+
+func TestIndexHNSW_Add(t *testing.T) {
+	d := 16
+	xb := random_vecs(10, d, 6)
+
+	Convey("IndexHNSW_Add", t, func() {
+		var index_hnsw IndexHNSW
+		index_hnsw.Init(int32(len(xb)), int32(d))
+
+		Convey("test case 1: the index keeps copies of the added vectors and returns copies of its vectors", func() {
+			x := append([]float64(nil), xb[0]...)
+			So(index_hnsw.Add(x), ShouldBeNil)
+			So(index_hnsw.BatchAdd(xb[1:]), ShouldBeNil)
+			x[0] += 100
+
+			got, err := index_hnsw.Search(xb[0], 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got.Idxs, ShouldResemble, []int32{0})
+			So(got.Vecs, ShouldResemble, [][]float64{xb[0]})
+
+			got.Vecs[0][0] += 100
+			got, err = index_hnsw.Search(xb[0], 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got.Vecs, ShouldResemble, [][]float64{xb[0]})
+		})
+
+		Convey("test case 2: SetEfSearch", func() {
+			So(index_hnsw.SetEfSearch(64), ShouldBeNil)
+			So(index_hnsw.ef_search, ShouldEqual, 64)
+			So(errors.Is(index_hnsw.SetEfSearch(0), ErrInvalidParameter), ShouldBeTrue)
+			So(errors.Is(index_hnsw.SetEfSearch(-1), ErrInvalidParameter), ShouldBeTrue)
+			So(index_hnsw.ef_search, ShouldEqual, 64)
+		})
+	})
+}
@@ -0,0 +1,206 @@
+package nanofaiss
+
+import "fmt"
+
+// IndexIDMap wraps an Index to identify the vectors by external int64 ids instead of their insertion order.
+// The vectors are stored in the wrapped index, id_map translates the idxs of the wrapped index to the external ids.
+type IndexIDMap struct {
+	index  Index
+	id_map []int64 // id_map[i] is the external id of the i-th vector of index
+}
+
+// IDSearchResult is the result of a knn search on an IndexIDMap, ranked like SearchResult.
+// IDs[i] is the external id of the i-th neighbor.
+type IDSearchResult struct {
+	IDs       []int64
+	Distances []float64
+	Vecs      [][]float64
+}
+
+// NewIndexIDMap wraps index, which should be initialized and empty, it returns ErrInvalidParameter otherwise
+func NewIndexIDMap(index Index) (*IndexIDMap, error) {
+	if index.Size() != 0 {
+		return nil, fmt.Errorf("IndexIDMap: NewIndexIDMap: index is not empty: %w", ErrInvalidParameter)
+	}
+
+	return &IndexIDMap{
+		index:  index,
+		id_map: []int64{},
+	}, nil
+}
+
+// Index returns the wrapped index
+func (idmap *IndexIDMap) Index() Index {
+	return idmap.index
+}
+
+// AddWithIDs adds the vectors x to the wrapped index, ids[i] is the external id of x[i]
+func (idmap *IndexIDMap) AddWithIDs(ids []int64, x [][]float64) error {
+	if len(ids) != len(x) {
+		return fmt.Errorf("IndexIDMap: AddWithIDs: number of ids is not equal to number of vectors: %w", ErrInvalidParameter)
+	}
+
+	if err := idmap.index.BatchAdd(x); err != nil {
+		return fmt.Errorf("IndexIDMap: AddWithIDs: %w", err)
+	}
+	idmap.id_map = append(idmap.id_map, ids...)
+
+	return nil
+}
+
+// Search searches the k nearest neighbors of x in the wrapped index and translates their idxs to external ids
+func (idmap *IndexIDMap) Search(x []float64, k int32, metric_type MetricType) (IDSearchResult, error) {
+	result, err := idmap.index.Search(x, k, metric_type)
+	if err != nil {
+		return IDSearchResult{}, fmt.Errorf("IndexIDMap: Search: %w", err)
+	}
+
+	ids := make([]int64, len(result.Idxs))
+	for i, idx := range result.Idxs {
+		ids[i] = idmap.id_map[idx]
+	}
+
+	return IDSearchResult{
+		IDs:       ids,
+		Distances: result.Distances,
+		Vecs:      result.Vecs,
+	}, nil
+}
+
+// RemoveIDs removes the vectors whose external id is selected by sel from the wrapped index and returns the number
+// of removed vectors, it returns ErrNotSupported if the wrapped index has no RemoveIDs.
+// Like the remove_ids of Faiss, id_map is compacted in the order the storage of IndexFlat is, except for
+// IndexIVFFlat which does not renumber its ids.
+func (idmap *IndexIDMap) RemoveIDs(sel IDSelector) (int32, error) {
+	removed, _, err := idmap.remove_ids(sel)
+	return removed, err
+}
+
+// remove_ids is RemoveIDs, it also returns true if the idxs of the wrapped index are renumbered
+func (idmap *IndexIDMap) remove_ids(sel IDSelector) (int32, bool, error) {
+	remover, ok := idmap.index.(id_remover)
+	if !ok {
+		return 0, false, fmt.Errorf("IndexIDMap: RemoveIDs: %w", ErrNotSupported)
+	}
+
+	removed := remover.RemoveIDs(&id_selector_translated{id_map: idmap.id_map, sel: sel})
+	if _, ok := idmap.index.(*IndexIVFFlat); ok {
+		return removed, false, nil
+	}
+
+	j := 0
+	for _, id := range idmap.id_map {
+		if !sel.IsMember(id) {
+			idmap.id_map[j] = id
+			j++
+		}
+	}
+	idmap.id_map = idmap.id_map[:j]
+
+	return removed, true, nil
+}
+
+// Remove removes all vectors from the wrapped index
+func (idmap *IndexIDMap) Remove() {
+	idmap.index.Remove()
+	idmap.id_map = []int64{}
+}
+
+// Size returns the number of vectors
+func (idmap *IndexIDMap) Size() int32 {
+	return idmap.index.Size()
+}
+
+// id_remover is an index which can remove a subset of its vectors selected by idx
+type id_remover interface {
+	RemoveIDs(sel IDSelector) int32
+}
+
+// id_selector_translated selects the idxs of the wrapped index whose external id is selected by sel
+type id_selector_translated struct {
+	id_map []int64
+	sel    IDSelector
+}
+
+func (sel *id_selector_translated) IsMember(idx int64) bool {
+	if idx < 0 || idx >= int64(len(sel.id_map)) {
+		return false
+	}
+	return sel.sel.IsMember(sel.id_map[idx])
+}
+
+// IndexIDMap2 is an IndexIDMap which also maintains the reverse mapping from external ids to the idxs of
+// the wrapped index, so the external ids must be unique.
+type IndexIDMap2 struct {
+	IndexIDMap
+	rev_map map[int64]int32 // rev_map[id] is the idx of the vector of external id in the wrapped index
+}
+
+// NewIndexIDMap2 wraps index, which should be initialized and empty, it returns ErrInvalidParameter otherwise
+func NewIndexIDMap2(index Index) (*IndexIDMap2, error) {
+	idmap, err := NewIndexIDMap(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IndexIDMap2{
+		IndexIDMap: *idmap,
+		rev_map:    make(map[int64]int32),
+	}, nil
+}
+
+// AddWithIDs adds the vectors x to the wrapped index, ids[i] is the external id of x[i] and should not exist yet
+func (idmap2 *IndexIDMap2) AddWithIDs(ids []int64, x [][]float64) error {
+	seen := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		if _, ok := idmap2.rev_map[id]; ok || seen[id] {
+			return fmt.Errorf("IndexIDMap2: AddWithIDs: id %d: %w", id, ErrDuplicateID)
+		}
+		seen[id] = true
+	}
+
+	idx := int32(len(idmap2.id_map))
+	if err := idmap2.IndexIDMap.AddWithIDs(ids, x); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		idmap2.rev_map[id] = idx + int32(i)
+	}
+
+	return nil
+}
+
+// Lookup returns the idx in the wrapped index of the vector of external id
+func (idmap2 *IndexIDMap2) Lookup(id int64) (int32, bool) {
+	idx, ok := idmap2.rev_map[id]
+	return idx, ok
+}
+
+// RemoveIDs is IndexIDMap.RemoveIDs, the removed ids are dropped from the reverse mapping
+func (idmap2 *IndexIDMap2) RemoveIDs(sel IDSelector) (int32, error) {
+	removed, renumbered, err := idmap2.remove_ids(sel)
+	if err != nil {
+		return 0, err
+	}
+
+	if renumbered {
+		idmap2.rev_map = make(map[int64]int32, len(idmap2.id_map))
+		for idx, id := range idmap2.id_map {
+			idmap2.rev_map[id] = int32(idx)
+		}
+	} else {
+		for id := range idmap2.rev_map {
+			if sel.IsMember(id) {
+				delete(idmap2.rev_map, id)
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// Remove removes all vectors from the wrapped index
+func (idmap2 *IndexIDMap2) Remove() {
+	idmap2.IndexIDMap.Remove()
+	idmap2.rev_map = make(map[int64]int32)
+}
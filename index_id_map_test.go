@@ -0,0 +1,196 @@
+package nanofaiss
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/crowaixyz/nanofaiss/pkg/kmeans"
+)
+
+func TestIndexIDMap_Search(t *testing.T) {
+	Convey("IndexIDMap_Search", t, func() {
+		q := []float64{6.6541, 9.1702, 7.5098, -8.3963, 4.3156, -5.5704, -4.3876, -2.0011, -2.1687, 3.2732, 3.5592, 5.8669, -8.0175, 9.9450, -6.2154, 3.7234}
+		ids := []int64{1000, 1001, 1002, 1003, 1004, 1005, 1006, 1007, 1008, 1 << 40}
+
+		tests := []struct {
+			name        string
+			index       Index
+			metric_type MetricType
+			k           int32
+			want_ids    []int64
+		}{
+			{
+				name:        "test case 1: IndexFlat",
+				index:       &IndexFlat{},
+				metric_type: METRIC_L2,
+				k:           3,
+				want_ids:    []int64{1 << 40, 1001, 1003},
+			},
+			{
+				name:        "test case 2: IndexHNSW",
+				index:       &IndexHNSW{},
+				metric_type: METRIC_L2,
+				k:           3,
+				want_ids:    []int64{1 << 40, 1001, 1003},
+			},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				tt.index.Init(int32(len(vecs)), 16)
+				idmap, err := NewIndexIDMap(tt.index)
+				So(err, ShouldBeNil)
+				idmap.AddWithIDs(ids, vecs)
+				So(idmap.Size(), ShouldEqual, len(vecs))
+
+				got, err := idmap.Search(q, tt.k, tt.metric_type)
+				So(err, ShouldBeNil)
+				want, err := tt.index.Search(q, tt.k, tt.metric_type)
+				So(err, ShouldBeNil)
+				So(got.IDs, ShouldResemble, tt.want_ids)
+				So(got.Distances, ShouldResemble, want.Distances)
+				So(got.Vecs, ShouldResemble, want.Vecs)
+
+				idmap.Remove()
+				So(idmap.Size(), ShouldEqual, 0)
+			})
+		}
+	})
+}
+
+func TestIndexIDMap2_Lookup(t *testing.T) {
+	Convey("IndexIDMap2_Lookup", t, func() {
+		var flat IndexFlat
+		flat.Init(int32(len(vecs)), 16)
+		idmap2, err := NewIndexIDMap2(&flat)
+		So(err, ShouldBeNil)
+
+		idmap2.AddWithIDs([]int64{42, 7}, vecs[:2])
+		idmap2.AddWithIDs([]int64{-3}, vecs[2:3])
+
+		idx, ok := idmap2.Lookup(7)
+		So(ok, ShouldBeTrue)
+		So(idx, ShouldEqual, 1)
+
+		idx, ok = idmap2.Lookup(-3)
+		So(ok, ShouldBeTrue)
+		So(idx, ShouldEqual, 2)
+
+		_, ok = idmap2.Lookup(8)
+		So(ok, ShouldBeFalse)
+
+		got, err := idmap2.Search(vecs[1], 1, METRIC_L2)
+		So(err, ShouldBeNil)
+		So(got.IDs, ShouldResemble, []int64{7})
+
+		So(errors.Is(idmap2.AddWithIDs([]int64{42}, vecs[3:4]), ErrDuplicateID), ShouldBeTrue)
+		So(errors.Is(idmap2.AddWithIDs([]int64{5, 5}, vecs[3:5]), ErrDuplicateID), ShouldBeTrue)
+		So(errors.Is(idmap2.AddWithIDs([]int64{5}, vecs[3:5]), ErrInvalidParameter), ShouldBeTrue)
+		So(idmap2.Size(), ShouldEqual, 3)
+		So(flat.Size(), ShouldEqual, 3)
+	})
+}
+
+func TestIndexIDMap_RemoveIDs(t *testing.T) {
+	n, d := 300, 16
+	xb := random_vecs(n, d, 11)
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = int64(i)*10 + 1<<40
+	}
+
+	// remove the ids of the even vectors
+	removed_ids := make([]int64, 0, n/2)
+	for i := 0; i < n; i += 2 {
+		removed_ids = append(removed_ids, ids[i])
+	}
+
+	Convey("IndexIDMap_RemoveIDs", t, func() {
+		// define test cases
+		tests := []struct {
+			name     string
+			index    func() Index
+			want_idx func(i int) int32 // idx of the i-th vector after the removal
+		}{
+			{
+				name: "test case 1: IndexFlat renumbers the vectors",
+				index: func() Index {
+					var flat IndexFlat
+					flat.Init(int32(n), int32(d))
+					return &flat
+				},
+				want_idx: func(i int) int32 { return int32(i / 2) },
+			},
+			{
+				name: "test case 2: IndexIVFFlat keeps the ids",
+				index: func() Index {
+					var ivf IndexIVFFlat
+					ivf.InitWithOptions(0, int32(d), 4, METRIC_L2, nil)
+					ivf.SetKMeansOptions(kmeans.WithSeed(1))
+					ivf.TrainCentroids(xb, 10, 0.001)
+					ivf.SetNprobe(4)
+					return &ivf
+				},
+				want_idx: func(i int) int32 { return int32(i) },
+			},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				idmap2, err := NewIndexIDMap2(tt.index())
+				So(err, ShouldBeNil)
+				So(idmap2.AddWithIDs(ids, xb), ShouldBeNil)
+
+				removed, err := idmap2.RemoveIDs(NewIDSelectorBatch(removed_ids))
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, n/2)
+				So(idmap2.Size(), ShouldEqual, n/2)
+
+				// the remaining vectors are found with their external id, the removed ones are gone
+				for i := range xb {
+					got, err := idmap2.Search(xb[i], 1, METRIC_L2)
+					So(err, ShouldBeNil)
+					idx, ok := idmap2.Lookup(ids[i])
+					if i%2 == 0 {
+						So(got.IDs[0], ShouldNotEqual, ids[i])
+						So(ok, ShouldBeFalse)
+					} else {
+						So(got.IDs, ShouldResemble, []int64{ids[i]})
+						So(ok, ShouldBeTrue)
+						So(idx, ShouldEqual, tt.want_idx(i))
+						So(got.Vecs[0], ShouldResemble, xb[i])
+					}
+				}
+
+				// removing again removes nothing, the vectors added after get their external id
+				removed, err = idmap2.RemoveIDs(NewIDSelectorBatch(removed_ids))
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 0)
+				So(idmap2.AddWithIDs([]int64{ids[0]}, xb[:1]), ShouldBeNil)
+				got, err := idmap2.Search(xb[0], 1, METRIC_L2)
+				So(err, ShouldBeNil)
+				So(got.IDs, ShouldResemble, []int64{ids[0]})
+				So(idmap2.Size(), ShouldEqual, n/2+1)
+			})
+		}
+
+		Convey("test case 3: errors", func() {
+			var hnsw IndexHNSW
+			hnsw.Init(int32(n), int32(d))
+			idmap, err := NewIndexIDMap(&hnsw)
+			So(err, ShouldBeNil)
+			So(idmap.AddWithIDs(ids[:1], xb[:1]), ShouldBeNil)
+			_, err = idmap.RemoveIDs(NewIDSelectorBatch(ids[:1]))
+			So(errors.Is(err, ErrNotSupported), ShouldBeTrue)
+
+			// an index which is not empty is rejected
+			_, err = NewIndexIDMap(&hnsw)
+			So(errors.Is(err, ErrInvalidParameter), ShouldBeTrue)
+			_, err = NewIndexIDMap2(&hnsw)
+			So(errors.Is(err, ErrInvalidParameter), ShouldBeTrue)
+		})
+	})
+}
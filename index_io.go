@@ -0,0 +1,209 @@
+package nanofaiss
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// binary format of the serialized indexes, all numbers are little-endian:
+//
+//	magic   [4]byte "NFSS"
+//	version uint32, the versions up to INDEX_IO_VERSION are read
+//	fourcc  [4]byte type of the index, eg. "IxFl" for IndexFlat
+//	body    specific to the type of the index
+//	crc     uint32 CRC-32 (IEEE) of all the preceding bytes
+const (
+	INDEX_IO_MAGIC          = "NFSS"
+	INDEX_IO_VERSION uint32 = 4 // version 2 adds the metric of IndexIVFFlat, version 3 its quantizer, version 4 stores its vectors in the lists
+)
+
+// fourcc of the serialized index types
+const (
+	index_flat_fourcc     = "IxFl"
+	index_ivf_flat_fourcc = "IvFl"
+)
+
+// types of the coarse quantizer of a serialized IndexIVFFlat
+const (
+	ivf_quantizer_flat int32 = 0
+	ivf_quantizer_hnsw int32 = 1
+)
+
+// number of elements read at a time, so a corrupted length fails at the end of the data instead of allocating it
+const index_io_read_chunk = 4096
+
+// index_writer writes the header and the body of an index and computes the checksum on the fly.
+// The first error is sticky, the following writes are no-ops and close returns it.
+type index_writer struct {
+	w   io.Writer // writes to the underlying writer and the checksum
+	raw io.Writer
+	crc hash.Hash32
+	err error
+}
+
+func new_index_writer(w io.Writer, fourcc string) *index_writer {
+	crc := crc32.NewIEEE()
+	iw := &index_writer{
+		w:   io.MultiWriter(w, crc),
+		raw: w,
+		crc: crc,
+	}
+
+	iw.write([]byte(INDEX_IO_MAGIC))
+	iw.write(INDEX_IO_VERSION)
+	iw.write([]byte(fourcc))
+
+	return iw
+}
+
+func (iw *index_writer) write(data any) {
+	if iw.err != nil {
+		return
+	}
+	iw.err = binary.Write(iw.w, binary.LittleEndian, data)
+}
+
+// close writes the checksum, which is not part of the checksum itself
+func (iw *index_writer) close() error {
+	if iw.err != nil {
+		return iw.err
+	}
+
+	return binary.Write(iw.raw, binary.LittleEndian, iw.crc.Sum32())
+}
+
+// index_reader reads the header and the body of an index and verifies the checksum in close.
+// The first error is sticky, the following reads return zero values and close returns it.
+type index_reader struct {
+	r       io.Reader // reads from the underlying reader and feeds the checksum
+	raw     io.Reader
+	crc     hash.Hash32
+	version uint32 // version of the format being read
+	err     error
+}
+
+// new_index_reader reads the header, it returns ErrInvalidFormat if it is not the header of an index of fourcc
+func new_index_reader(r io.Reader, fourcc string) (*index_reader, error) {
+	crc := crc32.NewIEEE()
+	ir := &index_reader{
+		r:   io.TeeReader(r, crc),
+		raw: r,
+		crc: crc,
+	}
+
+	magic := make([]byte, len(INDEX_IO_MAGIC))
+	ir.read(magic)
+	version := ir.read_uint32()
+	index_fourcc := make([]byte, len(fourcc))
+	ir.read(index_fourcc)
+
+	if ir.err != nil {
+		return nil, ir.err
+	}
+	if string(magic) != INDEX_IO_MAGIC {
+		return nil, fmt.Errorf("bad magic %q: %w", magic, ErrInvalidFormat)
+	}
+	if version < 1 || version > INDEX_IO_VERSION {
+		return nil, fmt.Errorf("unsupported version %d: %w", version, ErrInvalidFormat)
+	}
+	if string(index_fourcc) != fourcc {
+		return nil, fmt.Errorf("index type %q is not %q: %w", index_fourcc, fourcc, ErrInvalidFormat)
+	}
+	ir.version = version
+
+	return ir, nil
+}
+
+func (ir *index_reader) read(data any) {
+	if ir.err != nil {
+		return
+	}
+
+	ir.err = binary.Read(ir.r, binary.LittleEndian, data)
+	if ir.err == io.EOF {
+		ir.err = io.ErrUnexpectedEOF
+	}
+}
+
+func (ir *index_reader) read_uint32() uint32 {
+	var v uint32
+	ir.read(&v)
+	return v
+}
+
+// read_int32 reads an int32 which should be in [lo, hi]
+func (ir *index_reader) read_int32(lo int32, hi int32) int32 {
+	var v int32
+	ir.read(&v)
+	if ir.err == nil && (v < lo || v > hi) {
+		ir.err = fmt.Errorf("value %d out of [%d, %d]: %w", v, lo, hi, ErrInvalidFormat)
+	}
+	return v
+}
+
+// read_float64s reads n float64 chunk by chunk
+func (ir *index_reader) read_float64s(n int) []float64 {
+	data := make([]float64, 0, min(n, index_io_read_chunk))
+	for len(data) < n && ir.err == nil {
+		chunk := make([]float64, min(n-len(data), index_io_read_chunk))
+		ir.read(chunk)
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+// read_int32s reads n int32 chunk by chunk
+func (ir *index_reader) read_int32s(n int) []int32 {
+	data := make([]int32, 0, min(n, index_io_read_chunk))
+	for len(data) < n && ir.err == nil {
+		chunk := make([]int32, min(n-len(data), index_io_read_chunk))
+		ir.read(chunk)
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+// write_vecs writes the data of the vectors one after another
+func (iw *index_writer) write_vecs(vecs []mat.VecDense) {
+	for i := range vecs {
+		iw.write(vecs[i].RawVector().Data)
+	}
+}
+
+// read_vecs reads n vectors of dimension d written by write_vecs
+func (ir *index_reader) read_vecs(n int32, d int32) []mat.VecDense {
+	vecs := make([]mat.VecDense, 0, min(int(n), index_io_read_chunk))
+	for i := int32(0); i < n && ir.err == nil; i++ {
+		data := ir.read_float64s(int(d))
+		if ir.err == nil {
+			vecs = append(vecs, *mat.NewVecDense(int(d), data))
+		}
+	}
+	return vecs
+}
+
+// close verifies the checksum, it returns ErrChecksumMismatch if the data is corrupted
+func (ir *index_reader) close() error {
+	if ir.err != nil {
+		return ir.err
+	}
+
+	want := ir.crc.Sum32()
+	var got uint32
+	if err := binary.Read(ir.raw, binary.LittleEndian, &got); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if got != want {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
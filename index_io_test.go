@@ -0,0 +1,191 @@
+package nanofaiss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/crowaixyz/nanofaiss/pkg/kmeans"
+)
+
+func TestIndexFlat_WriteIndex(t *testing.T) {
+	Convey("IndexFlat_WriteIndex", t, func() {
+		var flat IndexFlat
+		flat.Init(int32(len(vecs)), 16)
+		flat.BatchAdd(vecs)
+
+		var buf bytes.Buffer
+		So(flat.WriteIndex(&buf), ShouldBeNil)
+		// header, dim and size, vectors, checksum
+		So(buf.Len(), ShouldEqual, 12+8+len(vecs)*16*8+4)
+
+		var got IndexFlat
+		So(got.ReadIndex(bytes.NewReader(buf.Bytes())), ShouldBeNil)
+		So(got.Size(), ShouldEqual, len(vecs))
+		for i := range vecs {
+			So(got.vector(int32(i)), ShouldResemble, vecs[i])
+		}
+
+		// the index read is usable
+		So(got.Add(vecs[0]), ShouldBeNil)
+		result, err := got.Search(vecs[0], 2, METRIC_L2)
+		So(err, ShouldBeNil)
+		So(result.Idxs, ShouldResemble, []int32{0, 10})
+	})
+}
+
+func TestIndexIVFFlat_WriteIndex(t *testing.T) {
+	// training is done once, goconvey runs the top-level func for every leaf Convey
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	var ivf IndexIVFFlat
+	ivf.Train(&flat, 8, 10, 0.001)
+	ivf.RemoveIDs(NewIDSelectorRange(0, 100))
+
+	Convey("IndexIVFFlat_WriteIndex", t, func() {
+		var buf bytes.Buffer
+		So(ivf.WriteIndex(&buf), ShouldBeNil)
+
+		var got IndexIVFFlat
+		So(got.ReadIndex(&buf), ShouldBeNil)
+		So(got.size, ShouldEqual, ivf.size)
+		So(got.invlists, ShouldResemble, ivf.invlists)
+
+		for _, nprobe := range []int32{1, 3} {
+			So(ivf.SetNprobe(nprobe), ShouldBeNil)
+			want, err := ivf.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			So(got.SetNprobe(nprobe), ShouldBeNil)
+			results, err := got.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, want)
+		}
+
+		var untrained IndexIVFFlat
+		So(errors.Is(untrained.WriteIndex(&buf), ErrNotTrained), ShouldBeTrue)
+
+		Convey("test case 1: version 1 without the metric is read as L2", func() {
+			// version 1 has the vectors by id, including the removed ones, and no metric nor quantizer type
+			var v1 bytes.Buffer
+			le := binary.LittleEndian
+			v1.WriteString(INDEX_IO_MAGIC)
+			binary.Write(&v1, le, uint32(1))
+			v1.WriteString(index_ivf_flat_fourcc)
+			binary.Write(&v1, le, []int32{int32(d), int32(n)})
+			binary.Write(&v1, le, flat.data)
+			binary.Write(&v1, le, ivf.nlist)
+			for i := range ivf.clusters {
+				binary.Write(&v1, le, ivf.clusters[i].Center().RawVector().Data)
+			}
+			for i := range ivf.invlists {
+				binary.Write(&v1, le, int32(len(ivf.invlists[i])))
+				binary.Write(&v1, le, ivf.invlists[i])
+			}
+			binary.Write(&v1, le, crc32.ChecksumIEEE(v1.Bytes()))
+
+			var got IndexIVFFlat
+			So(got.ReadIndex(&v1), ShouldBeNil)
+			So(got.MetricType(), ShouldEqual, METRIC_L2)
+			So(got.invlists, ShouldResemble, ivf.invlists)
+			So(got.invlists_vecs, ShouldResemble, ivf.invlists_vecs)
+			So(got.next_id, ShouldEqual, n)
+			So(got.quantizer, ShouldHaveSameTypeAs, &IndexFlat{})
+		})
+
+		Convey("test case 2: HNSW quantizer", func() {
+			var quantizer IndexHNSW
+			quantizer.InitWithOptions(8, int32(d), 4, 20, 16, METRIC_L2)
+			var ivf_hnsw IndexIVFFlat
+			ivf_hnsw.SetKMeansOptions(kmeans.WithSeed(1))
+			So(ivf_hnsw.TrainWithQuantizer(&flat, 8, 10, 0.001, &quantizer), ShouldBeNil)
+			So(ivf_hnsw.WriteIndex(&buf), ShouldBeNil)
+
+			// the kmeans options of the index read into are kept
+			var got IndexIVFFlat
+			got.SetKMeansOptions(kmeans.WithSeed(2))
+			So(got.ReadIndex(&buf), ShouldBeNil)
+			So(len(got.kmeans_opts), ShouldEqual, 1)
+
+			// the graph of the centroids is built again with the same parameters
+			got_quantizer, ok := got.quantizer.(*IndexHNSW)
+			So(ok, ShouldBeTrue)
+			So(got_quantizer.m, ShouldEqual, 4)
+			So(got_quantizer.ef_construction, ShouldEqual, 20)
+			So(got_quantizer.ef_search, ShouldEqual, 16)
+			So(got_quantizer.neighbors, ShouldResemble, quantizer.neighbors)
+
+			So(ivf_hnsw.SetNprobe(2), ShouldBeNil)
+			want, err := ivf_hnsw.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			So(got.SetNprobe(2), ShouldBeNil)
+			results, err := got.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, want)
+		})
+
+		Convey("test case 3: unsupported quantizer", func() {
+			other := ivf
+			other.quantizer = &IndexLSH{}
+			err := other.WriteIndex(&buf)
+			So(errors.Is(err, ErrNotSupported), ShouldBeTrue)
+		})
+	})
+}
+
+func TestReadIndex_Errors(t *testing.T) {
+	Convey("ReadIndex_Errors", t, func() {
+		var flat IndexFlat
+		flat.Init(int32(len(vecs)), 16)
+		flat.BatchAdd(vecs)
+
+		var buf bytes.Buffer
+		flat.WriteIndex(&buf)
+		data := buf.Bytes()
+
+		corrupt := func(i int) []byte {
+			b := append([]byte{}, data...)
+			b[i] ^= 0xff
+			return b
+		}
+
+		tests := []struct {
+			name string
+			data []byte
+			want error
+		}{
+			{name: "test case 1: bad magic", data: corrupt(0), want: ErrInvalidFormat},
+			{name: "test case 2: unsupported version", data: corrupt(4), want: ErrInvalidFormat},
+			{name: "test case 3: bad dimension", data: corrupt(15), want: ErrInvalidFormat},
+			{name: "test case 4: corrupted vector", data: corrupt(100), want: ErrChecksumMismatch},
+			{name: "test case 5: corrupted checksum", data: corrupt(len(data) - 1), want: ErrChecksumMismatch},
+			{name: "test case 6: truncated", data: data[:len(data)-20], want: io.ErrUnexpectedEOF},
+			{name: "test case 7: empty", data: nil, want: io.ErrUnexpectedEOF},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				got := flat
+				err := got.ReadIndex(bytes.NewReader(tt.data))
+				So(errors.Is(err, tt.want), ShouldBeTrue)
+				So(got.Size(), ShouldEqual, len(vecs))
+			})
+		}
+
+		Convey("test case 8: another index type", func() {
+			var ivf IndexIVFFlat
+			err := ivf.ReadIndex(bytes.NewReader(data))
+			So(errors.Is(err, ErrInvalidFormat), ShouldBeTrue)
+		})
+	})
+}
@@ -1,66 +1,699 @@
 package nanofaiss
 
 import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
 	"gonum.org/v1/gonum/mat"
 
 	"github.com/crowaixyz/nanofaiss/pkg/kmeans"
+	"github.com/crowaixyz/nanofaiss/utils"
 )
 
 type IndexIVFFlat struct {
-	size int32
-	cap  int32
-	dim  int32
-	vecs []mat.VecDense
+	size    int32
+	cap     int32
+	dim     int32
+	next_id int32 // id of the next added vector, the number of vectors added including the removed ones
 
-	nlist    int32
-	clusters []kmeans.Cluster
+	metric_type   MetricType // metric of the kmeans training, the coarse quantizer and the search
+	nlist         int32
+	nprobe        int32 // number of inverted lists scanned by the searches, 0 means 1
+	clusters      []kmeans.Cluster
+	quantizer     Index       // coarse quantizer of the centroids, searched with metric_type to get the nearest lists
+	invlists      [][]int32   // ids of the vectors in every inverted list, sorted in ascending order
+	invlists_vecs [][]float64 // vectors of every inverted list one after another, dim per id of invlists
+	kmeans_opts   []kmeans.Option
 }
 
-func (ivf *IndexIVFFlat) Train(index_flat *IndexFlat, nlist int32, max_iterations int32, delta_threshold float64) {
-	ivf.size = index_flat.size
-	ivf.cap = index_flat.cap
-	ivf.dim = index_flat.dim
-	ivf.vecs = index_flat.vecs
+// Init initializes the index with nlist = 1, METRIC_L2 and an IndexFlat quantizer
+func (ivf *IndexIVFFlat) Init(n int32, d int32) error {
+	return ivf.InitWithOptions(n, d, 1, METRIC_L2, nil)
+}
 
+// InitWithOptions initializes the index with nlist inverted lists and metric_type, the centroids are learned by
+// TrainCentroids and kept in quantizer, which should be empty and initialized with dimension d and metric_type.
+// nil selects an IndexFlat.
+func (ivf *IndexIVFFlat) InitWithOptions(n int32, d int32, nlist int32, metric_type MetricType, quantizer Index) error {
+	if n < 0 || d <= 0 || nlist <= 0 {
+		return fmt.Errorf("IndexIVFFlat: Init: %w", ErrInvalidParameter)
+	}
+	if !metric_type.is_valid() {
+		return fmt.Errorf("IndexIVFFlat: Init: %w", ErrInvalidMetric)
+	}
+
+	ivf.size = 0
+	ivf.cap = n
+	ivf.dim = d
+	ivf.next_id = 0
+
+	ivf.metric_type = metric_type
 	ivf.nlist = nlist
+	ivf.nprobe = 1
+	ivf.clusters = nil
+	ivf.quantizer = quantizer
+	ivf.invlists = make([][]int32, nlist)
+	ivf.invlists_vecs = make([][]float64, nlist)
+
+	return nil
+}
+
+// TrainCentroids learns the nlist centroids with kmeans on the sample x, the vectors of x are not added,
+// the vectors added after are assigned to the inverted list of their nearest centroid.
+// The quantizer keeps the centroids, so the index should be initialized again before training it again.
+func (ivf *IndexIVFFlat) TrainCentroids(x [][]float64, max_iterations int32, delta_threshold float64) error {
+	if ivf.nlist <= 0 || int32(len(x)) < ivf.nlist {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", ErrInvalidParameter)
+	}
+	if ivf.clusters != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: already trained: %w", ErrInvalidParameter)
+	}
+	if !check_dims(x, ivf.dim) {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", ErrDimensionMismatch)
+	}
+	if err := ivf.check_quantizer(ivf.quantizer); err != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", err)
+	}
+
+	train_vecs := make([]mat.VecDense, len(x))
+	for i := range x {
+		train_vecs[i] = *mat.NewVecDense(int(ivf.dim), x[i])
+	}
+
+	clusters, err := ivf.train_kmeans(train_vecs, max_iterations, delta_threshold)
+	if err != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", kmeans_error(err))
+	}
+
+	// the lists of the sample are dropped, only the centroids are kept
+	centers := make([]mat.VecDense, len(clusters))
+	for i := range clusters {
+		centers[i] = *mat.VecDenseCopyOf(clusters[i].Center())
+	}
+
+	return ivf.set_centroids(centers)
+}
+
+// TrainCentroidsFromReader is TrainCentroids on a stream of vectors which may not fit in memory, eg. read from a
+// file. The centroids are learned by a mini-batch kmeans over random batches of batch_size vectors, see
+// kmeans.KMeans.TrainMiniBatch, r is read once, then up to the last vector of the batch at every iteration.
+// Readers which implement kmeans.VecSkipper skip the vectors in between instead of reading them.
+func (ivf *IndexIVFFlat) TrainCentroidsFromReader(r kmeans.VecReader, batch_size int, max_iterations int32, delta_threshold float64) error {
+	if ivf.nlist <= 0 || batch_size <= 0 {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", ErrInvalidParameter)
+	}
+	if ivf.clusters != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: already trained: %w", ErrInvalidParameter)
+	}
+	if err := ivf.check_quantizer(ivf.quantizer); err != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", err)
+	}
+
+	if ivf.metric_type == METRIC_COSINE {
+		r = &normalized_reader{r: r}
+	}
+	km := ivf.new_kmeans(max_iterations, delta_threshold)
+	centers, err := km.TrainMiniBatch(r, ivf.dim, batch_size)
+	if err != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", kmeans_error(err))
+	}
+
+	return ivf.set_centroids(centers)
+}
+
+// set_centroids keeps the trained centroids in the quantizer and empties the inverted lists
+func (ivf *IndexIVFFlat) set_centroids(centers []mat.VecDense) error {
+	ivf.clusters = make([]kmeans.Cluster, len(centers))
+	for i := range centers {
+		ivf.clusters[i] = kmeans.NewCluster(centers[i], nil)
+	}
+	if err := ivf.build_quantizer(ivf.quantizer); err != nil {
+		ivf.clusters = nil
+		return fmt.Errorf("IndexIVFFlat: Train: %w", err)
+	}
+
+	ivf.Remove()
+
+	return nil
+}
+
+// Train partitions the vectors of index_flat into nlist inverted lists with kmeans, the centroids are kept in an
+// IndexFlat. The metric is the metric of InitWithOptions, METRIC_L2 by default. A trained index should be
+// initialized again before training it again.
+func (ivf *IndexIVFFlat) Train(index_flat *IndexFlat, nlist int32, max_iterations int32, delta_threshold float64) error {
+	return ivf.TrainWithQuantizer(index_flat, nlist, max_iterations, delta_threshold, nil)
+}
+
+// TrainWithQuantizer is Train with the index keeping the centroids, quantizer should be empty and initialized with
+// the dimension of the vectors and the metric, eg. an IndexHNSW for a large nlist. nil selects an IndexFlat.
+// The index is not changed if it fails.
+func (ivf *IndexIVFFlat) TrainWithQuantizer(index_flat *IndexFlat, nlist int32, max_iterations int32, delta_threshold float64, quantizer Index) error {
+	if nlist <= 0 || nlist > index_flat.size {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", ErrInvalidParameter)
+	}
+	if ivf.clusters != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: already trained: %w", ErrInvalidParameter)
+	}
+	if err := ivf.check_quantizer(quantizer); err != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", err)
+	}
+
+	// the index is trained on a copy, which replaces it once the quantizer is built
+	trained := *ivf
+	trained.dim = index_flat.dim
+	trained.nlist = nlist
+	clusters, err := trained.train_kmeans(index_flat.vec_views(), max_iterations, delta_threshold)
+	if err != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", kmeans_error(err))
+	}
+
+	trained.size = index_flat.size
+	trained.cap = index_flat.size
+	trained.next_id = index_flat.size
+	trained.clusters = clusters
+
+	// copy the vectors into the lists, so RemoveIDs on index_flat or Add on the index does not change the other one
+	trained.invlists = make([][]int32, nlist)
+	trained.invlists_vecs = make([][]float64, nlist)
+	for i := range clusters {
+		ids := make([]int32, 0, clusters[i].Size())
+		for vec_idx, ok := range clusters[i].VecIdxs() {
+			if ok {
+				ids = append(ids, vec_idx)
+			}
+		}
+		sort.Slice(ids, func(a, b int) bool {
+			return ids[a] < ids[b]
+		})
+
+		data := make([]float64, 0, len(ids)*int(trained.dim))
+		for _, id := range ids {
+			data = append(data, index_flat.vector(id)...)
+		}
+		trained.invlists[i] = ids
+		trained.invlists_vecs[i] = data
+	}
 
-	km := kmeans.NewWithOptions(nlist, max_iterations, delta_threshold)
-	ivf.clusters = km.Train(ivf.vecs, ivf.dim)
+	// the quantizer is built once, so a query only searches it
+	if err := trained.build_quantizer(quantizer); err != nil {
+		return fmt.Errorf("IndexIVFFlat: Train: %w", err)
+	}
+
+	*ivf = trained
+
+	return nil
+}
+
+// Search searches the k nearest neighbors of x in the nprobe nearest inverted lists (see SetNprobe), metric_type
+// should be the metric of the index. The inverted lists are scanned in place so the idxs are the ids of the vectors,
+// with nprobe = nlist the result is the same as the result of IndexFlat.
+func (ivf *IndexIVFFlat) Search(x []float64, k int32, metric_type MetricType) (SearchResult, error) {
+	nprobe := max(ivf.nprobe, 1)
+	if err := ivf.check([][]float64{x}, k, nprobe); err != nil {
+		return SearchResult{}, fmt.Errorf("IndexIVFFlat: Search: %w", err)
+	}
+	if metric_type != ivf.metric_type {
+		return SearchResult{}, fmt.Errorf("IndexIVFFlat: Search: %w", ErrMetricMismatch)
+	}
+
+	// step 1. get top nprobe lists based on distance with centroids
+	list_nos, err := ivf.batch_assign([][]float64{x}, nprobe)
+	if err != nil {
+		return SearchResult{}, fmt.Errorf("IndexIVFFlat: Search: %w", err)
+	}
+
+	// step 2. search top k vectors in the selected lists
+	return ivf.search_preassigned(x, k, list_nos[0]), nil
+}
+
+// SetKMeansOptions sets the options of the kmeans training, eg. kmeans.WithSeed for reproducible trainings
+func (ivf *IndexIVFFlat) SetKMeansOptions(opts ...kmeans.Option) {
+	ivf.kmeans_opts = opts
+}
+
+// MetricType returns the metric of the index
+func (ivf *IndexIVFFlat) MetricType() MetricType {
+	return ivf.metric_type
+}
+
+// SetNprobe sets the number of inverted lists scanned by Search, BatchSearch and RangeSearch, 1 by default
+func (ivf *IndexIVFFlat) SetNprobe(nprobe int32) error {
+	if nprobe <= 0 {
+		return fmt.Errorf("IndexIVFFlat: SetNprobe: %w", ErrInvalidParameter)
+	}
+
+	ivf.nprobe = nprobe
+
+	return nil
+}
+
+// Add assigns x to the inverted list of the nearest centroid, the id of x is the number of vectors added before,
+// including the removed ones
+func (ivf *IndexIVFFlat) Add(x []float64) error {
+	return ivf.BatchAdd([][]float64{x})
+}
+
+// BatchAdd adds all vectors of x, or none of them if one of them is invalid
+func (ivf *IndexIVFFlat) BatchAdd(x [][]float64) error {
+	if ivf.clusters == nil {
+		return fmt.Errorf("IndexIVFFlat: BatchAdd: %w", ErrNotTrained)
+	}
+	if !check_dims(x, ivf.dim) {
+		return fmt.Errorf("IndexIVFFlat: BatchAdd: %w", ErrDimensionMismatch)
+	}
+
+	list_nos, err := ivf.batch_assign(x, 1)
+	if err != nil {
+		return fmt.Errorf("IndexIVFFlat: BatchAdd: %w", err)
+	}
+
+	// the ids are increasing, so appending keeps the lists sorted, the vectors are copied so the caller may reuse x
+	for i := range x {
+		list_no := list_nos[i][0]
+		ivf.invlists[list_no] = append(ivf.invlists[list_no], ivf.next_id)
+		ivf.invlists_vecs[list_no] = append(ivf.invlists_vecs[list_no], x[i]...)
+		ivf.next_id++
+	}
+	ivf.size += int32(len(x))
+	ivf.cap = max(ivf.cap, ivf.size)
+
+	return nil
+}
+
+// Size returns the number of vectors in the inverted lists
+func (ivf *IndexIVFFlat) Size() int32 {
+	return ivf.size
 }
 
-func (ivf *IndexIVFFlat) Search(x []float64, k int32, nprobe int32) ([]int32, [][]float64) {
+// Remove removes all vectors, the trained centroids are kept
+func (ivf *IndexIVFFlat) Remove() {
+	ivf.size = 0
+	ivf.next_id = 0
+	ivf.invlists = make([][]int32, ivf.nlist)
+	ivf.invlists_vecs = make([][]float64, ivf.nlist)
+}
+
+// RemoveIDs removes the vectors selected by sel from the inverted lists and returns the number of removed vectors.
+// Unlike IndexFlat, the ids of the remaining vectors are not changed. The lists are compacted in place, so the
+// vectors removed are not kept nor written by WriteIndex.
+func (ivf *IndexIVFFlat) RemoveIDs(sel IDSelector) int32 {
+	d := int(ivf.dim)
+	removed := int32(0)
+	for list_no := range ivf.invlists {
+		ids := ivf.invlists[list_no][:0]
+		data := ivf.invlists_vecs[list_no][:0]
+		for j, id := range ivf.invlists[list_no] {
+			if sel.IsMember(int64(id)) {
+				removed++
+			} else {
+				ids = append(ids, id)
+				data = append(data, ivf.invlists_vecs[list_no][j*d:(j+1)*d]...)
+			}
+		}
+		ivf.invlists[list_no] = ids
+		ivf.invlists_vecs[list_no] = data
+	}
+
+	ivf.size -= removed
+
+	return removed
+}
+
+// BatchSearch searches the k nearest neighbors of every row of the nq x d query matrix x in the nprobe nearest
+// inverted lists (see SetNprobe) with the metric of the index. The distances to the centroids are computed with one BLAS matrix
+// multiplication per block of queries, the inverted lists are scanned in place so the idxs are the ids of the
+// vectors in the trained dataset.
+func (ivf *IndexIVFFlat) BatchSearch(x [][]float64, k int32) ([]SearchResult, error) {
+	nprobe := max(ivf.nprobe, 1)
+	if err := ivf.check(x, k, nprobe); err != nil {
+		return nil, fmt.Errorf("IndexIVFFlat: BatchSearch: %w", err)
+	}
+
+	// get top nprobe lists of every query based on distance with centroids, then scan the selected lists
+	assign, err := ivf.batch_assign(x, nprobe)
+	if err != nil {
+		return nil, fmt.Errorf("IndexIVFFlat: BatchSearch: %w", err)
+	}
+
+	results := make([]SearchResult, len(x))
+	for i, list_nos := range assign {
+		results[i] = ivf.search_preassigned(x[i], k, list_nos)
+	}
+
+	return results, nil
+}
+
+// RangeSearch searches all the vectors within radius of every row of the nq x d query matrix x in the nprobe
+// nearest inverted lists (see SetNprobe), ie. with L2 distance < radius, or with IP / cosine similarity > radius.
+// The results of each query are ranked best-first.
+func (ivf *IndexIVFFlat) RangeSearch(x [][]float64, radius float64) (RangeSearchResult, error) {
+	nprobe := max(ivf.nprobe, 1)
+	if err := ivf.check(x, 1, nprobe); err != nil {
+		return RangeSearchResult{}, fmt.Errorf("IndexIVFFlat: RangeSearch: %w", err)
+	}
+
+	assign, err := ivf.batch_assign(x, nprobe)
+	if err != nil {
+		return RangeSearchResult{}, fmt.Errorf("IndexIVFFlat: RangeSearch: %w", err)
+	}
+
+	var result RangeSearchResult
+	result.Lims = make([]int, 1, len(x)+1)
+	for i, list_nos := range assign {
+		var idxs []int32
+		var distances []float64
+		for _, list_no := range list_nos {
+			for j, id := range ivf.invlists[list_no] {
+				distance := ivf.distance(ivf.list_vector(list_no, j), x[i])
+				if in_range(distance, radius, ivf.metric_type) {
+					idxs = append(idxs, id)
+					distances = append(distances, distance)
+				}
+			}
+		}
+
+		result.append(new_search_result(idxs, distances, ivf.metric_type))
+	}
+
+	return result, nil
+}
+
+// WriteIndex writes the trained index to w in the binary format of index_io.go, body:
+//
+//	dim       int32
+//	next_id   int32 number of vectors added, including the removed ones
+//	vecs      next_id * dim float64 by id, including the removed ones, before version 4 only
+//	nlist     int32
+//	metric    int32 MetricType, since version 2, METRIC_L2 before
+//	quantizer int32 type of the quantizer, since version 3, IndexFlat before: 0 IndexFlat, or 1 IndexHNSW
+//	          followed by its m, ef_construction, ef_search and metric int32, the graph is built again on read
+//	centroids nlist * dim float64
+//	invlists  nlist times: list size int32, then the ids int32 in ascending order, then since version 4
+//	          the list size * dim float64 vectors of the ids
+func (ivf *IndexIVFFlat) WriteIndex(w io.Writer) error {
+	if ivf.clusters == nil {
+		return fmt.Errorf("IndexIVFFlat: WriteIndex: %w", ErrNotTrained)
+	}
+
+	// only the quantizers which can be built again from the centroids are written
+	switch ivf.quantizer.(type) {
+	case *IndexFlat, *IndexHNSW:
+	default:
+		return fmt.Errorf("IndexIVFFlat: WriteIndex: quantizer %T: %w", ivf.quantizer, ErrNotSupported)
+	}
+
+	iw := new_index_writer(w, index_ivf_flat_fourcc)
+	iw.write(ivf.dim)
+	iw.write(ivf.next_id)
+
+	iw.write(ivf.nlist)
+	iw.write(int32(ivf.metric_type))
+	if hnsw, ok := ivf.quantizer.(*IndexHNSW); ok {
+		iw.write(ivf_quantizer_hnsw)
+		iw.write([]int32{hnsw.m, hnsw.ef_construction, hnsw.ef_search, int32(hnsw.metric_type)})
+	} else {
+		iw.write(ivf_quantizer_flat)
+	}
+	for i := range ivf.clusters {
+		iw.write(ivf.clusters[i].Center().RawVector().Data)
+	}
+	for i := range ivf.invlists {
+		iw.write(int32(len(ivf.invlists[i])))
+		iw.write(ivf.invlists[i])
+		iw.write(ivf.invlists_vecs[i])
+	}
+
+	if err := iw.close(); err != nil {
+		return fmt.Errorf("IndexIVFFlat: WriteIndex: %w", err)
+	}
+
+	return nil
+}
+
+// ReadIndex replaces the index with the index written by WriteIndex, the index is not changed if it fails.
+// The vectors are owned by the index instead of being shared with an IndexFlat, the nprobe and the kmeans options
+// of the index are kept.
+func (ivf *IndexIVFFlat) ReadIndex(r io.Reader) error {
+	ir, err := new_index_reader(r, index_ivf_flat_fourcc)
+	if err != nil {
+		return fmt.Errorf("IndexIVFFlat: ReadIndex: %w", err)
+	}
+
+	dim := ir.read_int32(1, math.MaxInt32)
+	next_id := ir.read_int32(0, math.MaxInt32)
+	var vecs []mat.VecDense // vectors by id before version 4
+	if ir.version < 4 {
+		vecs = ir.read_vecs(next_id, dim)
+	}
+
+	nlist := ir.read_int32(1, math.MaxInt32)
+	metric_type := METRIC_L2
+	if ir.version >= 2 {
+		metric_type = MetricType(ir.read_int32(int32(METRIC_L2), int32(METRIC_COSINE)))
+	}
+	var quantizer Index // nil selects an IndexFlat
+	if ir.version >= 3 && ir.read_int32(ivf_quantizer_flat, ivf_quantizer_hnsw) == ivf_quantizer_hnsw {
+		m := ir.read_int32(2, math.MaxInt32)
+		ef_construction := ir.read_int32(1, math.MaxInt32)
+		ef_search := ir.read_int32(1, math.MaxInt32)
+		hnsw_metric_type := MetricType(ir.read_int32(int32(METRIC_L2), int32(METRIC_COSINE)))
+
+		var hnsw IndexHNSW
+		if ir.err == nil && hnsw.InitWithOptions(nlist, dim, m, ef_construction, ef_search, hnsw_metric_type) != nil {
+			ir.err = fmt.Errorf("invalid HNSW quantizer: %w", ErrInvalidFormat)
+		}
+		quantizer = &hnsw
+	}
+	centroids := ir.read_vecs(nlist, dim)
+
+	size := int32(0)
+	invlists := make([][]int32, 0, min(int(nlist), index_io_read_chunk))
+	invlists_vecs := make([][]float64, 0, min(int(nlist), index_io_read_chunk))
+	for i := int32(0); i < nlist && ir.err == nil; i++ {
+		ids := ir.read_int32s(int(ir.read_int32(0, next_id)))
+		for j, id := range ids {
+			if id < 0 || id >= next_id || j > 0 && id <= ids[j-1] {
+				ir.err = fmt.Errorf("id %d out of range or not sorted: %w", id, ErrInvalidFormat)
+				break
+			}
+		}
+
+		var data []float64
+		if ir.version < 4 {
+			data = make([]float64, 0, len(ids)*int(dim))
+			for j := 0; j < len(ids) && ir.err == nil; j++ {
+				data = append(data, vecs[ids[j]].RawVector().Data...)
+			}
+		} else {
+			data = ir.read_float64s(len(ids) * int(dim))
+		}
+
+		invlists = append(invlists, ids)
+		invlists_vecs = append(invlists_vecs, data)
+		size += int32(len(ids))
+	}
+
+	if err := ir.close(); err != nil {
+		return fmt.Errorf("IndexIVFFlat: ReadIndex: %w", err)
+	}
+
+	clusters := make([]kmeans.Cluster, nlist)
+	for i := range clusters {
+		clusters[i] = kmeans.NewCluster(centroids[i], invlists[i])
+	}
+	restored := IndexIVFFlat{size: size, cap: size, dim: dim, next_id: next_id, metric_type: metric_type, nlist: nlist, nprobe: ivf.nprobe, clusters: clusters, invlists: invlists, invlists_vecs: invlists_vecs, kmeans_opts: ivf.kmeans_opts}
+	if err := restored.check_quantizer(quantizer); err != nil {
+		return fmt.Errorf("IndexIVFFlat: ReadIndex: %w", err)
+	}
+	if err := restored.build_quantizer(quantizer); err != nil {
+		return fmt.Errorf("IndexIVFFlat: ReadIndex: %w", err)
+	}
+
+	*ivf = restored
+
+	return nil
+}
+
+// check returns an error if the index is not trained, or if the queries x, k or nprobe are invalid
+func (ivf *IndexIVFFlat) check(x [][]float64, k int32, nprobe int32) error {
+	if ivf.clusters == nil {
+		return ErrNotTrained
+	}
+	if !check_dims(x, ivf.dim) {
+		return ErrDimensionMismatch
+	}
+	if k <= 0 || nprobe <= 0 {
+		return ErrInvalidParameter
+	}
+
+	return nil
+}
+
+// check_quantizer returns ErrMetricMismatch if quantizer searches with another metric than the index, the quantizers
+// without a metric, like IndexFlat, search with the metric of the index
+func (ivf *IndexIVFFlat) check_quantizer(quantizer Index) error {
+	if q, ok := quantizer.(interface{ MetricType() MetricType }); ok && q.MetricType() != ivf.metric_type {
+		return fmt.Errorf("quantizer metric %d is not %d: %w", q.MetricType(), ivf.metric_type, ErrMetricMismatch)
+	}
+
+	return nil
+}
+
+// build_quantizer adds the centroids to quantizer and keeps it as the coarse quantizer, nil selects an IndexFlat
+func (ivf *IndexIVFFlat) build_quantizer(quantizer Index) error {
+	if quantizer == nil {
+		var flat IndexFlat
+		flat.Init(ivf.nlist, ivf.dim)
+		quantizer = &flat
+	}
+
+	centroids := make([][]float64, len(ivf.clusters))
+	for i := range ivf.clusters {
+		centroids[i] = ivf.clusters[i].Center().RawVector().Data
+	}
+	if err := quantizer.BatchAdd(centroids); err != nil {
+		return err
+	}
+
+	ivf.quantizer = quantizer
+
+	return nil
+}
+
+// batch_assign returns the nprobe nearest inverted lists of every row of x by searching the quantizer,
+// the IndexFlat quantizer computes the distances with one BLAS matrix multiplication per block of queries
+func (ivf *IndexIVFFlat) batch_assign(x [][]float64, nprobe int32) ([][]int32, error) {
 	if nprobe >= ivf.nlist {
 		nprobe = ivf.nlist // nprobe should not be greater than nlist
 	}
 
-	// step 1. get top nprobe cluster based on distance with cluster center
-	var center_index IndexFlat
-	center_index.Init(ivf.nlist, ivf.dim)
+	list_nos := make([][]int32, len(x))
+	if flat, ok := ivf.quantizer.(*IndexFlat); ok {
+		results, err := flat.BatchSearch(x, nprobe, ivf.metric_type)
+		if err != nil {
+			return nil, err
+		}
+		for i := range results {
+			list_nos[i] = results[i].Idxs
+		}
+		return list_nos, nil
+	}
 
-	for _, c := range ivf.clusters {
-		center_index.Add(c.Center().RawVector().Data)
+	for i := range x {
+		result, err := ivf.quantizer.Search(x[i], nprobe, ivf.metric_type)
+		if err != nil {
+			return nil, err
+		}
+		list_nos[i] = result.Idxs
 	}
 
-	cluster_idxs, _ := center_index.Search(x, nprobe, METRIC_L2)  // only support L2 distance
+	return list_nos, nil
+}
+
+// search_preassigned scans the inverted lists list_nos in place for the k nearest neighbors of x
+func (ivf *IndexIVFFlat) search_preassigned(x []float64, k int32, list_nos []int32) SearchResult {
+	heap := new_heap(ivf.metric_type, k)
 
-	// step 2. search top k vectors from selected clusters in step 1
-	var candidate_index IndexFlat
-	candidate_size := int32(0)
-	for _, idx := range cluster_idxs {
-		cluster := ivf.clusters[idx]
-		candidate_size += cluster.Size()
+	for _, list_no := range list_nos {
+		for j, id := range ivf.invlists[list_no] {
+			heap.Push(ivf.distance(ivf.list_vector(list_no, j), x), id)
+		}
+	}
+
+	// select copies of the vectors by idxs, so the caller cannot change the index
+	result := new_search_result(heap.Idxs(), heap.Distance(), ivf.metric_type)
+	result.Vecs = make([][]float64, len(result.Idxs))
+	for i := range result.Idxs {
+		result.Vecs[i] = append([]float64(nil), ivf.find_vector(list_nos, result.Idxs[i])...)
 	}
 
-	candidate_index.Init(candidate_size, ivf.dim)
+	return result
+}
 
-	for _, ci := range cluster_idxs {
-		cluster := ivf.clusters[ci]
-		vec_idxs := cluster.VecIdxs()
+// list_vector returns a view of the vector at offset j of the inverted list list_no
+func (ivf *IndexIVFFlat) list_vector(list_no int32, j int) []float64 {
+	d := int(ivf.dim)
+	return ivf.invlists_vecs[list_no][j*d : (j+1)*d]
+}
 
-		for vi := range vec_idxs {
-			candidate_index.Add(ivf.vecs[vi].RawVector().Data)
+// find_vector returns a view of the vector id in the inverted lists list_nos, the ids of a list are sorted so it
+// is searched by bisection
+func (ivf *IndexIVFFlat) find_vector(list_nos []int32, id int32) []float64 {
+	for _, list_no := range list_nos {
+		ids := ivf.invlists[list_no]
+		if j := sort.Search(len(ids), func(j int) bool { return ids[j] >= id }); j < len(ids) && ids[j] == id {
+			return ivf.list_vector(list_no, j)
 		}
 	}
 
-	return candidate_index.Search(x, k, METRIC_L2)
+	return nil
+}
+
+// distance returns the distance (L2) or similarity (IP, cosine) between the vectors y and x
+func (ivf *IndexIVFFlat) distance(y []float64, x []float64) float64 {
+	switch ivf.metric_type {
+	case METRIC_IP:
+		return utils.InnerProductT(y, x)
+	case METRIC_COSINE:
+		return utils.CosineDistanceT(y, x)
+	}
+
+	return utils.L2DistanceT(y, x)
+}
+
+// train_kmeans clusters vecs into nlist clusters with the kmeans of the metric, see new_kmeans
+func (ivf *IndexIVFFlat) train_kmeans(vecs []mat.VecDense, max_iterations int32, delta_threshold float64) ([]kmeans.Cluster, error) {
+	if ivf.metric_type == METRIC_COSINE {
+		vecs = normalize_vecs(vecs)
+	}
+
+	km := ivf.new_kmeans(max_iterations, delta_threshold)
+	return km.Train(vecs, ivf.dim)
+}
+
+// new_kmeans returns the kmeans of the metric: the vectors are assigned by L2 distance or by inner product,
+// and for cosine a spherical kmeans clusters normalized copies of the vectors
+func (ivf *IndexIVFFlat) new_kmeans(max_iterations int32, delta_threshold float64) kmeans.KMeans {
+	opts := append([]kmeans.Option{}, ivf.kmeans_opts...)
+	switch ivf.metric_type {
+	case METRIC_IP:
+		opts = append(opts, kmeans.WithInnerProduct())
+	case METRIC_COSINE:
+		opts = append(opts, kmeans.WithSpherical())
+	}
+
+	return kmeans.NewWithOptions(ivf.nlist, max_iterations, delta_threshold, opts...)
+}
+
+// normalize_vecs returns copies of vecs scaled to unit length
+func normalize_vecs(vecs []mat.VecDense) []mat.VecDense {
+	normalized := make([]mat.VecDense, len(vecs))
+	for i := range vecs {
+		normalized[i] = *mat.VecDenseCopyOf(&vecs[i])
+		if norm := mat.Norm(&normalized[i], 2); norm > 0 {
+			normalized[i].ScaleVec(1/norm, &normalized[i])
+		}
+	}
+
+	return normalized
+}
+
+// normalized_reader reads normalized copies of the vectors of r, for the spherical kmeans of METRIC_COSINE
+type normalized_reader struct {
+	r kmeans.VecReader
+}
+
+func (nr *normalized_reader) Read(n int) ([]mat.VecDense, error) {
+	vecs, err := nr.r.Read(n)
+	return normalize_vecs(vecs), err
+}
+
+func (nr *normalized_reader) Reset() error {
+	return nr.r.Reset()
+}
+
+func (nr *normalized_reader) Skip(n int) error {
+	return kmeans.Skip(nr.r, n)
 }
@@ -0,0 +1,635 @@
+package nanofaiss
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/crowaixyz/nanofaiss/pkg/kmeans"
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+func TestIndexIVFFlat_Search(t *testing.T) {
+	// training is done once, goconvey runs the top-level func for every leaf Convey
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	var ivf IndexIVFFlat
+	ivf.Train(&flat, 8, 10, 0.001)
+
+	Convey("IndexIVFFlat_Search", t, func() {
+		Convey("test case 1: nprobe = nlist is the same as IndexFlat", func() {
+			So(ivf.SetNprobe(8), ShouldBeNil)
+			for _, q := range xq {
+				want, err := flat.Search(q, k, METRIC_L2)
+				So(err, ShouldBeNil)
+				got, err := ivf.Search(q, k, METRIC_L2)
+				So(err, ShouldBeNil)
+
+				So(got.Idxs, ShouldResemble, want.Idxs)
+				So(got.Distances, ShouldResemble, want.Distances)
+				So(got.Vecs, ShouldResemble, want.Vecs)
+			}
+		})
+
+		Convey("test case 2: the idxs are the ids of the dataset", func() {
+			for _, nprobe := range []int32{1, 3} {
+				So(ivf.SetNprobe(nprobe), ShouldBeNil)
+				want, err := ivf.BatchSearch(xq, k)
+				So(err, ShouldBeNil)
+
+				for i, q := range xq {
+					got, err := ivf.Search(q, k, METRIC_L2)
+					So(err, ShouldBeNil)
+					So(got, ShouldResemble, want[i])
+					for j, idx := range got.Idxs {
+						So(got.Vecs[j], ShouldResemble, xb[idx])
+					}
+				}
+			}
+		})
+	})
+}
+
+func TestIndexIVFFlat_TrainWithQuantizer(t *testing.T) {
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	var ivf IndexIVFFlat
+	ivf.Train(&flat, 8, 10, 0.001)
+
+	// the centroids kept in an HNSW graph, which is exact for so few centroids
+	var quantizer IndexHNSW
+	quantizer.InitWithOptions(8, int32(d), 4, 40, 16, METRIC_L2)
+	var ivf_hnsw IndexIVFFlat
+	ivf_hnsw.TrainWithQuantizer(&flat, 8, 10, 0.001, &quantizer)
+
+	Convey("IndexIVFFlat_TrainWithQuantizer", t, func() {
+		Convey("test case 1: the quantizer is built at train time", func() {
+			So(ivf.quantizer, ShouldHaveSameTypeAs, &IndexFlat{})
+			So(ivf.quantizer.(*IndexFlat).Size(), ShouldEqual, 8)
+			So(ivf_hnsw.quantizer, ShouldEqual, &quantizer)
+			So(quantizer.size, ShouldEqual, 8)
+		})
+
+		Convey("test case 2: HNSW quantizer", func() {
+			// kmeans is not seeded, so ivf_hnsw is compared with its own centroids
+			So(ivf_hnsw.SetNprobe(8), ShouldBeNil)
+			got, err := ivf_hnsw.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			for i := range xq {
+				want, err := flat.Search(xq[i], k, METRIC_L2)
+				So(err, ShouldBeNil)
+				So(got[i], ShouldResemble, want)
+			}
+
+			So(ivf_hnsw.SetNprobe(1), ShouldBeNil)
+			got, err = ivf_hnsw.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			for i := range xq {
+				nearest := int32(0)
+				for c := range ivf_hnsw.clusters {
+					if utils.L2DistanceSqrT(xq[i], ivf_hnsw.clusters[c].Center().RawVector().Data) < utils.L2DistanceSqrT(xq[i], ivf_hnsw.clusters[nearest].Center().RawVector().Data) {
+						nearest = int32(c)
+					}
+				}
+				So(got[i], ShouldResemble, ivf_hnsw.search_preassigned(xq[i], k, []int32{nearest}))
+			}
+		})
+
+		Convey("test case 3: errors", func() {
+			// a failed training does not change the index
+			var ip_quantizer IndexHNSW
+			ip_quantizer.InitWithOptions(8, int32(d), 4, 40, 16, METRIC_IP)
+			var ivf_ip IndexIVFFlat
+			ivf_ip.Init(0, int32(d)+1)
+			want := ivf_ip
+			err := ivf_ip.TrainWithQuantizer(&flat, 8, 10, 0.001, &ip_quantizer)
+			So(errors.Is(err, ErrMetricMismatch), ShouldBeTrue)
+			So(ivf_ip, ShouldResemble, want)
+			So(ip_quantizer.size, ShouldEqual, 0)
+
+			var centroids_ip IndexIVFFlat
+			centroids_ip.InitWithOptions(0, int32(d), 8, METRIC_L2, &ip_quantizer)
+			err = centroids_ip.TrainCentroids(xb, 10, 0.001)
+			So(errors.Is(err, ErrMetricMismatch), ShouldBeTrue)
+			_, err = centroids_ip.Search(xq[0], k, METRIC_L2)
+			So(errors.Is(err, ErrNotTrained), ShouldBeTrue)
+
+			var small_quantizer IndexFlat
+			small_quantizer.Init(8, int32(d)-1)
+			var ivf_small IndexIVFFlat
+			ivf_small.Init(0, int32(d)+1)
+			want = ivf_small
+			err = ivf_small.TrainWithQuantizer(&flat, 8, 10, 0.001, &small_quantizer)
+			So(errors.Is(err, ErrDimensionMismatch), ShouldBeTrue)
+			So(ivf_small, ShouldResemble, want)
+			_, err = ivf_small.Search(xq[0], k, METRIC_L2)
+			So(errors.Is(err, ErrNotTrained), ShouldBeTrue)
+
+			// the quantizer keeps the centroids, a trained index is not trained again
+			err = ivf_hnsw.TrainWithQuantizer(&flat, 8, 10, 0.001, nil)
+			So(errors.Is(err, ErrInvalidParameter), ShouldBeTrue)
+			So(ivf_hnsw.quantizer, ShouldEqual, &quantizer)
+		})
+	})
+}
+
+func TestIndexIVFFlat_BatchSearch(t *testing.T) {
+	// training is done once, goconvey runs the top-level func for every leaf Convey
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	var ivf IndexIVFFlat
+	ivf.Train(&flat, 8, 10, 0.001)
+
+	Convey("IndexIVFFlat_BatchSearch", t, func() {
+		Convey("test case 1: nprobe = nlist is exact", func() {
+			So(ivf.SetNprobe(8), ShouldBeNil)
+			got, err := ivf.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			So(len(got), ShouldEqual, len(xq))
+
+			for i := range xq {
+				want, err := flat.Search(xq[i], k, METRIC_L2)
+				So(err, ShouldBeNil)
+				So(got[i].Idxs, ShouldResemble, want.Idxs)
+				So(got[i].Distances, ShouldResemble, want.Distances)
+				So(got[i].Vecs, ShouldResemble, want.Vecs)
+			}
+		})
+
+		Convey("test case 2: nprobe = 1 only scans the nearest list", func() {
+			So(ivf.SetNprobe(1), ShouldBeNil)
+			got, err := ivf.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+
+			for i := range xq {
+				nearest := int32(0)
+				for c := range ivf.clusters {
+					if utils.L2DistanceSqrT(xq[i], ivf.clusters[c].Center().RawVector().Data) < utils.L2DistanceSqrT(xq[i], ivf.clusters[nearest].Center().RawVector().Data) {
+						nearest = int32(c)
+					}
+				}
+
+				for _, idx := range got[i].Idxs {
+					So(ivf.clusters[nearest].VecIdxs()[idx], ShouldBeTrue)
+				}
+			}
+		})
+	})
+}
+
+func TestIndexIVFFlat_RangeSearch(t *testing.T) {
+	n, d := 1000, 16
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	var ivf IndexIVFFlat
+	ivf.Train(&flat, 8, 10, 0.001)
+
+	Convey("IndexIVFFlat_RangeSearch", t, func() {
+		Convey("test case 1: nprobe = nlist is exact", func() {
+			So(ivf.SetNprobe(8), ShouldBeNil)
+			got, err := ivf.RangeSearch(xq, 35)
+			So(err, ShouldBeNil)
+			want, err := flat.RangeSearch(xq, 35, METRIC_L2)
+			So(err, ShouldBeNil)
+
+			So(got.Lims, ShouldResemble, want.Lims)
+			So(got.Idxs, ShouldResemble, want.Idxs)
+			for i := range want.Distances {
+				So(got.Distances[i], ShouldAlmostEqual, want.Distances[i], 1e-6)
+			}
+		})
+
+		Convey("test case 2: nprobe = 1 returns a subset", func() {
+			So(ivf.SetNprobe(1), ShouldBeNil)
+			got, err := ivf.RangeSearch(xq, 35)
+			So(err, ShouldBeNil)
+			want, err := flat.RangeSearch(xq, 35, METRIC_L2)
+			So(err, ShouldBeNil)
+
+			So(len(got.Lims), ShouldEqual, len(xq)+1)
+			So(len(got.Idxs), ShouldBeLessThanOrEqualTo, len(want.Idxs))
+		})
+	})
+}
+
+func TestIndexIVFFlat_RemoveIDs(t *testing.T) {
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	Convey("IndexIVFFlat_RemoveIDs", t, func() {
+		var ivf IndexIVFFlat
+		ivf.Train(&flat, 8, 10, 0.001)
+
+		// remove the even ids
+		even := make([]int64, 0, n/2)
+		for i := 0; i < n; i += 2 {
+			even = append(even, int64(i))
+		}
+		So(ivf.RemoveIDs(NewIDSelectorBatch(even)), ShouldEqual, n/2)
+		So(ivf.size, ShouldEqual, n/2)
+		So(ivf.RemoveIDs(NewIDSelectorBatch(even)), ShouldEqual, 0)
+
+		// the ids of the remaining vectors are not changed
+		So(ivf.SetNprobe(8), ShouldBeNil)
+		results, err := ivf.BatchSearch(xq, k)
+		So(err, ShouldBeNil)
+		for i, result := range results {
+			So(len(result.Idxs), ShouldEqual, k)
+			for j, idx := range result.Idxs {
+				So(idx%2, ShouldEqual, 1)
+				So(result.Vecs[j], ShouldResemble, xb[idx])
+			}
+
+			all, err := flat.Search(xq[i], int32(n), METRIC_L2)
+			So(err, ShouldBeNil)
+			odd := make([]int32, 0, k)
+			for _, idx := range all.Idxs {
+				if idx%2 == 1 && int32(len(odd)) < k {
+					odd = append(odd, idx)
+				}
+			}
+			So(result.Idxs, ShouldResemble, odd)
+		}
+	})
+
+	Convey("IndexIVFFlat_RemoveIDs from the trained IndexFlat", t, func() {
+		var source IndexFlat
+		source.Init(int32(n), int32(d))
+		source.BatchAdd(xb)
+
+		var ivf IndexIVFFlat
+		So(ivf.Train(&source, 8, 10, 0.001), ShouldBeNil)
+		So(ivf.SetNprobe(8), ShouldBeNil)
+
+		// removing vectors from the IndexFlat does not change the index trained from it
+		So(source.RemoveIDs(NewIDSelectorRange(0, int64(n/2))), ShouldEqual, n/2)
+		for _, q := range xq {
+			want, err := flat.Search(q, k, METRIC_L2)
+			So(err, ShouldBeNil)
+			got, err := ivf.Search(q, k, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, want)
+		}
+	})
+
+	Convey("IndexIVFFlat_RemoveIDs frees the removed vectors", t, func() {
+		var ivf IndexIVFFlat
+		So(ivf.Train(&flat, 8, 10, 0.001), ShouldBeNil)
+
+		// header, dim, next_id, nlist, metric and quantizer type, centroids, list sizes, ids and vectors, checksum
+		serialized_len := func() int {
+			var buf bytes.Buffer
+			So(ivf.WriteIndex(&buf), ShouldBeNil)
+			return buf.Len()
+		}
+		stored := func() int {
+			total := 0
+			for i := range ivf.invlists {
+				So(len(ivf.invlists_vecs[i]), ShouldEqual, len(ivf.invlists[i])*d)
+				total += len(ivf.invlists[i])
+			}
+			return total
+		}
+
+		So(ivf.RemoveIDs(NewIDSelectorRange(0, int64(n/2))), ShouldEqual, n/2)
+		So(stored(), ShouldEqual, n/2)
+		want := 12 + 5*4 + 8*d*8 + 8*4 + n/2*(4+d*8) + 4
+		So(serialized_len(), ShouldEqual, want)
+
+		// adding and removing vectors again does not grow the index
+		for round := 0; round < 3; round++ {
+			So(ivf.BatchAdd(xq), ShouldBeNil)
+			So(ivf.RemoveIDs(NewIDSelectorRange(int64(ivf.next_id)-int64(len(xq)), int64(ivf.next_id))), ShouldEqual, len(xq))
+			So(ivf.size, ShouldEqual, n/2)
+			So(stored(), ShouldEqual, n/2)
+			So(serialized_len(), ShouldEqual, want)
+		}
+		So(ivf.next_id, ShouldEqual, n+3*len(xq))
+	})
+}
+
+func TestIndexIVFFlat_Add(t *testing.T) {
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	// train on a sample, then add the vectors in batches and one by one
+	var ivf IndexIVFFlat
+	var index Index = &ivf
+	ivf.InitWithOptions(0, int32(d), 8, METRIC_L2, nil)
+	ivf.TrainCentroids(xb[:300], 10, 0.001)
+	index.BatchAdd(xb[:600])
+	for _, x := range xb[600:] {
+		index.Add(x)
+	}
+
+	Convey("IndexIVFFlat_Add", t, func() {
+		Convey("test case 1: the vectors are in the list of the nearest centroid", func() {
+			So(ivf.size, ShouldEqual, n)
+			So(ivf.next_id, ShouldEqual, n)
+
+			list_nos, err := ivf.batch_assign(xb, 1)
+			So(err, ShouldBeNil)
+			for id := range xb {
+				So(ivf.invlists[list_nos[id][0]], ShouldContain, int32(id))
+			}
+			for _, ids := range ivf.invlists {
+				So(sort.SliceIsSorted(ids, func(a, b int) bool { return ids[a] < ids[b] }), ShouldBeTrue)
+			}
+		})
+
+		Convey("test case 2: nprobe = nlist is the same as IndexFlat", func() {
+			So(ivf.SetNprobe(8), ShouldBeNil)
+			for _, q := range xq {
+				want, err := flat.Search(q, k, METRIC_L2)
+				So(err, ShouldBeNil)
+				got, err := index.Search(q, k, METRIC_L2)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, want)
+			}
+		})
+
+		Convey("test case 3: Add after Train does not change the IndexFlat", func() {
+			var trained IndexIVFFlat
+			trained.Train(&flat, 8, 10, 0.001)
+			x := append([]float64(nil), xq[0]...)
+			So(trained.Add(x), ShouldBeNil)
+			So(trained.size, ShouldEqual, n+1)
+			So(flat.Size(), ShouldEqual, n)
+
+			// the index keeps copies of the added vectors and returns copies of its vectors
+			x[0] += 100
+			trained.SetNprobe(8)
+			got, err := trained.Search(xq[0], 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got.Idxs, ShouldResemble, []int32{int32(n)})
+			So(got.Vecs, ShouldResemble, [][]float64{xq[0]})
+
+			got.Vecs[0][0] += 100
+			got, err = trained.Search(xq[0], 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got.Vecs, ShouldResemble, [][]float64{xq[0]})
+		})
+
+		Convey("test case 4: Remove keeps the centroids", func() {
+			var removed IndexIVFFlat
+			removed.InitWithOptions(0, int32(d), 8, METRIC_L2, nil)
+			removed.TrainCentroids(xb, 10, 0.001)
+			removed.BatchAdd(xb)
+			removed.Remove()
+			So(removed.size, ShouldEqual, 0)
+
+			So(removed.Add(xq[0]), ShouldBeNil)
+			got, err := removed.Search(xq[0], 1, METRIC_L2)
+			So(err, ShouldBeNil)
+			So(got.Idxs, ShouldResemble, []int32{0})
+		})
+
+		Convey("test case 5: errors", func() {
+			var untrained IndexIVFFlat
+			untrained.InitWithOptions(0, int32(d), 8, METRIC_L2, nil)
+			So(errors.Is(untrained.Add(xb[0]), ErrNotTrained), ShouldBeTrue)
+			So(errors.Is(untrained.TrainCentroids(xb[:7], 10, 0.001), ErrInvalidParameter), ShouldBeTrue)
+			So(errors.Is(untrained.TrainCentroids([][]float64{{1}}, 10, 0.001), ErrInvalidParameter), ShouldBeTrue)
+			So(errors.Is(untrained.InitWithOptions(0, int32(d), 0, METRIC_L2, nil), ErrInvalidParameter), ShouldBeTrue)
+
+			So(errors.Is(ivf.TrainCentroids(xb, 10, 0.001), ErrInvalidParameter), ShouldBeTrue)
+			So(errors.Is(ivf.BatchAdd([][]float64{xq[0], {1}}), ErrDimensionMismatch), ShouldBeTrue)
+			So(ivf.size, ShouldEqual, n)
+			So(errors.Is(ivf.SetNprobe(0), ErrInvalidParameter), ShouldBeTrue)
+
+			_, err := ivf.Search(xq[0], k, METRIC_IP)
+			So(errors.Is(err, ErrMetricMismatch), ShouldBeTrue)
+		})
+	})
+}
+
+func TestIndexIVFFlat_Metric(t *testing.T) {
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	indexes := make(map[MetricType]*IndexIVFFlat)
+	for _, metric_type := range []MetricType{METRIC_IP, METRIC_COSINE} {
+		var ivf IndexIVFFlat
+		ivf.InitWithOptions(0, int32(d), 8, metric_type, nil)
+		ivf.TrainCentroids(xb, 10, 0.001)
+		ivf.BatchAdd(xb)
+		indexes[metric_type] = &ivf
+	}
+
+	Convey("IndexIVFFlat_Metric", t, func() {
+		// define test cases
+		tests := []struct {
+			name        string
+			metric_type MetricType
+			radius      float64
+		}{
+			{name: "test case 1: IP", metric_type: METRIC_IP, radius: 150},
+			{name: "test case 2: cosine", metric_type: METRIC_COSINE, radius: 0.6},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			ivf := indexes[tt.metric_type]
+
+			Convey(tt.name, func() {
+				So(ivf.MetricType(), ShouldEqual, tt.metric_type)
+
+				// nprobe = nlist is the same as IndexFlat
+				So(ivf.SetNprobe(8), ShouldBeNil)
+				for _, q := range xq {
+					want, err := flat.Search(q, k, tt.metric_type)
+					So(err, ShouldBeNil)
+					got, err := ivf.Search(q, k, tt.metric_type)
+					So(err, ShouldBeNil)
+					So(got, ShouldResemble, want)
+				}
+
+				So(ivf.SetNprobe(8), ShouldBeNil)
+				got, err := ivf.RangeSearch(xq, tt.radius)
+				So(err, ShouldBeNil)
+				want, err := flat.RangeSearch(xq, tt.radius, tt.metric_type)
+				So(err, ShouldBeNil)
+				So(got.Lims, ShouldResemble, want.Lims)
+				So(got.Idxs, ShouldResemble, want.Idxs)
+				So(len(want.Idxs), ShouldBeGreaterThan, 0)
+
+				// nprobe = 1 scans the list of the centroid of maximum similarity
+				So(ivf.SetNprobe(1), ShouldBeNil)
+				results, err := ivf.BatchSearch(xq, k)
+				So(err, ShouldBeNil)
+				for i, q := range xq {
+					best, err := ivf.quantizer.Search(q, 1, METRIC_IP)
+					So(err, ShouldBeNil)
+					So(results[i], ShouldResemble, ivf.search_preassigned(q, k, best.Idxs))
+				}
+
+				_, err = ivf.Search(xq[0], k, METRIC_L2)
+				So(errors.Is(err, ErrMetricMismatch), ShouldBeTrue)
+			})
+		}
+
+		Convey("test case 3: spherical kmeans centroids are normalized", func() {
+			for _, c := range indexes[METRIC_COSINE].clusters {
+				So(mat.Norm(c.Center(), 2), ShouldAlmostEqual, 1, 1e-9)
+			}
+		})
+
+		Convey("test case 4: the metric is written", func() {
+			ivf := indexes[METRIC_COSINE]
+
+			var buf bytes.Buffer
+			So(ivf.WriteIndex(&buf), ShouldBeNil)
+			var got IndexIVFFlat
+			So(got.ReadIndex(&buf), ShouldBeNil)
+			So(got.MetricType(), ShouldEqual, METRIC_COSINE)
+
+			So(ivf.SetNprobe(2), ShouldBeNil)
+			want, err := ivf.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			So(got.SetNprobe(2), ShouldBeNil)
+			results, err := got.BatchSearch(xq, k)
+			So(err, ShouldBeNil)
+			So(results, ShouldResemble, want)
+
+			// Faiss has no cosine metric, IP is stored in the Faiss index
+			So(errors.Is(WriteFaissIndex(&buf, ivf, METRIC_IP), ErrMetricMismatch), ShouldBeTrue)
+			buf.Reset()
+			So(WriteFaissIndex(&buf, indexes[METRIC_IP], METRIC_IP), ShouldBeNil)
+			index, metric_type, err := ReadFaissIndex(&buf)
+			So(err, ShouldBeNil)
+			So(metric_type, ShouldEqual, METRIC_IP)
+			So(index.(*IndexIVFFlat).MetricType(), ShouldEqual, METRIC_IP)
+			So(index.(*IndexIVFFlat).invlists, ShouldResemble, indexes[METRIC_IP].invlists)
+		})
+	})
+}
+
+func TestIndexIVFFlat_SetKMeansOptions(t *testing.T) {
+	n, d := 1000, 16
+	xb := random_vecs(n, d, 9)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	Convey("IndexIVFFlat_SetKMeansOptions", t, func() {
+		// two trainings with the same seed build the same index
+		var indexes [2]IndexIVFFlat
+		for i := range indexes {
+			indexes[i].SetKMeansOptions(kmeans.WithSeed(5), kmeans.WithInit(kmeans.INIT_KMEANS_PLUS_PLUS))
+			So(indexes[i].Train(&flat, 8, 10, 0.001), ShouldBeNil)
+		}
+		So(indexes[1].invlists, ShouldResemble, indexes[0].invlists)
+		So(indexes[1].clusters, ShouldResemble, indexes[0].clusters)
+	})
+}
+
+func TestIndexIVFFlat_TrainCentroidsFromReader(t *testing.T) {
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 9)
+	xq := random_vecs(50, d, 10)
+	stream := make([]mat.VecDense, n)
+	for i := range xb {
+		stream[i] = *mat.NewVecDense(d, xb[i])
+	}
+
+	Convey("IndexIVFFlat_TrainCentroidsFromReader", t, func() {
+		// define test cases
+		tests := []struct {
+			name        string
+			metric_type MetricType
+		}{
+			{name: "test case 1: METRIC_L2", metric_type: METRIC_L2},
+			{name: "test case 2: METRIC_IP", metric_type: METRIC_IP},
+			{name: "test case 3: METRIC_COSINE", metric_type: METRIC_COSINE},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				var flat IndexFlat
+				flat.Init(int32(n), int32(d))
+				flat.BatchAdd(xb)
+
+				var ivf IndexIVFFlat
+				ivf.InitWithOptions(0, int32(d), 8, tt.metric_type, nil)
+				ivf.SetKMeansOptions(kmeans.WithSeed(3))
+				So(ivf.TrainCentroidsFromReader(kmeans.NewSliceReader(stream), 64, 5, 0.001), ShouldBeNil)
+				So(len(ivf.clusters), ShouldEqual, 8)
+				So(ivf.size, ShouldEqual, 0)
+				if tt.metric_type == METRIC_COSINE {
+					for i := range ivf.clusters {
+						So(mat.Norm(ivf.clusters[i].Center(), 2), ShouldAlmostEqual, 1, 1e-9)
+					}
+				}
+
+				// nprobe = nlist is the same as IndexFlat
+				So(ivf.BatchAdd(xb), ShouldBeNil)
+				So(ivf.SetNprobe(8), ShouldBeNil)
+				for _, q := range xq {
+					want, err := flat.Search(q, k, tt.metric_type)
+					So(err, ShouldBeNil)
+					got, err := ivf.Search(q, k, tt.metric_type)
+					So(err, ShouldBeNil)
+					So(got.Idxs, ShouldResemble, want.Idxs)
+				}
+			})
+		}
+
+		Convey("test case 4: errors", func() {
+			var ivf IndexIVFFlat
+			ivf.InitWithOptions(0, int32(d), 8, METRIC_L2, nil)
+			So(errors.Is(ivf.TrainCentroidsFromReader(kmeans.NewSliceReader(stream), 0, 5, 0.001), ErrInvalidParameter), ShouldBeTrue)
+			So(errors.Is(ivf.TrainCentroidsFromReader(kmeans.NewSliceReader(stream[:7]), 64, 5, 0.001), ErrInvalidParameter), ShouldBeTrue)
+
+			short := []mat.VecDense{*mat.NewVecDense(2, nil)}
+			So(errors.Is(ivf.TrainCentroidsFromReader(kmeans.NewSliceReader(short), 64, 5, 0.001), ErrDimensionMismatch), ShouldBeTrue)
+			So(ivf.clusters, ShouldBeNil)
+
+			So(ivf.TrainCentroidsFromReader(kmeans.NewSliceReader(stream), 64, 5, 0.001), ShouldBeNil)
+			So(errors.Is(ivf.TrainCentroidsFromReader(kmeans.NewSliceReader(stream), 64, 5, 0.001), ErrInvalidParameter), ShouldBeTrue)
+		})
+	})
+}
@@ -1 +1,291 @@
 package nanofaiss
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/crowaixyz/nanofaiss/pkg/kmeans"
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+// IndexIVFPQ is an inverted file index whose inverted lists store PQ codes.
+// A coarse kmeans quantizer of nlist centroids partitions the vectors like IndexIVFFlat, and the residual
+// of every vector (vector minus its centroid) is encoded by a product quantizer, so a vector costs only
+// pq.code_size bytes. At search time the nprobe nearest lists are scanned, with a distance table
+// computed for the query residual of each probed list.
+type IndexIVFPQ struct {
+	size int32
+	cap  int32
+	dim  int32
+
+	nlist     int32
+	nprobe    int32          // number of inverted lists scanned by Search, 0 means 1
+	centroids []mat.VecDense // centroids of the coarse quantizer
+
+	pq             product_quantizer
+	invlists_ids   [][]int32 // ids of the vectors in every inverted list
+	invlists_codes [][]uint8 // codes of the vectors in every inverted list, pq.code_size bytes per vector
+	is_trained     bool
+	kmeans_opts    []kmeans.Option
+}
+
+// ivfpq_candidate is a vector pushed to the heap of a search and the position of its code
+type ivfpq_candidate struct {
+	id      int32
+	list_no int32
+	offset  int32 // offset of the vector in the inverted list
+}
+
+// Init initializes the index with nlist = 1, m = d/2 sub-quantizers (m = d if d is odd) and PQ_DEFAULT_NBITS bits per code
+func (ivfpq *IndexIVFPQ) Init(n int32, d int32) error {
+	m := d
+	if d%2 == 0 {
+		m = d / 2
+	}
+	return ivfpq.InitWithOptions(n, d, 1, m, PQ_DEFAULT_NBITS)
+}
+
+// InitWithOptions initializes the index with nlist inverted lists and m sub-quantizers of nbits bits
+func (ivfpq *IndexIVFPQ) InitWithOptions(n int32, d int32, nlist int32, m int32, nbits int32) error {
+	if n < 0 || nlist <= 0 {
+		return fmt.Errorf("IndexIVFPQ: Init: %w", ErrInvalidParameter)
+	}
+	if err := ivfpq.pq.init(d, m, nbits); err != nil {
+		return fmt.Errorf("IndexIVFPQ: Init: %w", err)
+	}
+
+	ivfpq.size = 0
+	ivfpq.cap = n
+	ivfpq.dim = d
+
+	ivfpq.nlist = nlist
+	ivfpq.nprobe = 1
+	ivfpq.centroids = nil
+
+	ivfpq.invlists_ids = make([][]int32, nlist)
+	ivfpq.invlists_codes = make([][]uint8, nlist)
+	ivfpq.is_trained = false
+
+	return nil
+}
+
+// Train learns the coarse centroids with kmeans on x, then trains the product quantizer on the residuals
+func (ivfpq *IndexIVFPQ) Train(x [][]float64, max_iterations int32, delta_threshold float64) error {
+	if !check_dims(x, ivfpq.dim) {
+		return fmt.Errorf("IndexIVFPQ: Train: %w", ErrDimensionMismatch)
+	}
+	if int32(len(x)) < ivfpq.nlist {
+		return fmt.Errorf("IndexIVFPQ: Train: %w", ErrInvalidParameter)
+	}
+
+	train_vecs := make([]mat.VecDense, len(x))
+	for i := range x {
+		train_vecs[i] = *mat.NewVecDense(int(ivfpq.dim), x[i])
+	}
+
+	// step 1. train the coarse quantizer
+	km := kmeans.NewWithOptions(ivfpq.nlist, max_iterations, delta_threshold, ivfpq.kmeans_opts...)
+	clusters, err := km.Train(train_vecs, ivfpq.dim)
+	if err != nil {
+		return fmt.Errorf("IndexIVFPQ: Train: %w", kmeans_error(err))
+	}
+
+	ivfpq.centroids = make([]mat.VecDense, ivfpq.nlist)
+	for i := range clusters {
+		ivfpq.centroids[i] = *mat.VecDenseCopyOf(clusters[i].Center())
+	}
+
+	// step 2. train the product quantizer on the residuals
+	residuals := make([][]float64, len(x))
+	for i := range x {
+		residuals[i] = ivfpq.residual(x[i], ivfpq.assign(x[i]))
+	}
+	if err := ivfpq.pq.train(residuals, max_iterations, delta_threshold, ivfpq.kmeans_opts...); err != nil {
+		return fmt.Errorf("IndexIVFPQ: Train: %w", err)
+	}
+
+	ivfpq.is_trained = true
+
+	return nil
+}
+
+// SetKMeansOptions sets the options of the kmeans trainings of the coarse quantizer and of the product quantizer,
+// eg. kmeans.WithSeed for reproducible trainings
+func (ivfpq *IndexIVFPQ) SetKMeansOptions(opts ...kmeans.Option) {
+	ivfpq.kmeans_opts = opts
+}
+
+func (ivfpq *IndexIVFPQ) IsTrained() bool {
+	return ivfpq.is_trained
+}
+
+// SetNprobe sets the number of inverted lists scanned by Search, 1 by default
+func (ivfpq *IndexIVFPQ) SetNprobe(nprobe int32) error {
+	if nprobe <= 0 {
+		return fmt.Errorf("IndexIVFPQ: SetNprobe: %w", ErrInvalidParameter)
+	}
+
+	ivfpq.nprobe = nprobe
+
+	return nil
+}
+
+// Search searches the k nearest neighbors of x in the nprobe nearest inverted lists (see SetNprobe), only
+// METRIC_L2 is supported. The returned vectors are reconstructed from the codes, they are approximations of the
+// original vectors.
+func (ivfpq *IndexIVFPQ) Search(x []float64, k int32, metric_type MetricType) (SearchResult, error) {
+	if len(x) != int(ivfpq.dim) {
+		return SearchResult{}, fmt.Errorf("IndexIVFPQ: Search: %w", ErrDimensionMismatch)
+	}
+	if !ivfpq.is_trained {
+		return SearchResult{}, fmt.Errorf("IndexIVFPQ: Search: %w", ErrNotTrained)
+	}
+	if k <= 0 {
+		return SearchResult{}, fmt.Errorf("IndexIVFPQ: Search: %w", ErrInvalidParameter)
+	}
+	if metric_type != METRIC_L2 {
+		return SearchResult{}, fmt.Errorf("IndexIVFPQ: Search: %w", ErrMetricMismatch)
+	}
+
+	nprobe := max(ivfpq.nprobe, 1)
+	if nprobe >= ivfpq.nlist {
+		nprobe = ivfpq.nlist // nprobe should not be greater than nlist
+	}
+
+	// step 1. get top nprobe lists based on distance with centroids
+	var list_max_heap utils.DistanceMaxHeap
+	list_max_heap.Init(nprobe)
+	q := mat.NewVecDense(int(ivfpq.dim), x)
+	for i := int32(0); i < ivfpq.nlist; i++ {
+		list_max_heap.Push(utils.L2Distance(ivfpq.centroids[i], *q), i)
+	}
+
+	// step 2. scan the selected lists with the distance table of the query residual, the heap keeps the slots of
+	// the candidates, which record where their code is
+	var distance_max_heap utils.DistanceMaxHeap
+	distance_max_heap.Init(k)
+	var candidates []ivfpq_candidate
+	for _, list_no := range list_max_heap.Idxs() {
+		table := ivfpq.pq.compute_distance_table(ivfpq.residual(x, list_no), METRIC_L2)
+
+		ids := ivfpq.invlists_ids[list_no]
+		for j := range ids {
+			distance := math.Sqrt(ivfpq.pq.compute_code_distance(table, ivfpq.list_code(list_no, int32(j))))
+			if distance_max_heap.Size() < k || distance < distance_max_heap.Peek() {
+				distance_max_heap.Push(distance, int32(len(candidates)))
+				candidates = append(candidates, ivfpq_candidate{id: ids[j], list_no: list_no, offset: int32(j)})
+			}
+		}
+	}
+
+	// step 3. reconstruct vectors from the codes of the candidates
+	slots := distance_max_heap.Idxs()
+	ids := make([]int32, len(slots))
+	slot_of := make(map[int32]int32, len(slots))
+	for i, slot := range slots {
+		ids[i] = candidates[slot].id
+		slot_of[ids[i]] = slot
+	}
+	result := new_search_result(ids, distance_max_heap.Distance(), METRIC_L2)
+	result.Vecs = make([][]float64, len(result.Idxs))
+	for i := range result.Idxs {
+		candidate := candidates[slot_of[result.Idxs[i]]]
+		result.Vecs[i] = ivfpq.reconstruct(candidate.list_no, candidate.offset)
+	}
+
+	return result, nil
+}
+
+// Add assigns x to the nearest inverted list and stores the PQ code of its residual, the id of x is its insertion order
+func (ivfpq *IndexIVFPQ) Add(x []float64) error {
+	if len(x) != int(ivfpq.dim) {
+		return fmt.Errorf("IndexIVFPQ: Add: %w", ErrDimensionMismatch)
+	}
+	if !ivfpq.is_trained {
+		return fmt.Errorf("IndexIVFPQ: Add: %w", ErrNotTrained)
+	}
+	if ivfpq.size >= ivfpq.cap {
+		return fmt.Errorf("IndexIVFPQ: Add: %w", ErrIndexFull)
+	}
+
+	list_no := ivfpq.assign(x)
+	code := make([]uint8, ivfpq.pq.code_size)
+	ivfpq.pq.encode(ivfpq.residual(x, list_no), code)
+
+	ivfpq.invlists_ids[list_no] = append(ivfpq.invlists_ids[list_no], ivfpq.size)
+	ivfpq.invlists_codes[list_no] = append(ivfpq.invlists_codes[list_no], code...)
+	ivfpq.size++
+
+	return nil
+}
+
+// BatchAdd adds all vectors of x, or none of them if one of them is invalid
+func (ivfpq *IndexIVFPQ) BatchAdd(x [][]float64) error {
+	if !check_dims(x, ivfpq.dim) {
+		return fmt.Errorf("IndexIVFPQ: BatchAdd: %w", ErrDimensionMismatch)
+	}
+	if !ivfpq.is_trained {
+		return fmt.Errorf("IndexIVFPQ: BatchAdd: %w", ErrNotTrained)
+	}
+	if ivfpq.size+int32(len(x)) > ivfpq.cap {
+		return fmt.Errorf("IndexIVFPQ: BatchAdd: %w", ErrIndexFull)
+	}
+
+	for i := range x {
+		ivfpq.Add(x[i])
+	}
+
+	return nil
+}
+
+// Size returns the number of vectors in the inverted lists
+func (ivfpq *IndexIVFPQ) Size() int32 {
+	return ivfpq.size
+}
+
+// Remove removes all vectors, the trained centroids and codebooks are kept
+func (ivfpq *IndexIVFPQ) Remove() {
+	ivfpq.size = 0
+	ivfpq.invlists_ids = make([][]int32, ivfpq.nlist)
+	ivfpq.invlists_codes = make([][]uint8, ivfpq.nlist)
+}
+
+// assign returns the inverted list of the nearest centroid of x
+func (ivfpq *IndexIVFPQ) assign(x []float64) int32 {
+	min_dist := math.MaxFloat64
+	min_idx := int32(0)
+	for i := int32(0); i < ivfpq.nlist; i++ {
+		dist := utils.L2DistanceSqrT(x, ivfpq.centroids[i].RawVector().Data)
+		if dist < min_dist {
+			min_dist = dist
+			min_idx = i
+		}
+	}
+
+	return min_idx
+}
+
+// residual returns x minus the centroid of list_no
+func (ivfpq *IndexIVFPQ) residual(x []float64, list_no int32) []float64 {
+	r := make([]float64, len(x))
+	floats.SubTo(r, x, ivfpq.centroids[list_no].RawVector().Data)
+
+	return r
+}
+
+// reconstruct decodes the vector at offset in list_no and adds back the centroid
+func (ivfpq *IndexIVFPQ) reconstruct(list_no int32, offset int32) []float64 {
+	x := make([]float64, ivfpq.dim)
+	ivfpq.pq.decode(ivfpq.list_code(list_no, offset), x)
+	floats.Add(x, ivfpq.centroids[list_no].RawVector().Data)
+
+	return x
+}
+
+func (ivfpq *IndexIVFPQ) list_code(list_no int32, offset int32) []uint8 {
+	code_size := int(ivfpq.pq.code_size)
+	return ivfpq.invlists_codes[list_no][int(offset)*code_size : (int(offset)+1)*code_size]
+}
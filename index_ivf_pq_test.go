@@ -0,0 +1,88 @@
+package nanofaiss
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIndexIVFPQ_Search(t *testing.T) {
+	// training is done once, goconvey runs the top-level func for every leaf Convey
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 4)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	var index_ivf_pq IndexIVFPQ
+	var index Index = &index_ivf_pq
+	index_ivf_pq.InitWithOptions(int32(n), int32(d), 8, 8, 5)
+	index_ivf_pq.Train(xb, 10, 0.001)
+	index_ivf_pq.BatchAdd(xb)
+
+	Convey("IndexIVFPQ_Search", t, func() {
+		So(index_ivf_pq.IsTrained(), ShouldBeTrue)
+
+		list_size := 0
+		for i := range index_ivf_pq.invlists_ids {
+			list_size += len(index_ivf_pq.invlists_ids[i])
+			So(len(index_ivf_pq.invlists_codes[i]), ShouldEqual, len(index_ivf_pq.invlists_ids[i])*5)
+		}
+		So(list_size, ShouldEqual, n)
+		So(index.Size(), ShouldEqual, n)
+
+		tests := []struct {
+			name     string
+			nprobe   int32
+			want_min float64
+		}{
+			{name: "test case 1: nprobe = 1", nprobe: 1, want_min: 0.5},
+			{name: "test case 2: nprobe = nlist", nprobe: 8, want_min: 0.9},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				So(index_ivf_pq.SetNprobe(tt.nprobe), ShouldBeNil)
+
+				// the true nearest neighbor should be found in the top k of the quantized search
+				hits := 0
+				for _, q := range xb[:50] {
+					want, err := flat.Search(q, 1, METRIC_L2)
+					So(err, ShouldBeNil)
+					result, err := index.Search(q, k, METRIC_L2)
+					So(err, ShouldBeNil)
+					So(len(result.Vecs), ShouldEqual, len(result.Idxs))
+
+					// the vectors are decoded from the codes of the results
+					for i, idx := range result.Idxs {
+						for list_no, ids := range index_ivf_pq.invlists_ids {
+							for offset, id := range ids {
+								if id == idx {
+									So(result.Vecs[i], ShouldResemble, index_ivf_pq.reconstruct(int32(list_no), int32(offset)))
+								}
+							}
+						}
+					}
+
+					for _, idx := range result.Idxs {
+						if idx == want.Idxs[0] {
+							hits++
+						}
+					}
+				}
+
+				So(float64(hits)/50, ShouldBeGreaterThanOrEqualTo, tt.want_min)
+			})
+		}
+
+		Convey("test case 3: errors", func() {
+			So(errors.Is(index_ivf_pq.SetNprobe(0), ErrInvalidParameter), ShouldBeTrue)
+			_, err := index.Search(xb[0], k, METRIC_IP)
+			So(errors.Is(err, ErrMetricMismatch), ShouldBeTrue)
+			_, err = index.Search(xb[0], 0, METRIC_L2)
+			So(errors.Is(err, ErrInvalidParameter), ShouldBeTrue)
+		})
+	})
+}
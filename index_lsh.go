@@ -1 +1,273 @@
 package nanofaiss
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+const lsh_random_seed int64 = 1234
+
+// IndexLSH is a locality sensitive hashing index with random hyperplanes.
+// Every vector is projected onto nbits random hyperplanes and stored as a packed binary code, bit i is set
+// if the i-th projection is above its threshold. Vectors with a small angle between them share most of their
+// bits, so search is done by Hamming distance between codes, no training is required.
+// Optionally the thresholds are trained as the medians of the projections, and the Hamming candidates are
+// re-ranked with the original metric, in which case the original vectors are kept.
+type IndexLSH struct {
+	size int32
+	cap  int32
+	dim  int32
+
+	nbits            int32
+	code_size        int32     // number of bytes of a code
+	projection       []float64 // nbits * d, row i is the normal vector of hyperplane i
+	thresholds       []float64 // nbits, zero unless trained
+	train_thresholds bool
+	rerank_factor    int32 // k * rerank_factor Hamming candidates are re-ranked, 0 means no re-ranking
+	is_trained       bool
+
+	codes []uint8
+	vecs  []mat.VecDense // original vectors, only kept when re-ranking
+}
+
+// Init initializes the index with nbits = d, no trained thresholds and no re-ranking
+func (ilsh *IndexLSH) Init(n int32, d int32) error {
+	return ilsh.InitWithOptions(n, d, d, false, 0)
+}
+
+// InitWithOptions initializes the index with nbits hyperplanes.
+// If train_thresholds is true, Train must be called before Add.
+// If rerank_factor > 0, Search re-ranks k * rerank_factor Hamming candidates with the given metric.
+func (ilsh *IndexLSH) InitWithOptions(n int32, d int32, nbits int32, train_thresholds bool, rerank_factor int32) error {
+	if n < 0 || d <= 0 || nbits <= 0 || rerank_factor < 0 {
+		return fmt.Errorf("IndexLSH: Init: %w", ErrInvalidParameter)
+	}
+
+	ilsh.size = 0
+	ilsh.cap = n
+	ilsh.dim = d
+
+	ilsh.nbits = nbits
+	ilsh.code_size = (nbits + 7) / 8
+	ilsh.thresholds = make([]float64, nbits)
+	ilsh.train_thresholds = train_thresholds
+	ilsh.rerank_factor = rerank_factor
+	ilsh.is_trained = !train_thresholds
+
+	// random hyperplanes, the components of the normal vectors are drawn from a standard normal distribution
+	r := rand.New(rand.NewSource(lsh_random_seed))
+	ilsh.projection = make([]float64, int(nbits)*int(d))
+	for i := range ilsh.projection {
+		ilsh.projection[i] = r.NormFloat64()
+	}
+
+	ilsh.codes = make([]uint8, 0, int(n)*int(ilsh.code_size))
+	if rerank_factor > 0 {
+		ilsh.vecs = make([]mat.VecDense, 0, n)
+	}
+
+	return nil
+}
+
+// Train sets the threshold of every bit to the median of the projections of x, it is a no-op if thresholds are not trained
+func (ilsh *IndexLSH) Train(x [][]float64) error {
+	if !ilsh.train_thresholds {
+		return nil
+	}
+	if len(x) == 0 {
+		return fmt.Errorf("IndexLSH: Train: no training vectors: %w", ErrInvalidParameter)
+	}
+	if !check_dims(x, ilsh.dim) {
+		return fmt.Errorf("IndexLSH: Train: %w", ErrDimensionMismatch)
+	}
+
+	projections := make([][]float64, ilsh.nbits)
+	for i := range projections {
+		projections[i] = make([]float64, len(x))
+	}
+	for j := range x {
+		p := ilsh.project(x[j])
+		for i := range p {
+			projections[i][j] = p[i]
+		}
+	}
+
+	for i := range projections {
+		sort.Float64s(projections[i])
+		mid := len(x) / 2
+		if len(x)%2 == 0 {
+			ilsh.thresholds[i] = (projections[i][mid-1] + projections[i][mid]) / 2
+		} else {
+			ilsh.thresholds[i] = projections[i][mid]
+		}
+	}
+
+	ilsh.is_trained = true
+
+	return nil
+}
+
+func (ilsh *IndexLSH) IsTrained() bool {
+	return ilsh.is_trained
+}
+
+// Search searches the k nearest codes of x in Hamming distance.
+// Without re-ranking, metric_type is only validated, the distances are Hamming distances and Vecs is nil since
+// the original vectors are not kept, random hyperplanes approximate the angle between vectors, ie. cosine similarity.
+// With re-ranking, the Hamming candidates are ranked by metric_type on the original vectors.
+func (ilsh *IndexLSH) Search(x []float64, k int32, metric_type MetricType) (SearchResult, error) {
+	if len(x) != int(ilsh.dim) {
+		return SearchResult{}, fmt.Errorf("IndexLSH: Search: %w", ErrDimensionMismatch)
+	}
+	if !ilsh.is_trained {
+		return SearchResult{}, fmt.Errorf("IndexLSH: Search: %w", ErrNotTrained)
+	}
+	if k <= 0 {
+		return SearchResult{}, fmt.Errorf("IndexLSH: Search: %w", ErrInvalidParameter)
+	}
+	if !metric_type.is_valid() {
+		return SearchResult{}, fmt.Errorf("IndexLSH: Search: %w", ErrInvalidMetric)
+	}
+
+	// step 1. search the nearest codes in Hamming distance
+	nhamming := k
+	if ilsh.rerank_factor > 0 {
+		nhamming = k * ilsh.rerank_factor
+	}
+	result := ilsh.hamming_search(ilsh.encode(x), nhamming)
+	if ilsh.rerank_factor <= 0 {
+		return result, nil
+	}
+
+	// step 2. re-rank the candidates with the original vectors and select vectors by idxs
+	result = ilsh.rerank(x, result.Idxs, k, metric_type)
+	result.Vecs = make([][]float64, len(result.Idxs))
+	for i := range result.Idxs {
+		result.Vecs[i] = ilsh.vecs[result.Idxs[i]].RawVector().Data
+	}
+
+	return result, nil
+}
+
+func (ilsh *IndexLSH) Add(x []float64) error {
+	if len(x) != int(ilsh.dim) {
+		return fmt.Errorf("IndexLSH: Add: %w", ErrDimensionMismatch)
+	}
+	if !ilsh.is_trained {
+		return fmt.Errorf("IndexLSH: Add: %w", ErrNotTrained)
+	}
+	if ilsh.size >= ilsh.cap {
+		return fmt.Errorf("IndexLSH: Add: %w", ErrIndexFull)
+	}
+
+	ilsh.size++
+	ilsh.codes = append(ilsh.codes, ilsh.encode(x)...)
+	if ilsh.rerank_factor > 0 {
+		ilsh.vecs = append(ilsh.vecs, *mat.NewVecDense(int(ilsh.dim), x))
+	}
+
+	return nil
+}
+
+// BatchAdd adds all vectors of x, or none of them if one of them is invalid
+func (ilsh *IndexLSH) BatchAdd(x [][]float64) error {
+	if !check_dims(x, ilsh.dim) {
+		return fmt.Errorf("IndexLSH: BatchAdd: %w", ErrDimensionMismatch)
+	}
+	if !ilsh.is_trained {
+		return fmt.Errorf("IndexLSH: BatchAdd: %w", ErrNotTrained)
+	}
+	if ilsh.size+int32(len(x)) > ilsh.cap {
+		return fmt.Errorf("IndexLSH: BatchAdd: %w", ErrIndexFull)
+	}
+
+	for i := range x {
+		ilsh.Add(x[i])
+	}
+
+	return nil
+}
+
+// Size returns the number of vectors in the index
+func (ilsh *IndexLSH) Size() int32 {
+	return ilsh.size
+}
+
+func (ilsh *IndexLSH) Remove() {
+	ilsh.size = 0
+	ilsh.codes = nil
+	ilsh.vecs = nil
+}
+
+// project returns the projections of x on the nbits hyperplanes
+func (ilsh *IndexLSH) project(x []float64) []float64 {
+	d := int(ilsh.dim)
+	p := make([]float64, ilsh.nbits)
+	for i := range p {
+		p[i] = utils.InnerProductT(ilsh.projection[i*d:(i+1)*d], x)
+	}
+
+	return p
+}
+
+// encode returns the packed binary code of x, bit i is the (i%8)-th bit of byte i/8
+func (ilsh *IndexLSH) encode(x []float64) []uint8 {
+	code := make([]uint8, ilsh.code_size)
+	for i, p := range ilsh.project(x) {
+		if p > ilsh.thresholds[i] {
+			code[i>>3] |= 1 << (i & 7)
+		}
+	}
+
+	return code
+}
+
+func (ilsh *IndexLSH) hamming_search(code []uint8, k int32) SearchResult {
+	var distance_max_heap utils.DistanceMaxHeap
+	distance_max_heap.Init(k)
+
+	code_size := int(ilsh.code_size)
+	for i := int32(0); i < ilsh.size; i++ {
+		distance := 0
+		stored := ilsh.codes[int(i)*code_size : (int(i)+1)*code_size]
+		for j := range code {
+			distance += bits.OnesCount8(code[j] ^ stored[j])
+		}
+
+		distance_max_heap.Push(float64(distance), i)
+	}
+
+	return new_search_result(distance_max_heap.Idxs(), distance_max_heap.Distance(), METRIC_L2) // Hamming distance, more smaller, more similar
+}
+
+func (ilsh *IndexLSH) rerank(x []float64, candidates []int32, k int32, metric_type MetricType) SearchResult {
+	q := *mat.NewVecDense(int(ilsh.dim), x)
+
+	if metric_type == METRIC_L2 {
+		var distance_max_heap utils.DistanceMaxHeap
+		distance_max_heap.Init(k)
+		for _, idx := range candidates {
+			distance_max_heap.Push(utils.L2Distance(ilsh.vecs[idx], q), idx)
+		}
+
+		return new_search_result(distance_max_heap.Idxs(), distance_max_heap.Distance(), METRIC_L2)
+	}
+
+	var distance_min_heap utils.DistanceMinHeap
+	distance_min_heap.Init(k)
+	for _, idx := range candidates {
+		if metric_type == METRIC_IP {
+			distance_min_heap.Push(utils.InnerProductDistance(ilsh.vecs[idx], q), idx)
+		} else {
+			distance_min_heap.Push(utils.CosineDistance(ilsh.vecs[idx], q), idx)
+		}
+	}
+
+	return new_search_result(distance_min_heap.Idxs(), distance_min_heap.Distance(), metric_type)
+}
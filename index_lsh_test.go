@@ -0,0 +1,93 @@
+package nanofaiss
+
+import (
+	"math/bits"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIndexLSH_Search(t *testing.T) {
+	Convey("IndexLSH_Search", t, func() {
+		n, d := 1000, 16
+		xb := random_vecs(n, d, 5)
+
+		var flat IndexFlat
+		flat.Init(int32(n), int32(d))
+		flat.BatchAdd(xb)
+
+		Convey("test case 1: duplicates without re-ranking", func() {
+			var index_lsh IndexLSH
+			index_lsh.InitWithOptions(int32(n), int32(d), 64, false, 0)
+			index_lsh.BatchAdd(xb)
+
+			So(len(index_lsh.codes), ShouldEqual, n*8)
+			for i := 0; i < 50; i++ {
+				got, err := index_lsh.Search(xb[i], 1, METRIC_COSINE)
+				So(err, ShouldBeNil)
+				So(got.Idxs, ShouldResemble, []int32{int32(i)})
+				So(got.Distances, ShouldResemble, []float64{0})
+				So(got.Vecs, ShouldBeNil)
+			}
+		})
+
+		Convey("test case 2: trained thresholds", func() {
+			var index_lsh IndexLSH
+			index_lsh.InitWithOptions(int32(n), int32(d), 32, true, 0)
+			So(index_lsh.IsTrained(), ShouldBeFalse)
+
+			index_lsh.Train(xb)
+			index_lsh.BatchAdd(xb)
+			So(index_lsh.IsTrained(), ShouldBeTrue)
+
+			// every bit is set for half of the training vectors
+			for b := 0; b < 32; b++ {
+				ones := 0
+				for i := 0; i < n; i++ {
+					ones += int(index_lsh.codes[i*4+b/8]>>(b%8)) & 1
+				}
+				So(ones, ShouldEqual, n/2)
+			}
+		})
+
+		Convey("test case 3: re-ranking with the original metric", func() {
+			var index_lsh IndexLSH
+			index_lsh.InitWithOptions(int32(n), int32(d), 64, false, 20)
+			index_lsh.BatchAdd(xb)
+
+			for _, metric_type := range []MetricType{METRIC_L2, METRIC_IP, METRIC_COSINE} {
+				hits := 0
+				for _, q := range random_vecs(50, d, 6) {
+					want, err := flat.Search(q, 1, metric_type)
+					So(err, ShouldBeNil)
+					result, err := index_lsh.Search(q, 5, metric_type)
+					So(err, ShouldBeNil)
+					So(len(result.Vecs), ShouldEqual, len(result.Idxs))
+
+					for _, idx := range result.Idxs {
+						if idx == want.Idxs[0] {
+							hits++
+						}
+					}
+				}
+
+				So(float64(hits)/50, ShouldBeGreaterThanOrEqualTo, 0.8)
+			}
+		})
+	})
+}
+
+func TestIndexLSH_Encode(t *testing.T) {
+	Convey("IndexLSH_Encode", t, func() {
+		var index_lsh IndexLSH
+		index_lsh.InitWithOptions(2, 4, 12, false, 0)
+
+		// opposite vectors are on opposite sides of every hyperplane
+		a := index_lsh.encode([]float64{1, 2, 3, 4})
+		b := index_lsh.encode([]float64{-1, -2, -3, -4})
+		So(len(a), ShouldEqual, 2)
+
+		distance := bits.OnesCount8(a[0]^b[0]) + bits.OnesCount8(a[1]^b[1])
+		So(distance, ShouldEqual, 12)
+	})
+}
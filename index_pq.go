@@ -1 +1,371 @@
 package nanofaiss
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/crowaixyz/nanofaiss/pkg/kmeans"
+	"github.com/crowaixyz/nanofaiss/utils"
+)
+
+// default number of bits per sub-quantizer code, each sub-quantizer has 256 centroids
+const PQ_DEFAULT_NBITS int32 = 8
+
+// IndexPQ is a product quantization index.
+// The vector space is split into m sub-spaces, each sub-space is quantized by its own kmeans codebook
+// of 2^nbits centroids, so a vector is stored as m codes of nbits bits instead of d float64 values.
+// Search computes asymmetric distances (ADC): the query is not quantized, the distances between the
+// query sub-vectors and all centroids are precomputed in lookup tables, and the distance to a stored
+// vector is the sum of m table lookups.
+type IndexPQ struct {
+	size int32
+	cap  int32
+	dim  int32
+
+	pq          product_quantizer
+	codes       []uint8 // codes of all vectors, pq.code_size bytes per vector
+	is_trained  bool
+	kmeans_opts []kmeans.Option
+}
+
+// Init initializes the index with m = d/2 sub-quantizers (m = d if d is odd) and PQ_DEFAULT_NBITS bits per code
+func (ipq *IndexPQ) Init(n int32, d int32) error {
+	m := d
+	if d%2 == 0 {
+		m = d / 2
+	}
+	return ipq.InitWithOptions(n, d, m, PQ_DEFAULT_NBITS)
+}
+
+// InitWithOptions initializes the index with m sub-quantizers of nbits bits, d must be a multiple of m
+func (ipq *IndexPQ) InitWithOptions(n int32, d int32, m int32, nbits int32) error {
+	if n < 0 {
+		return fmt.Errorf("IndexPQ: Init: %w", ErrInvalidParameter)
+	}
+	if err := ipq.pq.init(d, m, nbits); err != nil {
+		return fmt.Errorf("IndexPQ: Init: %w", err)
+	}
+
+	ipq.size = 0
+	ipq.cap = n
+	ipq.dim = d
+
+	ipq.codes = make([]uint8, 0, int(n)*int(ipq.pq.code_size))
+	ipq.is_trained = false
+
+	return nil
+}
+
+// Train learns the codebook of every sub-quantizer with kmeans on the training vectors x
+func (ipq *IndexPQ) Train(x [][]float64, max_iterations int32, delta_threshold float64) error {
+	if err := ipq.pq.train(x, max_iterations, delta_threshold, ipq.kmeans_opts...); err != nil {
+		return fmt.Errorf("IndexPQ: Train: %w", err)
+	}
+	ipq.is_trained = true
+
+	return nil
+}
+
+// SetKMeansOptions sets the options of the kmeans trainings of the product quantizer, eg. kmeans.WithSeed
+// for reproducible trainings
+func (ipq *IndexPQ) SetKMeansOptions(opts ...kmeans.Option) {
+	ipq.kmeans_opts = opts
+}
+
+func (ipq *IndexPQ) IsTrained() bool {
+	return ipq.is_trained
+}
+
+// Search searches the k nearest neighbors of x with asymmetric distance computation.
+// The returned vectors are reconstructed from the codes, they are approximations of the original vectors.
+func (ipq *IndexPQ) Search(x []float64, k int32, metric_type MetricType) (SearchResult, error) {
+	if len(x) != int(ipq.dim) {
+		return SearchResult{}, fmt.Errorf("IndexPQ: Search: %w", ErrDimensionMismatch)
+	}
+	if !ipq.is_trained {
+		return SearchResult{}, fmt.Errorf("IndexPQ: Search: %w", ErrNotTrained)
+	}
+	if k <= 0 {
+		return SearchResult{}, fmt.Errorf("IndexPQ: Search: %w", ErrInvalidParameter)
+	}
+
+	var result SearchResult
+	if metric_type == METRIC_L2 {
+		result = ipq.knn_search_l2_metric(x, k)
+	} else if metric_type == METRIC_IP || metric_type == METRIC_COSINE {
+		result = ipq.knn_search_similarity_metric(x, k, metric_type)
+	} else {
+		return SearchResult{}, fmt.Errorf("IndexPQ: Search: %w", ErrInvalidMetric)
+	}
+
+	// reconstruct vectors by idxs
+	result.Vecs = make([][]float64, len(result.Idxs))
+	for i := range result.Idxs {
+		result.Vecs[i] = ipq.reconstruct(result.Idxs[i])
+	}
+
+	return result, nil
+}
+
+func (ipq *IndexPQ) Add(x []float64) error {
+	if len(x) != int(ipq.dim) {
+		return fmt.Errorf("IndexPQ: Add: %w", ErrDimensionMismatch)
+	}
+	if !ipq.is_trained {
+		return fmt.Errorf("IndexPQ: Add: %w", ErrNotTrained)
+	}
+	if ipq.size >= ipq.cap {
+		return fmt.Errorf("IndexPQ: Add: %w", ErrIndexFull)
+	}
+
+	code := make([]uint8, ipq.pq.code_size)
+	ipq.pq.encode(x, code)
+
+	ipq.size++
+	ipq.codes = append(ipq.codes, code...)
+
+	return nil
+}
+
+// BatchAdd adds all vectors of x, or none of them if one of them is invalid
+func (ipq *IndexPQ) BatchAdd(x [][]float64) error {
+	if !check_dims(x, ipq.dim) {
+		return fmt.Errorf("IndexPQ: BatchAdd: %w", ErrDimensionMismatch)
+	}
+	if !ipq.is_trained {
+		return fmt.Errorf("IndexPQ: BatchAdd: %w", ErrNotTrained)
+	}
+	if ipq.size+int32(len(x)) > ipq.cap {
+		return fmt.Errorf("IndexPQ: BatchAdd: %w", ErrIndexFull)
+	}
+
+	for i := range x {
+		ipq.Add(x[i])
+	}
+
+	return nil
+}
+
+// Size returns the number of vectors in the index
+func (ipq *IndexPQ) Size() int32 {
+	return ipq.size
+}
+
+func (ipq *IndexPQ) Remove() {
+	ipq.size = 0
+	ipq.codes = nil
+}
+
+// Reconstruct decodes the i-th stored vector
+func (ipq *IndexPQ) Reconstruct(i int32) ([]float64, error) {
+	if i < 0 || i >= ipq.size {
+		return nil, fmt.Errorf("IndexPQ: Reconstruct: %w", ErrOutOfRange)
+	}
+
+	return ipq.reconstruct(i), nil
+}
+
+func (ipq *IndexPQ) reconstruct(i int32) []float64 {
+	x := make([]float64, ipq.dim)
+	ipq.pq.decode(ipq.code(i), x)
+
+	return x
+}
+
+func (ipq *IndexPQ) code(i int32) []uint8 {
+	code_size := int(ipq.pq.code_size)
+	return ipq.codes[int(i)*code_size : (int(i)+1)*code_size]
+}
+
+func (ipq *IndexPQ) knn_search_l2_metric(x []float64, k int32) SearchResult {
+	var distance_max_heap utils.DistanceMaxHeap
+	distance_max_heap.Init(k)
+
+	table := ipq.pq.compute_distance_table(x, METRIC_L2)
+	for i := int32(0); i < ipq.size; i++ {
+		distance := math.Sqrt(ipq.pq.compute_code_distance(table, ipq.code(i)))
+		distance_max_heap.Push(distance, i)
+	}
+
+	return new_search_result(distance_max_heap.Idxs(), distance_max_heap.Distance(), METRIC_L2)
+}
+
+func (ipq *IndexPQ) knn_search_similarity_metric(x []float64, k int32, metric_type MetricType) SearchResult {
+	var distance_min_heap utils.DistanceMinHeap
+	distance_min_heap.Init(k)
+
+	table := ipq.pq.compute_distance_table(x, METRIC_IP)
+	x_norm := math.Sqrt(utils.InnerProductT(x, x))
+	for i := int32(0); i < ipq.size; i++ {
+		distance := ipq.pq.compute_code_distance(table, ipq.code(i))
+		if metric_type == METRIC_COSINE {
+			distance /= x_norm * math.Sqrt(ipq.pq.compute_code_distance(ipq.pq.centroid_norms, ipq.code(i)))
+		}
+		distance_min_heap.Push(distance, i)
+	}
+
+	return new_search_result(distance_min_heap.Idxs(), distance_min_heap.Distance(), metric_type)
+}
+
+// product_quantizer splits a vector of dimension dim into m sub-vectors of dimension dsub,
+// and quantizes each sub-vector to one of the ksub = 2^nbits centroids of its sub-space.
+// It is shared by IndexPQ and IndexIVFPQ.
+type product_quantizer struct {
+	dim       int32
+	m         int32
+	nbits     int32
+	ksub      int32
+	dsub      int32
+	code_size int32 // number of bytes of a code, codes are packed with nbits bits per sub-quantizer
+
+	centroids      []float64 // m * ksub * dsub, centroid j of sub-quantizer i starts at (i*ksub + j) * dsub
+	centroid_norms []float64 // m * ksub, squared L2 norm of every centroid
+}
+
+// init returns ErrInvalidParameter if d is not a multiple of m or nbits is not in [1, 8]
+func (pq *product_quantizer) init(d int32, m int32, nbits int32) error {
+	if d <= 0 || m <= 0 || d%m != 0 {
+		return ErrInvalidParameter
+	}
+	if nbits <= 0 || nbits > 8 {
+		return ErrInvalidParameter
+	}
+
+	pq.dim = d
+	pq.m = m
+	pq.nbits = nbits
+	pq.ksub = 1 << nbits
+	pq.dsub = d / m
+	pq.code_size = (m*nbits + 7) / 8
+	pq.centroids = nil
+	pq.centroid_norms = nil
+
+	return nil
+}
+
+// train runs kmeans with opts in every sub-space, the number of training vectors should be at least ksub
+func (pq *product_quantizer) train(x [][]float64, max_iterations int32, delta_threshold float64, opts ...kmeans.Option) error {
+	if int32(len(x)) < pq.ksub {
+		return ErrInvalidParameter
+	}
+	if !check_dims(x, pq.dim) {
+		return ErrDimensionMismatch
+	}
+
+	pq.centroids = make([]float64, pq.m*pq.ksub*pq.dsub)
+	pq.centroid_norms = make([]float64, pq.m*pq.ksub)
+
+	for i := int32(0); i < pq.m; i++ {
+		sub_vecs := make([]mat.VecDense, len(x))
+		for j := range x {
+			sub_vecs[j] = *mat.NewVecDense(int(pq.dsub), x[j][i*pq.dsub:(i+1)*pq.dsub])
+		}
+
+		km := kmeans.NewWithOptions(pq.ksub, max_iterations, delta_threshold, opts...)
+		clusters, err := km.Train(sub_vecs, pq.dsub)
+		if err != nil {
+			return kmeans_error(err)
+		}
+
+		for j := int32(0); j < pq.ksub; j++ {
+			c := pq.centroid(i, j)
+			copy(c, clusters[j].Center().RawVector().Data)
+			pq.centroid_norms[i*pq.ksub+j] = utils.InnerProductT(c, c)
+		}
+	}
+
+	return nil
+}
+
+// centroid returns the j-th centroid of the i-th sub-quantizer
+func (pq *product_quantizer) centroid(i int32, j int32) []float64 {
+	start := (i*pq.ksub + j) * pq.dsub
+	return pq.centroids[start : start+pq.dsub]
+}
+
+// encode quantizes x to code, each sub-vector is assigned to the nearest centroid in L2 distance
+func (pq *product_quantizer) encode(x []float64, code []uint8) {
+	for i := range code {
+		code[i] = 0
+	}
+
+	for i := int32(0); i < pq.m; i++ {
+		sub_x := x[i*pq.dsub : (i+1)*pq.dsub]
+
+		min_dist := math.MaxFloat64
+		min_idx := int32(0)
+		for j := int32(0); j < pq.ksub; j++ {
+			dist := utils.L2DistanceSqrT(sub_x, pq.centroid(i, j))
+			if dist < min_dist {
+				min_dist = dist
+				min_idx = j
+			}
+		}
+
+		pq.set_code(code, i, min_idx)
+	}
+}
+
+// decode reconstructs the vector of code into x
+func (pq *product_quantizer) decode(code []uint8, x []float64) {
+	for i := int32(0); i < pq.m; i++ {
+		copy(x[i*pq.dsub:(i+1)*pq.dsub], pq.centroid(i, pq.get_code(code, i)))
+	}
+}
+
+// compute_distance_table computes the m * ksub lookup table of x: squared L2 distances between the
+// sub-vectors of x and the centroids for METRIC_L2, inner products for METRIC_IP
+func (pq *product_quantizer) compute_distance_table(x []float64, metric_type MetricType) []float64 {
+	table := make([]float64, pq.m*pq.ksub)
+
+	for i := int32(0); i < pq.m; i++ {
+		sub_x := x[i*pq.dsub : (i+1)*pq.dsub]
+		for j := int32(0); j < pq.ksub; j++ {
+			if metric_type == METRIC_L2 {
+				table[i*pq.ksub+j] = utils.L2DistanceSqrT(sub_x, pq.centroid(i, j))
+			} else {
+				table[i*pq.ksub+j] = utils.InnerProductT(sub_x, pq.centroid(i, j))
+			}
+		}
+	}
+
+	return table
+}
+
+// compute_code_distance sums up the table entries selected by code
+func (pq *product_quantizer) compute_code_distance(table []float64, code []uint8) float64 {
+	distance := 0.0
+	for i := int32(0); i < pq.m; i++ {
+		distance += table[i*pq.ksub+pq.get_code(code, i)]
+	}
+
+	return distance
+}
+
+// codes are packed as a little-endian bit stream, the same layout as Faiss
+func (pq *product_quantizer) get_code(code []uint8, i int32) int32 {
+	c := int32(0)
+	offset := i * pq.nbits
+	for b := int32(0); b < pq.nbits; b++ {
+		bit := offset + b
+		if code[bit>>3]&(1<<(bit&7)) != 0 {
+			c |= 1 << b
+		}
+	}
+
+	return c
+}
+
+func (pq *product_quantizer) set_code(code []uint8, i int32, c int32) {
+	offset := i * pq.nbits
+	for b := int32(0); b < pq.nbits; b++ {
+		bit := offset + b
+		if c&(1<<b) != 0 {
+			code[bit>>3] |= 1 << (bit & 7)
+		} else {
+			code[bit>>3] &^= 1 << (bit & 7)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package nanofaiss
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProductQuantizer_Code(t *testing.T) {
+	Convey("ProductQuantizer_Code", t, func() {
+		tests := []struct {
+			name  string
+			m     int32
+			nbits int32
+		}{
+			{name: "test case 1: nbits = 8", m: 4, nbits: 8},
+			{name: "test case 2: nbits = 5", m: 4, nbits: 5},
+			{name: "test case 3: nbits = 3", m: 8, nbits: 3},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				var pq product_quantizer
+				pq.init(tt.m*2, tt.m, tt.nbits)
+				So(pq.code_size, ShouldEqual, (tt.m*tt.nbits+7)/8)
+
+				code := make([]uint8, pq.code_size)
+				for i := int32(0); i < tt.m; i++ {
+					pq.set_code(code, i, (i*7+3)%pq.ksub)
+				}
+				for i := int32(0); i < tt.m; i++ {
+					So(pq.get_code(code, i), ShouldEqual, (i*7+3)%pq.ksub)
+				}
+			})
+		}
+	})
+}
+
+func TestIndexPQ_Search(t *testing.T) {
+	// training is done once, goconvey runs the top-level func for every leaf Convey
+	n, d, k := 1000, 16, int32(10)
+	xb := random_vecs(n, d, 3)
+
+	var flat IndexFlat
+	flat.Init(int32(n), int32(d))
+	flat.BatchAdd(xb)
+
+	var index_pq IndexPQ
+	index_pq.InitWithOptions(int32(n), int32(d), 8, 5)
+	index_pq.Train(xb, 10, 0.001)
+	index_pq.BatchAdd(xb)
+
+	Convey("IndexPQ_Search", t, func() {
+		So(index_pq.IsTrained(), ShouldBeTrue)
+		So(len(index_pq.codes), ShouldEqual, n*5)
+
+		tests := []struct {
+			name        string
+			metric_type MetricType
+		}{
+			{name: "test case 1: METRIC_L2", metric_type: METRIC_L2},
+			{name: "test case 2: METRIC_IP", metric_type: METRIC_IP},
+			{name: "test case 3: METRIC_COSINE", metric_type: METRIC_COSINE},
+		}
+
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				// the true nearest neighbor should be found in the top k of the quantized search
+				hits := 0
+				for _, q := range xb[:50] {
+					want, err := flat.Search(q, 1, tt.metric_type)
+					So(err, ShouldBeNil)
+					result, err := index_pq.Search(q, k, tt.metric_type)
+					So(err, ShouldBeNil)
+					So(len(result.Idxs), ShouldEqual, k)
+					So(len(result.Vecs), ShouldEqual, k)
+
+					for _, idx := range result.Idxs {
+						if idx == want.Idxs[0] {
+							hits++
+						}
+					}
+				}
+
+				So(float64(hits)/50, ShouldBeGreaterThanOrEqualTo, 0.9)
+			})
+		}
+	})
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package nanofaiss
+
+import (
+	"io"
+	"os"
+)
+
+// mmap_file reads the size bytes of f in memory on the platforms without mmap
+func mmap_file(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func munmap_file(data []byte) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package nanofaiss
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap_file maps the size bytes of f read-only, the mapping is shared with the page cache of other processes
+func mmap_file(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap_file(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -19,3 +19,17 @@ func (c *Cluster) Center() *mat.VecDense {
 func (c *Cluster) VecIdxs() map[int32]bool {
 	return c.vec_idxs
 }
+
+// NewCluster returns a cluster of center with the vectors of vec_idxs, eg. to restore a trained cluster
+func NewCluster(center mat.VecDense, vec_idxs []int32) Cluster {
+	c := Cluster{
+		size:     int32(len(vec_idxs)),
+		center:   center,
+		vec_idxs: make(map[int32]bool, len(vec_idxs)),
+	}
+	for _, idx := range vec_idxs {
+		c.vec_idxs[idx] = true
+	}
+
+	return c
+}
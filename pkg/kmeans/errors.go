@@ -0,0 +1,9 @@
+package kmeans
+
+import "errors"
+
+// errors returned by the trainings, they may be wrapped with some context, use errors.Is to check them
+var (
+	ErrInvalidParameter  = errors.New("kmeans: invalid parameter")
+	ErrDimensionMismatch = errors.New("kmeans: dimension mismatch")
+)
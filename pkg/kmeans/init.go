@@ -0,0 +1,238 @@
+package kmeans
+
+import (
+	"math"
+	"math/rand"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// InitMethod is the method used to choose the initial centroids
+type InitMethod int
+
+const (
+	INIT_RANDOM           InitMethod = iota // nlist distinct vectors chosen uniformly at random
+	INIT_KMEANS_PLUS_PLUS                   // k-means++: every vector is chosen with probability proportional to D(x)^2
+	INIT_KMEANS_PARALLEL                    // k-means||: a few oversampling rounds, reduced by a greedy k-means++
+)
+
+// number of oversampling rounds of k-means||, each samples about 2 * nlist vectors
+const kmeans_parallel_rounds = 5
+
+// WithInit selects the method choosing the initial centroids, INIT_RANDOM by default
+func WithInit(method InitMethod) Option {
+	return func(km *KMeans) {
+		km.init_method = method
+	}
+}
+
+// WithSeed seeds the random numbers of the training, so two trainings with the same seed return the same clusters.
+// Without a seed the current time is used.
+func WithSeed(seed int64) Option {
+	return func(km *KMeans) {
+		km.seed = seed
+		km.has_seed = true
+	}
+}
+
+// init_centroids returns the idxs of the nlist vectors chosen as initial centroids, D(x) is the L2 distance
+func (km *KMeans) init_centroids(rng *rand.Rand, vecs []mat.VecDense) []int32 {
+	points := make([][]float64, len(vecs))
+	for i := range vecs {
+		points[i] = vecs[i].RawVector().Data
+	}
+
+	switch km.init_method {
+	case INIT_KMEANS_PLUS_PLUS:
+		return kmeans_plus_plus(rng, points, nil, km.nlist, 1)
+	case INIT_KMEANS_PARALLEL:
+		return kmeans_parallel(rng, points, km.nlist)
+	}
+
+	return sample_without_replacement(rng, int32(len(vecs)), km.nlist)
+}
+
+// sample_without_replacement returns n distinct random numbers in [0, upper) with Floyd's algorithm
+func sample_without_replacement(rng *rand.Rand, upper int32, n int32) []int32 {
+	seen := make(map[int32]bool, n)
+	nums := make([]int32, 0, n)
+	for j := upper - n; j < upper; j++ {
+		t := rng.Int31n(j + 1)
+		if seen[t] {
+			t = j
+		}
+		seen[t] = true
+		nums = append(nums, t)
+	}
+
+	return nums
+}
+
+// kmeans_plus_plus chooses k of the points, every point is chosen with probability proportional to its weight
+// times its squared distance to the nearest chosen point, nil weights are all 1. With trials > 1 it is greedy:
+// trials points are drawn at every step and the one reducing the potential the most is kept.
+func kmeans_plus_plus(rng *rand.Rand, points [][]float64, weights []float64, k int32, trials int) []int32 {
+	weight := func(i int) float64 {
+		if weights == nil {
+			return 1
+		}
+		return weights[i]
+	}
+
+	// step 1. the first point is drawn by weight only
+	probs := make([]float64, len(points))
+	for i := range probs {
+		probs[i] = weight(i)
+	}
+	first := sample_weighted(rng, probs)
+	chosen := []int32{first}
+
+	min_d2 := make([]float64, len(points))
+	for i := range points {
+		min_d2[i] = l2_distance_sqr(points[i], points[first])
+	}
+
+	// step 2. draw the other points by weight * D(x)^2
+	candidate_d2 := make([]float64, len(points))
+	best_d2 := make([]float64, len(points))
+	for int32(len(chosen)) < k {
+		for i := range probs {
+			probs[i] = weight(i) * min_d2[i]
+		}
+
+		best := int32(-1)
+		best_potential := math.Inf(1)
+		for t := 0; t < trials; t++ {
+			candidate := sample_weighted(rng, probs)
+
+			potential := 0.0
+			for i := range points {
+				candidate_d2[i] = math.Min(min_d2[i], l2_distance_sqr(points[i], points[candidate]))
+				potential += weight(i) * candidate_d2[i]
+			}
+			if potential < best_potential {
+				best = candidate
+				best_potential = potential
+				best_d2, candidate_d2 = candidate_d2, best_d2
+			}
+		}
+
+		chosen = append(chosen, best)
+		min_d2, best_d2 = best_d2, min_d2
+	}
+
+	return chosen
+}
+
+// kmeans_parallel chooses k of the points with k-means||: every round samples each point with probability
+// 2k * D(x)^2 / potential, then the candidates weighted by the number of points nearest to them are reduced
+// to k with a greedy k-means++
+func kmeans_parallel(rng *rand.Rand, points [][]float64, k int32) []int32 {
+	first := rng.Int31n(int32(len(points)))
+	candidates := []int32{first}
+	is_candidate := map[int32]bool{first: true}
+
+	min_d2 := make([]float64, len(points))
+	for i := range points {
+		min_d2[i] = l2_distance_sqr(points[i], points[first])
+	}
+
+	oversampling := 2 * float64(k)
+	for r := 0; r < kmeans_parallel_rounds; r++ {
+		potential := 0.0
+		for i := range min_d2 {
+			potential += min_d2[i]
+		}
+		if potential == 0 {
+			break
+		}
+
+		var sampled []int32
+		for i := range points {
+			if rng.Float64() < oversampling*min_d2[i]/potential && !is_candidate[int32(i)] {
+				sampled = append(sampled, int32(i))
+				is_candidate[int32(i)] = true
+			}
+		}
+		for i := range points {
+			for _, c := range sampled {
+				min_d2[i] = math.Min(min_d2[i], l2_distance_sqr(points[i], points[c]))
+			}
+		}
+		candidates = append(candidates, sampled...)
+	}
+
+	// too few distinct candidates, eg. with duplicated points
+	if int32(len(candidates)) <= k {
+		return kmeans_plus_plus(rng, points, nil, k, greedy_trials(k))
+	}
+
+	// weight every candidate by the number of points nearest to it
+	weights := make([]float64, len(candidates))
+	for i := range points {
+		nearest := 0
+		nearest_d2 := math.Inf(1)
+		for j, c := range candidates {
+			if d2 := l2_distance_sqr(points[i], points[c]); d2 < nearest_d2 {
+				nearest = j
+				nearest_d2 = d2
+			}
+		}
+		weights[nearest]++
+	}
+
+	candidate_points := make([][]float64, len(candidates))
+	for j, c := range candidates {
+		candidate_points[j] = points[c]
+	}
+
+	chosen := kmeans_plus_plus(rng, candidate_points, weights, k, greedy_trials(k))
+	for i := range chosen {
+		chosen[i] = candidates[chosen[i]]
+	}
+
+	return chosen
+}
+
+// greedy_trials returns the number of trials of greedy k-means++, 2 + ln(k) like scikit-learn
+func greedy_trials(k int32) int {
+	return 2 + int(math.Log(float64(k)))
+}
+
+// sample_weighted returns i with probability probs[i] / sum(probs), or uniformly if all probs are 0
+func sample_weighted(rng *rand.Rand, probs []float64) int32 {
+	total := 0.0
+	for _, p := range probs {
+		total += p
+	}
+	if total <= 0 {
+		return rng.Int31n(int32(len(probs)))
+	}
+
+	r := rng.Float64() * total
+	for i, p := range probs {
+		r -= p
+		if r < 0 {
+			return int32(i)
+		}
+	}
+
+	// rounding errors, the last point of non-zero probability
+	for i := len(probs) - 1; i > 0; i-- {
+		if probs[i] > 0 {
+			return int32(i)
+		}
+	}
+	return 0
+}
+
+// l2_distance_sqr returns the squared L2 distance of a and b
+func l2_distance_sqr(a, b []float64) float64 {
+	s := 0.0
+	for i := range a {
+		d := a[i] - b[i]
+		s += d * d
+	}
+
+	return s
+}
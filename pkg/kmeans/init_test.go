@@ -0,0 +1,93 @@
+package kmeans
+
+import (
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gonum.org/v1/gonum/mat"
+)
+
+// blobs returns n vectors of dimension d around each of the centers, the blobs are far apart
+func blobs(centers [][]float64, n int, seed int64) []mat.VecDense {
+	rng := rand.New(rand.NewSource(seed))
+	vecs := make([]mat.VecDense, 0, len(centers)*n)
+	for _, c := range centers {
+		for i := 0; i < n; i++ {
+			data := make([]float64, len(c))
+			for j := range data {
+				data[j] = c[j] + rng.NormFloat64()
+			}
+			vecs = append(vecs, *mat.NewVecDense(len(data), data))
+		}
+	}
+
+	return vecs
+}
+
+func TestKMeans_Init(t *testing.T) {
+	centers := [][]float64{{0, 0, 0}, {100, 0, 0}, {0, 100, 0}, {0, 0, 100}, {100, 100, 100}}
+	vecs := blobs(centers, 200, 1)
+
+	Convey("KMeans_Init", t, func() {
+		// define test cases
+		tests := []struct {
+			name   string
+			method InitMethod
+		}{
+			{name: "test case 1: random", method: INIT_RANDOM},
+			{name: "test case 2: k-means++", method: INIT_KMEANS_PLUS_PLUS},
+			{name: "test case 3: k-means||", method: INIT_KMEANS_PARALLEL},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				// the same seed gives the same clusters
+				km := NewWithOptions(5, 20, 0, WithInit(tt.method), WithSeed(42))
+				want, err := km.Train(vecs, 3)
+				So(err, ShouldBeNil)
+				got, err := km.Train(vecs, 3)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, want)
+
+				idxs := km.init_centroids(rand.New(rand.NewSource(7)), vecs)
+				So(len(idxs), ShouldEqual, 5)
+				if tt.method == INIT_RANDOM {
+					return
+				}
+
+				// D(x)^2 sampling picks one vector in every blob
+				blob_seen := make(map[int32]bool)
+				for _, idx := range idxs {
+					blob_seen[idx/200] = true
+				}
+				So(len(blob_seen), ShouldEqual, 5)
+			})
+		}
+
+		Convey("test case 4: sample_without_replacement", func() {
+			rng := rand.New(rand.NewSource(3))
+			nums := sample_without_replacement(rng, 10, 10)
+			seen := make(map[int32]bool)
+			for _, num := range nums {
+				So(num, ShouldBeBetweenOrEqual, 0, 9)
+				seen[num] = true
+			}
+			So(len(seen), ShouldEqual, 10)
+		})
+
+		Convey("test case 5: duplicated vectors", func() {
+			same := make([]mat.VecDense, 10)
+			for i := range same {
+				same[i] = *mat.NewVecDense(2, []float64{1, 1})
+			}
+			for _, method := range []InitMethod{INIT_KMEANS_PLUS_PLUS, INIT_KMEANS_PARALLEL} {
+				km := NewWithOptions(3, 5, 0, WithInit(method), WithSeed(1))
+				clusters, err := km.Train(same, 2)
+				So(err, ShouldBeNil)
+				So(len(clusters), ShouldEqual, 3)
+			}
+		})
+	})
+}
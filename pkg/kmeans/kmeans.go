@@ -1,166 +1,388 @@
 package kmeans
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/crowaixyz/nanofaiss/utils"
+	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
 )
 
+// number of vectors per block of the assignment step
+const ASSIGN_BLOCK = 1024
+
+// relative perturbation of the centroids of a split cluster, same as Faiss
+const split_eps = 1.0 / 1024
+
 type KMeans struct {
 	nlist           int32
 	max_iterations  int32
 	delta_threshold float64
+	workers         int  // number of goroutines of the assignment and update steps, GOMAXPROCS if <= 0
+	max_points      int  // Train subsamples the vectors to max_points per centroid, no subsampling if <= 0
+	inner_product   bool // assign the vectors to the centroid of maximum inner product instead of minimum L2 distance
+	spherical       bool // normalize the centroids to unit length after every iteration
+	init_method     InitMethod
+	seed            int64
+	has_seed        bool
+	log             func(stats IterationStats)
+	stats           []IterationStats // statistics of the iterations of the last training
+}
+
+// IterationStats are the statistics of an iteration of the training
+type IterationStats struct {
+	Iteration     int32
+	Inertia       float64       // sum of the squared L2 distances of the vectors to the centroid they are assigned to, of the batch for TrainMiniBatch
+	VecAdjustNum  int           // number of vectors which changed cluster, 0 for TrainMiniBatch
+	CentroidShift float64       // sum of the squared L2 distances the centroids moved, TrainMiniBatch only
+	Time          time.Duration // duration of the iteration
 }
 
-func NewWithOptions(nlist int32, max_interations int32, delta_threshold float64) KMeans {
-	return KMeans{
+// Option configures the KMeans returned by NewWithOptions
+type Option func(km *KMeans)
+
+func NewWithOptions(nlist int32, max_interations int32, delta_threshold float64, opts ...Option) KMeans {
+	km := KMeans{
 		nlist:           nlist,
 		max_iterations:  max_interations,
 		delta_threshold: delta_threshold,
 	}
+	for _, opt := range opts {
+		opt(&km)
+	}
+
+	return km
 }
 
-func (km *KMeans) Train(vecs []mat.VecDense, dim int32) []Cluster {
-	vec_size := int32(len(vecs))
-	init_cluster_size := vec_size / km.nlist / 2  // set the default init size of cluster
+// WithWorkers sets the number of goroutines of the training, GOMAXPROCS by default
+func WithWorkers(workers int) Option {
+	return func(km *KMeans) {
+		km.workers = workers
+	}
+}
 
-	// step 1. Initialize the centroids
-	// FIXME: randomly select the centroids temporarily, better way to init centroids ?
-	rand_centroid_idxs := generate_random_numbers(vec_size, km.nlist)
-	clusters := make([]Cluster, km.nlist)
-	for i := int32(0); i < km.nlist; i++ {
-		clusters[i].size = 0
-		clusters[i].vec_idxs = make(map[int32]bool, init_cluster_size)
-		clusters[i].center = vecs[rand_centroid_idxs[i]]
+// WithMaxPointsPerCentroid caps the training set of Train to max_points * nlist vectors like Faiss, which uses 256:
+// the centroids are trained on a random sample and all the vectors are assigned to them at the end.
+// No subsampling by default.
+func WithMaxPointsPerCentroid(max_points int) Option {
+	return func(km *KMeans) {
+		km.max_points = max_points
+	}
+}
+
+// WithLog calls log with the statistics of every iteration of the training
+func WithLog(log func(stats IterationStats)) Option {
+	return func(km *KMeans) {
+		km.log = log
 	}
+}
 
-	// step 2. Iterate until convergence: reach interation limit or adjust rate lower than threshold
-	// FIXME: bad performance
-	for i := int32(0); i < km.max_iterations; i++ {
-		vec_cluster_map := make(map[int32]int32, vec_size)
-		vec_adjust_num := 0
-		// step 2.1. Assign each vector to the nearest cluster
-		for j := int32(0); j < vec_size; j++ {
-			// calculate distance between vector and cluster centroid, only support L2 distance
-			min_dist := math.MaxFloat64
-			min_dist_cluster_idx := int32(-1)
-			if _, ok := vec_cluster_map[j]; ok {
-				min_dist_cluster_idx = vec_cluster_map[j]
-			}
-			for k := int32(0); k < km.nlist; k++ {
-				v := vecs[j]
-				c := clusters[k].center
-				dist := utils.L2Distance(v, c)
-				if dist < min_dist {
-					min_dist = dist
-					min_dist_cluster_idx = k
-				}
-			}
+// Stats returns the statistics of the iterations of the last training, eg. to check the inertia decreases
+func (km *KMeans) Stats() []IterationStats {
+	return km.stats
+}
 
-			// check if should change the cluster index of vector
-			c_idx := vec_cluster_map[j]
-			if min_dist_cluster_idx != c_idx {
-				// delete vec index from original cluster
-				delete(clusters[c_idx].vec_idxs, j)
-				clusters[c_idx].size -= 1
+// WithInnerProduct assigns the vectors to the centroid of maximum inner product, the centroids are still the means
+func WithInnerProduct() Option {
+	return func(km *KMeans) {
+		km.inner_product = true
+	}
+}
 
-				// put vec index to new cluster
-				clusters[min_dist_cluster_idx].vec_idxs[j] = true
-				clusters[min_dist_cluster_idx].size += 1
+// WithSpherical trains a spherical kmeans for cosine similarity: the vectors are assigned by inner product and
+// the centroids are normalized after every iteration, the vectors should be normalized too
+func WithSpherical() Option {
+	return func(km *KMeans) {
+		km.inner_product = true
+		km.spherical = true
+	}
+}
 
-				// change cluster index of vector
-				vec_cluster_map[j] = min_dist_cluster_idx
+// Train clusters vecs into nlist clusters, the assignment and the update steps are run by the workers.
+// An empty cluster is given a centroid by splitting the largest cluster, like Faiss. The iterations stop when the
+// rate of the vectors changing cluster is at most delta_threshold and no cluster was split. Then all the vectors are assigned to the trained centroids, so every vector
+// is in the cluster of its nearest centroid. It returns ErrInvalidParameter if nlist <= 0 or nlist > len(vecs).
+func (km *KMeans) Train(vecs []mat.VecDense, dim int32) ([]Cluster, error) {
+	km.stats = nil
+	if km.nlist <= 0 {
+		return nil, ErrInvalidParameter
+	}
+	if len(vecs) < int(km.nlist) {
+		return nil, fmt.Errorf("%d vectors for %d clusters: %w", len(vecs), km.nlist, ErrInvalidParameter)
+	}
 
-				// increase vector adjust number
-				vec_adjust_num += 1
-			}
+	// step 1. Subsample the vectors, all the random numbers come from one seeded source
+	rng := km.new_rand()
+	train_vecs := km.subsample(rng, vecs)
+	vec_size := int32(len(train_vecs))
 
-			// break if vec adjust cluster index rate less than threshold
-			if (float64(vec_adjust_num) / float64(vec_size)) <= km.delta_threshold {
-				break
-			}
+	// step 2. Initialize the centroids with the init method
+	centroid_idxs := km.init_centroids(rng, train_vecs)
+	centers := make([]mat.VecDense, km.nlist)
+	for i := range centers {
+		centers[i] = *mat.VecDenseCopyOf(&train_vecs[centroid_idxs[i]])
+		if km.spherical {
+			centers[i] = normalize(centers[i])
 		}
+	}
 
-		// step 2.2 set the centeroid of cluster to the mean value of all vectors in the cluster
-		for l := int32(0); l < km.nlist; l++ {
-			// FIXME: if cluster is empty, move the first vector from every other cluster
-			if clusters[l].size <= 0 {
-				for m := int32(0); m < km.nlist; m++ {
-					if m != l && clusters[m].size > 1 {
-						// move the first vector of cluster m to cluster l
-						for v_idx := range clusters[m].vec_idxs {
-							// delete vector from cluster m
-							delete(clusters[m].vec_idxs, v_idx)
-							clusters[m].size -= 1
-
-							// add vector to new cluster l
-							clusters[l].vec_idxs[v_idx]= true
-							clusters[l].size += 1
-
-							break
-						}
-					}
-				}
-			}
+	// step 3. Iterate until convergence: reach interation limit or adjust rate lower than threshold
+	assign := make([]int32, vec_size) // cluster of every vector
+	for j := range assign {
+		assign[j] = -1
+	}
+	for i := int32(0); i < km.max_iterations; i++ {
+		start := time.Now()
+
+		// step 3.1. Assign each vector to the nearest cluster
+		vec_adjust_num, inertia := km.assign_vecs(train_vecs, dim, centers, assign)
+
+		// step 3.2. collect the vectors of every cluster in ascending order
+		members := collect_members(assign, km.nlist)
+
+		// step 3.3 set the centeroid of cluster to the mean value of all vectors in the cluster,
+		// then split the largest clusters to give a centroid to the empty ones
+		km.update_centers(train_vecs, dim, members, centers)
+		nsplit := km.split_clusters(members, centers)
+		km.log_iteration(IterationStats{Iteration: i, Inertia: inertia, VecAdjustNum: vec_adjust_num, Time: time.Since(start)})
+
+		// break if vec adjust cluster index rate less than threshold, the vectors of a split cluster are moved
+		// by the next assignment
+		if nsplit == 0 && (float64(vec_adjust_num)/float64(vec_size)) <= km.delta_threshold {
+			break
 		}
-		for k := int32(0); k < km.nlist; k++ {
-			clusters[k].center = vec_mean(clusters[k].vec_idxs, vecs, dim)
+	}
+
+	// step 4. Assign all the vectors to the final centroids, the last update moved them after the last assignment
+	// and the centroids may be trained on a subsample
+	if len(train_vecs) < len(vecs) {
+		assign = make([]int32, len(vecs))
+		for j := range assign {
+			assign[j] = -1
 		}
 	}
+	km.assign_vecs(vecs, dim, centers, assign)
+	members := collect_members(assign, km.nlist)
 
-	// step 3. Return the clusters
-	return clusters
+	// step 5. Return the clusters
+	clusters := make([]Cluster, km.nlist)
+	for l := range clusters {
+		clusters[l] = NewCluster(centers[l], members[l])
+	}
+	return clusters, nil
 }
 
-func generate_random_numbers(upper int32, n int32) []int32 {
-	rand_nums := make(map[int32]int, n)
+// assign_vecs assigns every vector to the nearest centroid, it returns the number of vectors whose cluster changed
+// and the inertia, the sum of the squared L2 distances of the vectors to their centroid.
+// The workers compute the inner products of blocks of vectors with the centroids by BLAS matrix multiplications,
+// the L2 distance is ranked by |c|^2 - 2 x.c and the inner product by -x.c. The blocks do not depend on the number
+// of workers, so neither do the assignments.
+func (km *KMeans) assign_vecs(vecs []mat.VecDense, dim int32, centers []mat.VecDense, assign []int32) (int, float64) {
+	c := mat.NewDense(int(km.nlist), int(dim), nil)
+	c_norms := make([]float64, km.nlist)
+	for k := range centers {
+		c.SetRow(k, centers[k].RawVector().Data)
+		c_norms[k] = mat.Dot(&centers[k], &centers[k])
+	}
 
-	for i := int32(0); i < n; i++ {
-		tmp := rand.New(rand.NewSource(time.Now().UnixNano())).Int31n(upper)
-		if _, ok := rand_nums[tmp]; !ok {
-			rand_nums[tmp] = 1  // 1 - no useful meaning
-		} else {
-			for {
-				tmp = rand.New(rand.NewSource(time.Now().UnixNano())).Int31n(upper)
-				if _, ok := rand_nums[tmp]; ok {
-					continue
-				} else {
-					rand_nums[tmp] = 1
-					break
+	// a block of inner products takes at most 8MB
+	block := min(ASSIGN_BLOCK, max(1, (1<<20)/int(km.nlist)))
+	nblocks := (len(vecs) + block - 1) / block
+	changed := make([]int, nblocks)
+	inertias := make([]float64, nblocks)
+	km.parallel_for(nblocks, func(b int) {
+		b0 := b * block
+		b1 := min(b0+block, len(vecs))
+		x := mat.NewDense(b1-b0, int(dim), nil)
+		for j := b0; j < b1; j++ {
+			x.SetRow(j-b0, vecs[j].RawVector().Data)
+		}
+
+		var dots mat.Dense
+		dots.Mul(x, c.T())
+		for j := b0; j < b1; j++ {
+			best := int32(0)
+			best_dist := math.Inf(1)
+			best_dot := 0.0
+			for k, dot := range dots.RawRowView(j - b0) {
+				dist := c_norms[k] - 2*dot
+				if km.inner_product {
+					dist = -dot
+				}
+				if dist < best_dist {
+					best = int32(k)
+					best_dist = dist
+					best_dot = dot
 				}
 			}
+
+			x_norm := floats.Dot(x.RawRowView(j-b0), x.RawRowView(j-b0))
+			inertias[b] += math.Max(0, x_norm+c_norms[best]-2*best_dot)
+
+			if assign[j] != best {
+				assign[j] = best
+				changed[b]++
+			}
+		}
+	})
+
+	vec_adjust_num := 0
+	inertia := 0.0
+	for b := range changed {
+		vec_adjust_num += changed[b]
+		inertia += inertias[b]
+	}
+	return vec_adjust_num, inertia
+}
+
+// subsample returns a random sample of max_points per centroid of vecs in ascending order, or vecs if it is smaller
+func (km *KMeans) subsample(rng *rand.Rand, vecs []mat.VecDense) []mat.VecDense {
+	if km.max_points <= 0 || len(vecs) <= km.max_points*int(km.nlist) {
+		return vecs
+	}
+
+	idxs := sample_without_replacement(rng, int32(len(vecs)), int32(km.max_points*int(km.nlist)))
+	sort.Slice(idxs, func(a, b int) bool { return idxs[a] < idxs[b] })
+	sample := make([]mat.VecDense, len(idxs))
+	for i, idx := range idxs {
+		sample[i] = vecs[idx]
+	}
+
+	return sample
+}
+
+// log_iteration records the statistics of an iteration and passes them to the log
+func (km *KMeans) log_iteration(stats IterationStats) {
+	km.stats = append(km.stats, stats)
+	if km.log != nil {
+		km.log(stats)
+	}
+}
+
+// update_centers sets the centroid of every non empty cluster to the mean of its vectors, the clusters are split
+// among the workers and the vectors are summed in ascending order
+func (km *KMeans) update_centers(vecs []mat.VecDense, dim int32, members [][]int32, centers []mat.VecDense) {
+	km.parallel_for(len(members), func(l int) {
+		if len(members[l]) == 0 {
+			return
 		}
+
+		mean := make([]float64, dim)
+		for _, idx := range members[l] {
+			floats.Add(mean, vecs[idx].RawVector().Data)
+		}
+		floats.Scale(1/float64(len(members[l])), mean)
+
+		centers[l] = *mat.NewVecDense(int(dim), mean)
+		if km.spherical {
+			centers[l] = normalize(centers[l])
+		}
+	})
+}
+
+// split_clusters gives a centroid to every empty cluster by splitting the largest cluster like Faiss: the empty
+// cluster takes a copy of its centroid, then the two centroids are moved apart by a small symmetric perturbation
+// and each one counts half of the vectors for the following splits. It returns the number of split clusters.
+func (km *KMeans) split_clusters(members [][]int32, centers []mat.VecDense) int {
+	sizes := make([]int, len(members))
+	for l := range members {
+		sizes[l] = len(members[l])
 	}
 
-	num_list := []int32{}
-	for k := range rand_nums {
-		num_list = append(num_list, int32(k))
+	nsplit := 0
+	for l := range sizes {
+		if sizes[l] > 0 {
+			continue
+		}
+		largest := 0
+		for m := range sizes {
+			if sizes[m] > sizes[largest] {
+				largest = m
+			}
+		}
+		if sizes[largest] < 2 {
+			continue
+		}
+
+		c := centers[largest].RawVector().Data
+		split := make([]float64, len(c))
+		kept := make([]float64, len(c))
+		for j := range c {
+			if j%2 == 0 {
+				split[j], kept[j] = c[j]*(1+split_eps), c[j]*(1-split_eps)
+			} else {
+				split[j], kept[j] = c[j]*(1-split_eps), c[j]*(1+split_eps)
+			}
+		}
+		centers[l] = *mat.NewVecDense(len(split), split)
+		centers[largest] = *mat.NewVecDense(len(kept), kept)
+		if km.spherical {
+			centers[l] = normalize(centers[l])
+			centers[largest] = normalize(centers[largest])
+		}
+
+		sizes[l] = sizes[largest] / 2
+		sizes[largest] -= sizes[l]
+		nsplit++
 	}
-	
-	return num_list
+
+	return nsplit
 }
 
+// collect_members returns the idxs of the vectors of every cluster in ascending order
+func collect_members(assign []int32, nlist int32) [][]int32 {
+	members := make([][]int32, nlist)
+	for j, c := range assign {
+		members[c] = append(members[c], int32(j))
+	}
 
-// func generate_random_centroid(dim int32) mat.VecDense {
-// 	vec := mat.NewVecDense(int(dim), nil)
-// 	for i := int32(0); i < dim; i++ {
-// 		vec.SetVec(int(i), rand.New(rand.NewSource(time.Now().UnixNano())).Float64())
-// 	}
-// 	return *vec
-// }
+	return members
+}
 
+// parallel_for calls fn(0), ..., fn(n-1) on the workers
+func (km *KMeans) parallel_for(n int, fn func(i int)) {
+	workers := km.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, n)
 
-func vec_mean(vec_idxs map[int32]bool, vecs []mat.VecDense, dim int32) mat.VecDense {
-	mean := mat.NewVecDense(int(dim), nil)
-	for idx := range vec_idxs {
-		v := vecs[idx]
-		mean.AddVec(mean, &v)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				fn(i)
+			}
+		}()
 	}
+	wg.Wait()
+}
 
-	mean.ScaleVec(1/float64(len(vec_idxs)), mean)
+// new_rand returns the random source of a training, seeded with the seed option or the current time
+func (km *KMeans) new_rand() *rand.Rand {
+	seed := km.seed
+	if !km.has_seed {
+		seed = time.Now().UnixNano()
+	}
 
-	return *mean
-}
\ No newline at end of file
+	return rand.New(rand.NewSource(seed))
+}
+
+// normalize returns a copy of v scaled to unit length, a zero vector is returned as is
+func normalize(v mat.VecDense) mat.VecDense {
+	u := mat.VecDenseCopyOf(&v)
+	if norm := mat.Norm(u, 2); norm > 0 {
+		u.ScaleVec(1/norm, u)
+	}
+
+	return *u
+}
@@ -0,0 +1,211 @@
+package kmeans
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestKMeans_Workers(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	vecs := make([]mat.VecDense, 3000)
+	for i := range vecs {
+		data := make([]float64, 8)
+		for j := range data {
+			data[j] = rng.NormFloat64()
+		}
+		vecs[i] = *mat.NewVecDense(len(data), data)
+	}
+
+	Convey("KMeans_Workers", t, func() {
+		// define test cases
+		tests := []struct {
+			name string
+			opts []Option
+		}{
+			{name: "test case 1: L2", opts: nil},
+			{name: "test case 2: inner product", opts: []Option{WithInnerProduct()}},
+			{name: "test case 3: spherical", opts: []Option{WithSpherical()}},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				// the clusters do not depend on the number of workers
+				var want []Cluster
+				for _, workers := range []int{1, 3, 8} {
+					opts := append([]Option{WithSeed(42), WithWorkers(workers)}, tt.opts...)
+					km := NewWithOptions(16, 10, 0, opts...)
+					got, err := km.Train(vecs, 8)
+					So(err, ShouldBeNil)
+					if want == nil {
+						want = got
+						continue
+					}
+					So(got, ShouldResemble, want)
+				}
+
+				// the assignment step matches the brute force one
+				centers := make([]mat.VecDense, len(want))
+				for l := range want {
+					centers[l] = *want[l].Center()
+				}
+				km := NewWithOptions(16, 10, 0, tt.opts...)
+				assign := make([]int32, len(vecs))
+				vec_adjust_num, inertia := km.assign_vecs(vecs, 8, centers, assign)
+				So(vec_adjust_num, ShouldBeGreaterThan, 0)
+				want_inertia := 0.0
+				for j := range vecs {
+					best, best_dist := int32(0), math.Inf(1)
+					for l := range centers {
+						var diff mat.VecDense
+						diff.SubVec(&vecs[j], &centers[l])
+						dist := mat.Norm(&diff, 2)
+						if km.inner_product {
+							dist = -mat.Dot(&vecs[j], &centers[l])
+						}
+						if dist < best_dist {
+							best, best_dist = int32(l), dist
+						}
+					}
+					So(assign[j], ShouldEqual, best)
+					want_inertia += l2_distance_sqr(vecs[j].RawVector().Data, centers[best].RawVector().Data)
+				}
+				So(inertia, ShouldAlmostEqual, want_inertia, 1e-6)
+			})
+		}
+	})
+}
+
+func TestKMeans_Stats(t *testing.T) {
+	centers := [][]float64{{0, 0, 0}, {100, 0, 0}, {0, 100, 0}, {0, 0, 100}, {100, 100, 100}}
+	vecs := blobs(centers, 200, 1)
+
+	Convey("KMeans_Stats", t, func() {
+		// define test cases
+		tests := []struct {
+			name       string
+			max_points int
+			train_size int
+		}{
+			{name: "test case 1: all the vectors", max_points: 0, train_size: 1000},
+			{name: "test case 2: subsample", max_points: 40, train_size: 200},
+			{name: "test case 3: cap above the vectors", max_points: 1000, train_size: 1000},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				var logged []IterationStats
+				km := NewWithOptions(5, 20, 0.001, WithSeed(42), WithInit(INIT_KMEANS_PLUS_PLUS),
+					WithMaxPointsPerCentroid(tt.max_points), WithLog(func(stats IterationStats) {
+						logged = append(logged, stats)
+					}))
+				clusters, err := km.Train(vecs, 3)
+				So(err, ShouldBeNil)
+				So(km.Stats(), ShouldResemble, logged)
+
+				// the iterations stop once converged, the inertia does not increase
+				stats := km.Stats()
+				So(len(stats), ShouldBeBetweenOrEqual, 1, 20)
+				So(stats[0].VecAdjustNum, ShouldEqual, tt.train_size)
+				for i := range stats {
+					So(stats[i].Iteration, ShouldEqual, i)
+					if i > 0 {
+						So(stats[i].Inertia, ShouldBeLessThanOrEqualTo, stats[i-1].Inertia+1e-6)
+					}
+				}
+				last := stats[len(stats)-1]
+				So(float64(last.VecAdjustNum)/float64(tt.train_size), ShouldBeLessThanOrEqualTo, 0.001)
+
+				// the inertia of a blob is about 3 per vector
+				So(last.Inertia/float64(tt.train_size), ShouldBeBetween, 2, 4)
+
+				// all the vectors are in a cluster, every cluster is a blob
+				total := int32(0)
+				for i := range clusters {
+					total += clusters[i].Size()
+					So(clusters[i].Size(), ShouldEqual, 200)
+				}
+				So(total, ShouldEqual, 1000)
+			})
+		}
+
+		Convey("test case 4: an empty cluster is split from the largest cluster", func() {
+			km := NewWithOptions(3, 10, 0)
+			members := [][]int32{{0, 1, 2, 3}, {}, {4}}
+			centers := []mat.VecDense{*mat.NewVecDense(2, []float64{2, 4}), *mat.NewVecDense(2, []float64{0, 0}), *mat.NewVecDense(2, []float64{9, 9})}
+			So(km.split_clusters(members, centers), ShouldEqual, 1)
+			So(centers[1].RawVector().Data, ShouldResemble, []float64{2 * (1 + split_eps), 4 * (1 - split_eps)})
+			So(centers[0].RawVector().Data, ShouldResemble, []float64{2 * (1 - split_eps), 4 * (1 + split_eps)})
+			So(centers[2].RawVector().Data, ShouldResemble, []float64{9, 9})
+
+			// the 3 initial centroids are the same vector, so 2 clusters are split from the first one
+			var same []mat.VecDense
+			for _, v := range []float64{1, 1, 1, 1.2, 1.2, 1.2, 10} {
+				same = append(same, *mat.NewVecDense(1, []float64{v}))
+			}
+			km = NewWithOptions(3, 10, 0, WithSeed(2))
+			So(km.init_centroids(km.new_rand(), same), ShouldResemble, []int32{1, 0, 2})
+			clusters, err := km.Train(same, 1)
+			So(err, ShouldBeNil)
+			sizes := []int32{}
+			for l := range clusters {
+				sizes = append(sizes, clusters[l].Size())
+			}
+			So(sizes, ShouldResemble, []int32{3, 1, 3})
+			So(len(km.Stats()), ShouldBeLessThan, 10)
+		})
+
+		Convey("test case 5: invalid nlist", func() {
+			// more clusters than vectors, and no cluster
+			for _, nlist := range []int32{1001, 0, -1} {
+				km := NewWithOptions(nlist, 20, 0.001, WithSeed(42))
+				clusters, err := km.Train(vecs, 3)
+				So(clusters, ShouldBeNil)
+				So(errors.Is(err, ErrInvalidParameter), ShouldBeTrue)
+			}
+		})
+
+		Convey("test case 6: every vector is in the cluster of its nearest centroid", func() {
+			// one iteration stops before the clusters match the updated centroids
+			for _, max_points := range []int{0, 40} {
+				km := NewWithOptions(5, 1, 0, WithSeed(42), WithMaxPointsPerCentroid(max_points))
+				clusters, err := km.Train(vecs, 3)
+				So(err, ShouldBeNil)
+				for l := range clusters {
+					for j, ok := range clusters[l].VecIdxs() {
+						if !ok {
+							continue
+						}
+						for m := range clusters {
+							So(l2_distance_sqr(vecs[j].RawVector().Data, clusters[l].Center().RawVector().Data), ShouldBeLessThanOrEqualTo,
+								l2_distance_sqr(vecs[j].RawVector().Data, clusters[m].Center().RawVector().Data))
+						}
+					}
+				}
+			}
+		})
+
+		Convey("test case 7: mini-batch", func() {
+			km := NewWithOptions(5, 20, 0.001, WithSeed(42), WithInit(INIT_KMEANS_PLUS_PLUS))
+			_, err := km.TrainMiniBatch(NewSliceReader(vecs), 3, 100)
+			So(err, ShouldBeNil)
+			stats := km.Stats()
+			So(len(stats), ShouldBeBetweenOrEqual, 1, 20)
+			So(stats[len(stats)-1].Inertia, ShouldBeLessThanOrEqualTo, stats[0].Inertia)
+
+			// the iterations stop once the centroids barely move, there is no per vector assignment
+			last := stats[len(stats)-1]
+			So(last.VecAdjustNum, ShouldEqual, 0)
+			So(last.CentroidShift, ShouldBeLessThan, stats[0].CentroidShift)
+			if len(stats) < 20 {
+				So(last.CentroidShift/5, ShouldBeLessThanOrEqualTo, 0.001*last.Inertia/100)
+			}
+		})
+	})
+}
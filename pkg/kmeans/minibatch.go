@@ -0,0 +1,238 @@
+package kmeans
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// number of vectors read at once by Skip to skip the vectors of a VecReader which is not a VecSkipper
+const SKIP_BLOCK = 1024
+
+// VecReader is a stream of training vectors which may not fit in memory, eg. read from a file
+type VecReader interface {
+	// Read returns the next vectors of the stream, at most n, and io.EOF with no vectors at the end of the stream
+	Read(n int) ([]mat.VecDense, error)
+	// Reset rewinds the stream to its first vector
+	Reset() error
+}
+
+// VecSkipper is implemented by the VecReaders which can skip vectors without reading them, eg. by seeking in a file
+type VecSkipper interface {
+	// Skip skips the next n vectors of the stream, or up to the end of the stream
+	Skip(n int) error
+}
+
+// Skip skips the next n vectors of r with r.Skip if r is a VecSkipper, else it reads them and drops them
+func Skip(r VecReader, n int) error {
+	if s, ok := r.(VecSkipper); ok {
+		return s.Skip(n)
+	}
+
+	for n > 0 {
+		vecs, err := r.Read(min(n, SKIP_BLOCK))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(vecs) == 0 {
+			// a reader which returns no vectors before io.EOF would never end
+			return io.ErrUnexpectedEOF
+		}
+		n -= len(vecs)
+	}
+
+	return nil
+}
+
+type slice_reader struct {
+	vecs []mat.VecDense
+	pos  int
+}
+
+// NewSliceReader returns a VecReader of the vectors in memory, it is a VecSkipper
+func NewSliceReader(vecs []mat.VecDense) VecReader {
+	return &slice_reader{vecs: vecs}
+}
+
+func (sr *slice_reader) Read(n int) ([]mat.VecDense, error) {
+	if sr.pos >= len(sr.vecs) {
+		return nil, io.EOF
+	}
+
+	end := min(sr.pos+n, len(sr.vecs))
+	vecs := sr.vecs[sr.pos:end]
+	sr.pos = end
+	return vecs, nil
+}
+
+func (sr *slice_reader) Reset() error {
+	sr.pos = 0
+	return nil
+}
+
+func (sr *slice_reader) Skip(n int) error {
+	sr.pos = min(sr.pos+n, len(sr.vecs))
+	return nil
+}
+
+// TrainMiniBatch trains the nlist centroids on a stream of vectors which may not fit in memory, it returns the
+// centroids. The first pass counts the vectors and samples max(batch_size, nlist) of them for the init method by
+// reservoir sampling. Then every iteration is a step on a batch of batch_size vectors drawn at random positions of
+// the stream, the stream is read up to the last of them and the vectors in between are skipped, see VecSkipper.
+// The batch is assigned to the centroids and every centroid moves towards its vectors with a learning rate of
+// 1 / the number of vectors it got so far. The memory does not depend on the number of vectors of the stream.
+// The iterations stop when the centroids barely move: the mean of their squared shifts over a step is at most
+// delta_threshold times the mean squared distance of the vectors of the batch to their centroid.
+func (km *KMeans) TrainMiniBatch(r VecReader, dim int32, batch_size int) ([]mat.VecDense, error) {
+	km.stats = nil
+	if batch_size <= 0 || km.nlist <= 0 {
+		return nil, ErrInvalidParameter
+	}
+
+	// step 1. Count the vectors and sample the vectors of the init method by reservoir sampling
+	rng := km.new_rand()
+	sample_size := max(batch_size, int(km.nlist))
+	sample := make([]mat.VecDense, 0, sample_size)
+	vec_size := 0
+	err := read_batches(r, dim, batch_size, func(batch []mat.VecDense) {
+		for i := range batch {
+			if len(sample) < sample_size {
+				sample = append(sample, *mat.VecDenseCopyOf(&batch[i]))
+			} else if j := rng.Intn(vec_size + 1); j < sample_size {
+				sample[j] = *mat.VecDenseCopyOf(&batch[i])
+			}
+			vec_size++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if vec_size < int(km.nlist) {
+		return nil, fmt.Errorf("%d vectors for %d clusters: %w", vec_size, km.nlist, ErrInvalidParameter)
+	}
+
+	centroid_idxs := km.init_centroids(rng, sample)
+	centers := make([]mat.VecDense, km.nlist)
+	for i := range centers {
+		centers[i] = *mat.VecDenseCopyOf(&sample[centroid_idxs[i]])
+		if km.spherical {
+			centers[i] = normalize(centers[i])
+		}
+	}
+
+	// step 2. Iterate until convergence: reach interation limit or centroid shift lower than threshold
+	counts := make([]float64, km.nlist) // number of vectors a centroid got over all the batches
+	for i := int32(0); i < km.max_iterations; i++ {
+		start := time.Now()
+
+		// step 2.1. draw a batch at random positions of the stream and assign it to the centroids
+		positions := sample_without_replacement(rng, int32(vec_size), int32(min(batch_size, vec_size)))
+		sort.Slice(positions, func(a, b int) bool { return positions[a] < positions[b] })
+		batch, err := read_positions(r, dim, positions)
+		if err != nil {
+			return nil, err
+		}
+		batch_assign := make([]int32, len(batch))
+		for j := range batch_assign {
+			batch_assign[j] = -1
+		}
+		_, inertia := km.assign_vecs(batch, dim, centers, batch_assign)
+
+		// step 2.2. move every centroid towards the vectors of the batch, in the order of the stream
+		moved := make([][]float64, km.nlist) // centroids before the step, nil if they do not move
+		for j, c := range batch_assign {
+			center := centers[c].RawVector().Data
+			if moved[c] == nil {
+				moved[c] = append([]float64(nil), center...)
+			}
+			counts[c]++
+			eta := 1 / counts[c]
+			floats.Scale(1-eta, center)
+			floats.AddScaled(center, eta, batch[j].RawVector().Data)
+		}
+		shift := 0.0
+		for c := range centers {
+			if moved[c] == nil {
+				continue
+			}
+			if km.spherical {
+				centers[c] = normalize(centers[c])
+			}
+			shift += l2_distance_sqr(moved[c], centers[c].RawVector().Data)
+		}
+		km.log_iteration(IterationStats{Iteration: i, Inertia: inertia, CentroidShift: shift, Time: time.Since(start)})
+
+		// break if the centroids move less than the threshold of the spread of the batch around them
+		if shift/float64(km.nlist) <= km.delta_threshold*inertia/float64(len(batch)) {
+			break
+		}
+	}
+
+	return centers, nil
+}
+
+// read_positions rewinds r and reads copies of the vectors at the ascending positions, skipping the others
+func read_positions(r VecReader, dim int32, positions []int32) ([]mat.VecDense, error) {
+	if err := r.Reset(); err != nil {
+		return nil, err
+	}
+
+	vecs := make([]mat.VecDense, 0, len(positions))
+	pos := 0
+	for _, p := range positions {
+		if err := Skip(r, int(p)-pos); err != nil {
+			return nil, err
+		}
+		batch, err := r.Read(1)
+		if err == io.EOF {
+			// the stream should not shrink between the passes
+			return nil, fmt.Errorf("no vector at position %d: %w", p, ErrInvalidParameter)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if batch[0].Len() != int(dim) {
+			return nil, ErrDimensionMismatch
+		}
+		vecs = append(vecs, *mat.VecDenseCopyOf(&batch[0]))
+		pos = int(p) + 1
+	}
+
+	return vecs, nil
+}
+
+// read_batches rewinds r and calls fn on its vectors by batches of at most batch_size vectors
+func read_batches(r VecReader, dim int32, batch_size int, fn func(batch []mat.VecDense)) error {
+	if err := r.Reset(); err != nil {
+		return err
+	}
+
+	for {
+		batch, err := r.Read(batch_size)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		for i := range batch {
+			if batch[i].Len() != int(dim) {
+				return ErrDimensionMismatch
+			}
+		}
+		fn(batch)
+	}
+}
@@ -0,0 +1,120 @@
+package kmeans
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gonum.org/v1/gonum/mat"
+)
+
+// failing_reader fails after the first batch
+type failing_reader struct {
+	VecReader
+	read int
+}
+
+var errRead = errors.New("read error")
+
+func (fr *failing_reader) Read(n int) ([]mat.VecDense, error) {
+	fr.read++
+	if fr.read > 1 {
+		return nil, errRead
+	}
+	return fr.VecReader.Read(n)
+}
+
+// empty_reader returns no vectors and no error after its first pass, against the contract of VecReader
+type empty_reader struct {
+	VecReader
+	resets int
+}
+
+func (er *empty_reader) Reset() error {
+	er.resets++
+	return er.VecReader.Reset()
+}
+
+func (er *empty_reader) Read(n int) ([]mat.VecDense, error) {
+	if er.resets > 1 {
+		return nil, nil
+	}
+	return er.VecReader.Read(n)
+}
+
+func TestKMeans_TrainMiniBatch(t *testing.T) {
+	centers := [][]float64{{0, 0, 0}, {100, 0, 0}, {0, 100, 0}, {0, 0, 100}, {100, 100, 100}}
+	vecs := blobs(centers, 200, 1)
+	// interleave the blobs, the stream should not be sorted by cluster
+	stream := make([]mat.VecDense, 0, len(vecs))
+	for i := 0; i < 200; i++ {
+		for b := range centers {
+			stream = append(stream, vecs[b*200+i])
+		}
+	}
+
+	Convey("KMeans_TrainMiniBatch", t, func() {
+		// define test cases
+		tests := []struct {
+			name       string
+			batch_size int
+			method     InitMethod
+		}{
+			{name: "test case 1: small batches", batch_size: 16, method: INIT_KMEANS_PLUS_PLUS},
+			{name: "test case 2: one batch", batch_size: 1000, method: INIT_KMEANS_PLUS_PLUS},
+			{name: "test case 3: k-means||", batch_size: 100, method: INIT_KMEANS_PARALLEL},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				km := NewWithOptions(5, 10, 0.001, WithInit(tt.method), WithSeed(42))
+				got, err := km.TrainMiniBatch(NewSliceReader(stream), 3, tt.batch_size)
+				So(err, ShouldBeNil)
+				So(len(got), ShouldEqual, 5)
+
+				// every blob gets one centroid close to its center
+				blob_seen := make(map[int]bool)
+				for i := range got {
+					for b, c := range centers {
+						if l2_distance_sqr(got[i].RawVector().Data, c) < 25 {
+							blob_seen[b] = true
+						}
+					}
+				}
+				So(len(blob_seen), ShouldEqual, 5)
+
+				// the same seed gives the same centroids
+				again, err := km.TrainMiniBatch(NewSliceReader(stream), 3, tt.batch_size)
+				So(err, ShouldBeNil)
+				So(again, ShouldResemble, got)
+
+				// a reader which cannot skip reads the skipped vectors instead, the batches are the same
+				no_skip := struct{ VecReader }{NewSliceReader(stream)}
+				again, err = km.TrainMiniBatch(no_skip, 3, tt.batch_size)
+				So(err, ShouldBeNil)
+				So(again, ShouldResemble, got)
+			})
+		}
+
+		Convey("test case 4: errors", func() {
+			km := NewWithOptions(5, 10, 0.001, WithSeed(1))
+			_, err := km.TrainMiniBatch(NewSliceReader(stream), 3, 0)
+			So(errors.Is(err, ErrInvalidParameter), ShouldBeTrue)
+			_, err = km.TrainMiniBatch(NewSliceReader(stream[:4]), 3, 16)
+			So(errors.Is(err, ErrInvalidParameter), ShouldBeTrue)
+			_, err = km.TrainMiniBatch(NewSliceReader(stream), 2, 16)
+			So(errors.Is(err, ErrDimensionMismatch), ShouldBeTrue)
+			_, err = km.TrainMiniBatch(&failing_reader{VecReader: NewSliceReader(stream)}, 3, 16)
+			So(errors.Is(err, errRead), ShouldBeTrue)
+
+			// an empty read is the end of a truncated stream, skipping or reading it does not loop forever
+			_, err = km.TrainMiniBatch(&empty_reader{VecReader: NewSliceReader(stream)}, 3, 16)
+			So(errors.Is(err, io.ErrUnexpectedEOF), ShouldBeTrue)
+			_, err = km.TrainMiniBatch(&empty_reader{VecReader: NewSliceReader(stream), resets: 1}, 3, 16)
+			So(errors.Is(err, io.ErrUnexpectedEOF), ShouldBeTrue)
+			So(errors.Is(Skip(&empty_reader{VecReader: NewSliceReader(stream), resets: 2}, 10), io.ErrUnexpectedEOF), ShouldBeTrue)
+		})
+	})
+}
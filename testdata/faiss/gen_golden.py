@@ -0,0 +1,77 @@
+#!/usr/bin/env python3
+# Generates the small Faiss index files used by faiss_io_test.go with faiss.write_index, so the Go reader and
+# writer are checked against the files written by Faiss itself. It replaces the files packed by hand by
+# pack_golden.py, which are the ones checked in until this script is run with Faiss.
+#
+# Requires the Faiss Python package and numpy, eg. pip install faiss-cpu numpy, then run it in this directory.
+# The indexes are not trained: their centroids, codes and graph are set explicitly, so the files only depend on
+# the serialization of Faiss.
+import faiss
+import numpy as np
+
+
+def f32(values):
+    return np.array(values, dtype="float32")
+
+
+vecs = f32([[0.5, 1.25, -2.0, 3.0], [-1.5, 0.25, 4.0, -0.75], [2.0, -3.5, 0.125, 1.0]])
+
+index = faiss.IndexFlatL2(4)
+index.add(vecs)
+faiss.write_index(index, "flat_l2.faissindex")
+
+index = faiss.IndexFlatIP(4)
+index.add(vecs)
+faiss.write_index(index, "flat_ip.faissindex")
+
+# IndexIVFFlat: 2 lists, the vectors are assigned to their nearest centroid, so the lists are [0, 2] and [1, 3]
+quantizer = faiss.IndexFlatL2(2)
+quantizer.add(f32([[0.0, 0.0], [10.0, 10.0]]))
+index = faiss.IndexIVFFlat(quantizer, 2, 2, faiss.METRIC_L2)
+index.is_trained = True
+index.add(f32([[0.0, 1.0], [10.0, 11.0], [1.0, 0.0], [11.0, 10.0]]))
+faiss.write_index(index, "ivf_flat.faissindex")
+
+# IndexPQ: d = 4, M = 2, nbits = 2, so 4 centroids of dimension 2 per sub-quantizer and 1 byte per code.
+# The vectors added are the decoded codes, so they are encoded back to the same codes.
+pq_centroids = f32([float(i) / 4 for i in range(2 * 4 * 2)])
+pq_codes = np.array([[1 | 2 << 2], [3 | 0 << 2], [0 | 1 << 2]], dtype="uint8")
+index = faiss.IndexPQ(4, 2, 2)
+faiss.copy_array_to_vector(pq_centroids, index.pq.centroids)
+index.is_trained = True
+index.add(index.sa_decode(pq_codes))
+faiss.write_index(index, "pq.faissindex")
+
+# IndexIVFPQ: 4 lists with 2 non empty ones, so the sizes are stored sparse. The vectors are added to given lists
+# with add_core, a vector is the centroid of its list plus the decoded code of its residual.
+quantizer = faiss.IndexFlatL2(4)
+quantizer.add(f32([[0.0] * 4, [1.0] * 4, [2.0] * 4, [3.0] * 4]))
+index = faiss.IndexIVFPQ(quantizer, 4, 4, 2, 2)
+faiss.copy_array_to_vector(pq_centroids, index.pq.centroids)
+index.is_trained = True
+list_nos = np.array([1, 3, 1], dtype="int64")
+residuals = index.pq.decode(np.array([[9], [4], [3]], dtype="uint8"))
+x = np.ascontiguousarray(residuals + quantizer.reconstruct_n(0, 4)[list_nos])
+ids = np.arange(3, dtype="int64")
+index.add_core(3, faiss.swig_ptr(x), faiss.swig_ptr(ids), faiss.swig_ptr(list_nos))
+faiss.write_index(index, "ivf_pq.faissindex")
+
+# IndexHNSWFlat: M = 2, 3 nodes, node 1 is on layers 0 and 1 and is the entry point.
+# The graph is set explicitly instead of being built with the random levels of Faiss.
+index = faiss.IndexHNSWFlat(2, 2)
+index.storage.add(f32([[0.0, 0.0], [1.0, 1.0], [2.0, 0.0]]))
+index.ntotal = 3
+hnsw = index.hnsw
+levels = [1, 2, 1]
+offsets = [0]
+for level in levels:
+    offsets.append(offsets[-1] + hnsw.cum_nb_neighbors(level))
+faiss.copy_array_to_vector(np.array(levels, dtype="int32"), hnsw.levels)
+faiss.copy_array_to_vector(np.array(offsets, dtype="uint64"), hnsw.offsets)
+neighbors = [1, 2, -1, -1] + [0, 2, -1, -1] + [-1, -1] + [0, 1, -1, -1]
+faiss.copy_array_to_vector(np.array(neighbors, dtype="int32"), hnsw.neighbors)
+hnsw.entry_point = 1
+hnsw.max_level = 1
+hnsw.efConstruction = 40
+hnsw.efSearch = 16
+faiss.write_index(index, "hnsw_flat.faissindex")
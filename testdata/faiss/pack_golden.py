@@ -0,0 +1,145 @@
+#!/usr/bin/env python3
+# Packs the small Faiss index files used by faiss_io_test.go by hand, until they are regenerated by Faiss itself
+# with gen_golden.py.
+#
+# Faiss is not required: the files are written with struct following the layout of
+# faiss/impl/index_write.cpp (write_index_header, WRITEVECTOR, write_ProductQuantizer,
+# write_ivf_header, write_InvertedLists, write_HNSW), independently of the Go writer.
+import math
+import struct
+
+METRIC_INNER_PRODUCT = 0
+METRIC_L2 = 1
+
+
+def u8(v):
+    return struct.pack("<B", v)
+
+
+def i32(v):
+    return struct.pack("<i", v)
+
+
+def i64(v):
+    return struct.pack("<q", v)
+
+
+def u64(v):
+    return struct.pack("<Q", v)
+
+
+def vector(fmt, values):
+    return u64(len(values)) + b"".join(struct.pack("<" + fmt, v) for v in values)
+
+
+def header(d, ntotal, metric):
+    return i32(d) + i64(ntotal) + i64(1 << 20) + i64(1 << 20) + u8(1) + i32(metric)
+
+
+def flat(vecs, d, metric):
+    fourcc = b"IxF2" if metric == METRIC_L2 else b"IxFI"
+    floats = [x for v in vecs for x in v]
+    # WRITEXBVECTOR: number of floats, then the float32 data
+    return fourcc + header(d, len(vecs), metric) + vector("f", floats)
+
+
+def pq(d, m, nbits, centroids):
+    return u64(d) + u64(m) + u64(nbits) + vector("f", centroids)
+
+
+def ivf_header(d, ntotal, centroids):
+    direct_map = u8(0) + vector("q", [])
+    return header(d, ntotal, METRIC_L2) + u64(len(centroids)) + u64(1) + flat(centroids, d, METRIC_L2) + direct_map
+
+
+def invlists(code_size, lists):
+    nlist = len(lists)
+    out = b"ilar" + u64(nlist) + u64(code_size)
+    non_empty = [i for i, (ids, _) in enumerate(lists) if ids]
+    if len(non_empty) > nlist // 2:
+        out += b"full" + vector("Q", [len(ids) for ids, _ in lists])
+    else:
+        sizes = []
+        for i in non_empty:
+            sizes += [i, len(lists[i][0])]
+        out += b"sprs" + vector("Q", sizes)
+    for ids, codes in lists:
+        if ids:
+            out += codes + b"".join(i64(id) for id in ids)
+    return out
+
+
+def f32(v):
+    return struct.unpack("<f", struct.pack("<f", v))[0]
+
+
+def write(name, data):
+    with open(name, "wb") as f:
+        f.write(data)
+
+
+vecs = [[0.5, 1.25, -2.0, 3.0], [-1.5, 0.25, 4.0, -0.75], [2.0, -3.5, 0.125, 1.0]]
+write("flat_l2.faissindex", flat(vecs, 4, METRIC_L2))
+write("flat_ip.faissindex", flat(vecs, 4, METRIC_INNER_PRODUCT))
+
+# IndexIVFFlat: 2 lists, the codes are the float32 vectors
+ivf_vecs = {0: [0.0, 1.0], 1: [10.0, 11.0], 2: [1.0, 0.0], 3: [11.0, 10.0]}
+ivf_lists = [[0, 2], [1, 3]]
+write(
+    "ivf_flat.faissindex",
+    b"IwFl"
+    + ivf_header(2, 4, [[0.0, 0.0], [10.0, 10.0]])
+    + invlists(8, [(ids, b"".join(struct.pack("<2f", *ivf_vecs[id]) for id in ids)) for ids in ivf_lists]),
+)
+
+# IndexPQ: d = 4, M = 2, nbits = 2, so 4 centroids of dimension 2 per sub-quantizer and 1 byte per code
+pq_centroids = [float(i) / 4 for i in range(2 * 4 * 2)]
+pq_codes = bytes([1 | 2 << 2, 3 | 0 << 2, 0 | 1 << 2])
+write(
+    "pq.faissindex",
+    b"IxPq" + header(4, 3, METRIC_L2) + pq(4, 2, 2, pq_centroids) + vector("B", pq_codes)
+    # search_type, encode_signs, polysemous_ht
+    + i32(0) + u8(0) + i32(2 * 2 + 1),
+)
+
+# IndexIVFPQ: 4 lists with 2 non empty ones, so the sizes are stored sparse
+write(
+    "ivf_pq.faissindex",
+    b"IwPQ"
+    + ivf_header(4, 3, [[0.0] * 4, [1.0] * 4, [2.0] * 4, [3.0] * 4])
+    + u8(1) + u64(1)  # by_residual, code_size
+    + pq(4, 2, 2, pq_centroids)
+    + invlists(1, [([], b""), ([0, 2], bytes([9, 3])), ([], b""), ([1], bytes([4]))]),
+)
+
+# IndexHNSWFlat: M = 2, 3 nodes, node 1 is on layers 0 and 1 and is the entry point
+hnsw_m = 2
+# HNSW::set_default_probas takes levelMult as a float, divides in float and stores every proba in a float
+level_mult = f32(1 / math.log(hnsw_m))
+assign_probas, cum_nneighbor_per_level = [], [0]
+level = 0
+while True:
+    proba = f32(math.exp(f32(-level / level_mult)) * (1 - math.exp(f32(-1 / level_mult))))
+    if proba < 1e-9:
+        break
+    assign_probas.append(proba)
+    cum_nneighbor_per_level.append(cum_nneighbor_per_level[-1] + (2 * hnsw_m if level == 0 else hnsw_m))
+    level += 1
+levels = [1, 2, 1]
+offsets = [0]
+for l in levels:
+    offsets.append(offsets[-1] + cum_nneighbor_per_level[l])
+neighbors = [1, 2, -1, -1] + [0, 2, -1, -1] + [-1, -1] + [0, 1, -1, -1]
+hnsw_vecs = [[0.0, 0.0], [1.0, 1.0], [2.0, 0.0]]
+write(
+    "hnsw_flat.faissindex",
+    b"IHNf"
+    + header(2, 3, METRIC_L2)
+    + vector("d", assign_probas)
+    + vector("i", cum_nneighbor_per_level)
+    + vector("i", levels)
+    + vector("Q", offsets)
+    + vector("i", neighbors)
+    + i32(1) + i32(1) + i32(40) + i32(16) + i32(1)  # entry_point, max_level, efConstruction, efSearch, upper_beam
+    + flat(hnsw_vecs, 2, METRIC_L2),
+)
@@ -3,25 +3,103 @@ package utils
 import (
 	"math"
 
+	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
 )
 
+// L2Distance returns the L2(Euclidean) distance of a and b, it panics with mat.ErrShape if their lengths differ
 func L2Distance(a, b mat.VecDense) float64 {
+	if x, y, ok := contiguous(a, b); ok {
+		return L2DistanceT(x, y)
+	}
+
 	diff := mat.NewVecDense(a.Len(), nil)
 	diff.SubVec(&a, &b)
-	dot := mat.Dot(diff, diff)
-	distance := math.Sqrt(dot)
-
-	return distance
+	return math.Sqrt(mat.Dot(diff, diff))
 }
 
+// InnerProductDistance returns the inner product of a and b, it panics with mat.ErrShape if their lengths differ
 func InnerProductDistance(a, b mat.VecDense) float64 {
+	if x, y, ok := contiguous(a, b); ok {
+		return InnerProductT(x, y)
+	}
+
 	return mat.Dot(&a, &b)
 }
 
+// CosineDistance returns the cosine similarity of a and b, it panics with mat.ErrShape if their lengths differ
 func CosineDistance(a, b mat.VecDense) float64 {
-	dot := mat.Dot(&a, &b)
-	norm_a := mat.Norm(&a, 2)
-	norm_b := mat.Norm(&b, 2)
-	return dot / (norm_a * norm_b)
+	if x, y, ok := contiguous(a, b); ok {
+		return CosineDistanceT(x, y)
+	}
+
+	return mat.Dot(&a, &b) / (mat.Norm(&a, 2) * mat.Norm(&b, 2))
+}
+
+// contiguous returns the elements of a and b for the generic kernels if both are stored contiguously, eg. not
+// the column views of a matrix, which are computed by gonum
+func contiguous(a, b mat.VecDense) ([]float64, []float64, bool) {
+	if a.Len() != b.Len() {
+		panic(mat.ErrShape)
+	}
+
+	raw_a, raw_b := a.RawVector(), b.RawVector()
+	if raw_a.Inc != 1 || raw_b.Inc != 1 {
+		return nil, nil, false
+	}
+
+	return raw_a.Data[:a.Len()], raw_b.Data[:b.Len()], true
+}
+
+// InnerProductMatrix returns the nq x nb matrix of inner products between the rows of q (nq x d) and the rows of x (nb x d),
+// computed with a single matrix multiplication (BLAS GEMM)
+func InnerProductMatrix(q, x *mat.Dense) *mat.Dense {
+	nq, _ := q.Dims()
+	nb, _ := x.Dims()
+
+	ip := mat.NewDense(nq, nb, nil)
+	ip.Mul(q, x.T())
+
+	return ip
+}
+
+// L2DistanceMatrix returns the nq x nb matrix of L2 distances between the rows of q and the rows of x,
+// using the identity ||q - x||^2 = ||q||^2 + ||x||^2 - 2 * <q, x> so that the costly part is a GEMM
+func L2DistanceMatrix(q, x *mat.Dense) *mat.Dense {
+	q_norms := row_norms_sqr(q)
+	x_norms := row_norms_sqr(x)
+
+	distance := InnerProductMatrix(q, x)
+	distance.Apply(func(i, j int, ip float64) float64 {
+		// rounding errors may produce small negative values for identical vectors
+		return math.Sqrt(math.Max(q_norms[i]+x_norms[j]-2*ip, 0))
+	}, distance)
+
+	return distance
+}
+
+// CosineDistanceMatrix returns the nq x nb matrix of cosine similarities between the rows of q and the rows of x
+func CosineDistanceMatrix(q, x *mat.Dense) *mat.Dense {
+	q_norms := row_norms_sqr(q)
+	x_norms := row_norms_sqr(x)
+
+	distance := InnerProductMatrix(q, x)
+	distance.Apply(func(i, j int, ip float64) float64 {
+		return ip / math.Sqrt(q_norms[i]*x_norms[j])
+	}, distance)
+
+	return distance
+}
+
+// row_norms_sqr returns the squared L2 norm of every row of m
+func row_norms_sqr(m *mat.Dense) []float64 {
+	rows, _ := m.Dims()
+
+	norms := make([]float64, rows)
+	for i := range norms {
+		row := m.RawRowView(i)
+		norms[i] = floats.Dot(row, row)
+	}
+
+	return norms
 }
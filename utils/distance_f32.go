@@ -0,0 +1,59 @@
+package utils
+
+import "math"
+
+// float32 kernels over raw slices, they are used by the contiguous float32 storage where the vectors are not VecDense.
+// the sums are accumulated in 4 lanes so the loop is not bound by the latency of a single add.
+
+// L2DistanceSqrF32 returns the squared L2(Euclidean) distance of a and b, len(a) must equal len(b)
+func L2DistanceSqrF32(a, b []float32) float32 {
+	b = b[:len(a)]
+
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		d0 := a[i] - b[i]
+		d1 := a[i+1] - b[i+1]
+		d2 := a[i+2] - b[i+2]
+		d3 := a[i+3] - b[i+3]
+		s0 += d0 * d0
+		s1 += d1 * d1
+		s2 += d2 * d2
+		s3 += d3 * d3
+	}
+	for ; i < len(a); i++ {
+		d := a[i] - b[i]
+		s0 += d * d
+	}
+
+	return (s0 + s1) + (s2 + s3)
+}
+
+// L2DistanceF32 returns the L2(Euclidean) distance of a and b
+func L2DistanceF32(a, b []float32) float32 {
+	return float32(math.Sqrt(float64(L2DistanceSqrF32(a, b))))
+}
+
+// InnerProductF32 returns the inner product of a and b, len(a) must equal len(b)
+func InnerProductF32(a, b []float32) float32 {
+	b = b[:len(a)]
+
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+
+	return (s0 + s1) + (s2 + s3)
+}
+
+// CosineDistanceF32 returns the cosine similarity of a and b
+func CosineDistanceF32(a, b []float32) float32 {
+	return InnerProductF32(a, b) / float32(math.Sqrt(float64(InnerProductF32(a, a)))*math.Sqrt(float64(InnerProductF32(b, b))))
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestDistanceF32(t *testing.T) {
+	Convey("DistanceF32", t, func() {
+		// 7 elements, so the tail after the unrolled loop is covered too
+		a := []float32{1, 2, 3, 4, -1, 0.5, 2}
+		b := []float32{0, -1, 2, -2, 3, 3, 0.25}
+		to_vec := func(x []float32) mat.VecDense {
+			data := make([]float64, len(x))
+			for i := range x {
+				data[i] = float64(x[i])
+			}
+			return *mat.NewVecDense(len(data), data)
+		}
+
+		// define test cases
+		tests := []struct {
+			name string
+			f32  func(a, b []float32) float32
+			f64  func(a, b mat.VecDense) float64
+		}{
+			{name: "test case 1: L2DistanceF32", f32: L2DistanceF32, f64: L2Distance},
+			{name: "test case 2: InnerProductF32", f32: InnerProductF32, f64: InnerProductDistance},
+			{name: "test case 3: CosineDistanceF32", f32: CosineDistanceF32, f64: CosineDistance},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				So(float64(tt.f32(a, b)), ShouldAlmostEqual, tt.f64(to_vec(a), to_vec(b)), 1e-5)
+			})
+		}
+
+		Convey("test case 4: L2DistanceSqrF32", func() {
+			So(L2DistanceSqrF32(a, b), ShouldAlmostEqual, L2DistanceF32(a, b)*L2DistanceF32(a, b), 1e-4)
+			So(L2DistanceSqrF32(a, a), ShouldEqual, 0)
+		})
+	})
+}
+
+func BenchmarkL2DistanceF32(b *testing.B) {
+	x := make([]float32, 768)
+	y := make([]float32, 768)
+	for i := range x {
+		x[i] = float32(i) / 768
+		y[i] = 1 - x[i]
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = L2DistanceSqrF32(x, y)
+	}
+}
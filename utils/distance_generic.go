@@ -0,0 +1,92 @@
+package utils
+
+import "math"
+
+// Element is the element type of the vectors the generic kernels work on: float32, float64, half-precision floats
+// and int8-quantized values. The distances are always returned as float64.
+type Element interface {
+	~float32 | ~float64 | ~int8 | Float16
+}
+
+// L2DistanceSqrT returns the squared L2(Euclidean) distance of a and b, len(a) must equal len(b)
+func L2DistanceSqrT[T Element](a, b []T) float64 {
+	// float32 and float16 have their own kernels, the other types are accumulated in float64
+	switch a := any(a).(type) {
+	case []float32:
+		return float64(L2DistanceSqrF32(a, any(b).([]float32)))
+	case []Float16:
+		return float64(l2_distance_sqr_f16(a, any(b).([]Float16)))
+	}
+
+	b = b[:len(a)]
+	var s float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		s += d * d
+	}
+	return s
+}
+
+// L2DistanceT returns the L2(Euclidean) distance of a and b
+func L2DistanceT[T Element](a, b []T) float64 {
+	return math.Sqrt(L2DistanceSqrT(a, b))
+}
+
+// InnerProductT returns the inner product of a and b, len(a) must equal len(b)
+func InnerProductT[T Element](a, b []T) float64 {
+	switch a := any(a).(type) {
+	case []float32:
+		return float64(InnerProductF32(a, any(b).([]float32)))
+	case []Float16:
+		return float64(inner_product_f16(a, any(b).([]Float16)))
+	}
+
+	b = b[:len(a)]
+	var s float64
+	for i := range a {
+		s += float64(a[i]) * float64(b[i])
+	}
+	return s
+}
+
+// CosineDistanceT returns the cosine similarity of a and b
+func CosineDistanceT[T Element](a, b []T) float64 {
+	return InnerProductT(a, b) / (math.Sqrt(InnerProductT(a, a)) * math.Sqrt(InnerProductT(b, b)))
+}
+
+// ToFloat64 returns a float64 copy of x
+func ToFloat64[T Element](x []T) []float64 {
+	y := make([]float64, len(x))
+	if h, ok := any(x).([]Float16); ok {
+		for i := range h {
+			y[i] = float64(h[i].Float32())
+		}
+		return y
+	}
+
+	for i := range x {
+		y[i] = float64(x[i])
+	}
+	return y
+}
+
+func l2_distance_sqr_f16(a, b []Float16) float32 {
+	b = b[:len(a)]
+
+	var s float32
+	for i := range a {
+		d := a[i].Float32() - b[i].Float32()
+		s += d * d
+	}
+	return s
+}
+
+func inner_product_f16(a, b []Float16) float32 {
+	b = b[:len(a)]
+
+	var s float32
+	for i := range a {
+		s += a[i].Float32() * b[i].Float32()
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDistanceT(t *testing.T) {
+	Convey("DistanceT", t, func() {
+		// small integers are exact in every element type
+		a := []float64{1, 2, 3, 4, -1, 5, 2}
+		b := []float64{0, -1, 2, -2, 3, 3, 7}
+		want := []float64{L2DistanceT(a, b), InnerProductT(a, b), CosineDistanceT(a, b)}
+		So(want[0]*want[0], ShouldAlmostEqual, 3*3+1+1+6*6+4*4+2*2+5*5)
+		So(want[1], ShouldEqual, 0-2+6-8-3+15+14)
+
+		// define test cases
+		tests := []struct {
+			name string
+			got  []float64
+		}{
+			{
+				name: "test case 1: float32",
+				got:  distances_t(to_t(a, func(x float64) float32 { return float32(x) }), to_t(b, func(x float64) float32 { return float32(x) })),
+			},
+			{
+				name: "test case 2: float16",
+				got:  distances_t(to_t(a, func(x float64) Float16 { return NewFloat16(float32(x)) }), to_t(b, func(x float64) Float16 { return NewFloat16(float32(x)) })),
+			},
+			{
+				name: "test case 3: int8",
+				got:  distances_t(to_t(a, func(x float64) int8 { return int8(x) }), to_t(b, func(x float64) int8 { return int8(x) })),
+			},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				for i := range want {
+					So(tt.got[i], ShouldAlmostEqual, want[i], 1e-6)
+				}
+			})
+		}
+
+		Convey("test case 4: ToFloat64", func() {
+			So(ToFloat64([]Float16{NewFloat16(1.5), NewFloat16(-3)}), ShouldResemble, []float64{1.5, -3})
+			So(ToFloat64([]int8{-128, 127}), ShouldResemble, []float64{-128, 127})
+		})
+	})
+}
+
+func to_t[T Element](x []float64, conv func(x float64) T) []T {
+	y := make([]T, len(x))
+	for i := range x {
+		y[i] = conv(x[i])
+	}
+	return y
+}
+
+func distances_t[T Element](a, b []T) []float64 {
+	return []float64{L2DistanceT(a, b), InnerProductT(a, b), CosineDistanceT(a, b)}
+}
@@ -60,14 +60,14 @@ func TestL2Distance(t *testing.T) {
 				},
 				want: 5.196152422706632,
 			},
-			// {
-			// 	name: "test case 3",
-			// 	args: args{
-			// 		a: *mat.NewVecDense(3, []float64{1, 2, 3}),
-			// 		b: *mat.NewVecDense(4, []float64{1, 2, 3, 4}), // should be a vec of length 3
-			// 	},
-			// 	want: 0,
-			// },
+			{
+				name: "test case 3: column views",
+				args: args{
+					a: *mat.NewDense(3, 2, []float64{1, 0, 2, 0, 3, 0}).ColView(0).(*mat.VecDense),
+					b: *mat.NewDense(3, 2, []float64{0, 4, 0, 5, 0, 6}).ColView(1).(*mat.VecDense),
+				},
+				want: 5.196152422706632,
+			},
 		}
 
 		// run tests
@@ -77,6 +77,18 @@ func TestL2Distance(t *testing.T) {
 				So(got, ShouldAlmostEqual, tt.want)
 			})
 		}
+
+		Convey("test case 4: the lengths should be equal", func() {
+			a := *mat.NewVecDense(3, []float64{1, 2, 3})
+			b := *mat.NewVecDense(4, []float64{1, 2, 3, 4})
+			So(func() { L2Distance(a, b) }, ShouldPanicWith, mat.ErrShape)
+			So(func() { InnerProductDistance(a, b) }, ShouldPanicWith, mat.ErrShape)
+			So(func() { CosineDistance(a, b) }, ShouldPanicWith, mat.ErrShape)
+
+			// the data of a vector may be longer than the vector
+			c := *mat.NewVecDense(4, []float64{1, 2, 3, 100}).SliceVec(0, 3).(*mat.VecDense)
+			So(InnerProductDistance(a, c), ShouldEqual, 14)
+		})
 	})
 }
 
@@ -160,6 +172,53 @@ func TestCosineDistance(t *testing.T) {
 	})
 }
 
+func TestDistanceMatrix(t *testing.T) {
+	Convey("DistanceMatrix", t, func() {
+		q := mat.NewDense(3, 4, []float64{1, 2, 3, 4, -1, 0.5, 2, 0, 3, 3, 3, 3})
+		x := mat.NewDense(2, 4, []float64{1, 2, 3, 4, 0, -1, 2, -2})
+
+		// define test cases
+		tests := []struct {
+			name      string
+			matrix    func(q, x *mat.Dense) *mat.Dense
+			pair_dist func(a, b mat.VecDense) float64
+		}{
+			{
+				name:      "test case 1: L2DistanceMatrix",
+				matrix:    L2DistanceMatrix,
+				pair_dist: L2Distance,
+			},
+			{
+				name:      "test case 2: InnerProductMatrix",
+				matrix:    InnerProductMatrix,
+				pair_dist: InnerProductDistance,
+			},
+			{
+				name:      "test case 3: CosineDistanceMatrix",
+				matrix:    CosineDistanceMatrix,
+				pair_dist: CosineDistance,
+			},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				got := tt.matrix(q, x)
+
+				rows, cols := got.Dims()
+				So(rows, ShouldEqual, 3)
+				So(cols, ShouldEqual, 2)
+				for i := 0; i < rows; i++ {
+					for j := 0; j < cols; j++ {
+						want := tt.pair_dist(*mat.NewVecDense(4, q.RawRowView(i)), *mat.NewVecDense(4, x.RawRowView(j)))
+						So(got.At(i, j), ShouldAlmostEqual, want)
+					}
+				}
+			})
+		}
+	})
+}
+
 func BenchmarkL2Distance(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = L2Distance(v, u)
@@ -0,0 +1,72 @@
+package utils
+
+import "math"
+
+// Float16 is an IEEE 754 half-precision float, it is only a storage type, the arithmetic is done in float32
+type Float16 uint16
+
+// NewFloat16 converts f to the nearest half-precision float, ties to even, out of range values become infinities
+func NewFloat16(f float32) Float16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int32(b>>23) & 0xff
+	mant := b & 0x7fffff
+
+	// inf and nan
+	if exp == 0xff {
+		if mant != 0 {
+			return Float16(sign | 0x7e00)
+		}
+		return Float16(sign | 0x7c00)
+	}
+
+	e := exp - 127 + 15
+	if e >= 0x1f {
+		return Float16(sign | 0x7c00)
+	}
+
+	// subnormal half, the implicit bit of f is shifted into the mantissa
+	if e <= 0 {
+		if e < -10 {
+			return Float16(sign)
+		}
+		mant |= 0x800000
+		shift := uint32(14 - e)
+		h := mant >> shift
+		rem := mant & (1<<shift - 1)
+		half := uint32(1) << (shift - 1)
+		if rem > half || (rem == half && h&1 == 1) {
+			h++
+		}
+		return Float16(sign | uint16(h))
+	}
+
+	// the carry of the rounding goes into the exponent, up to infinity
+	h := uint32(e)<<10 | mant>>13
+	rem := mant & 0x1fff
+	if rem > 0x1000 || (rem == 0x1000 && h&1 == 1) {
+		h++
+	}
+	return Float16(sign | uint16(h))
+}
+
+// Float32 converts h to float32 exactly
+func (h Float16) Float32() float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch {
+	case exp == 0x1f: // inf and nan
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case exp != 0:
+		return math.Float32frombits(sign | (exp+112)<<23 | mant<<13)
+	}
+
+	// zero and subnormal, mant * 2^-24
+	f := float32(mant) / (1 << 24)
+	if sign != 0 {
+		f = -f
+	}
+	return f
+}
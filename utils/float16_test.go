@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFloat16(t *testing.T) {
+	Convey("Float16", t, func() {
+		// define test cases
+		tests := []struct {
+			name string
+			f    float32
+			h    Float16
+			back float32
+		}{
+			{name: "test case 1: one", f: 1, h: 0x3c00, back: 1},
+			{name: "test case 2: negative", f: -2.5, h: 0xc100, back: -2.5},
+			{name: "test case 3: max", f: 65504, h: 0x7bff, back: 65504},
+			{name: "test case 4: overflow", f: 65520, h: 0x7c00, back: float32(math.Inf(1))},
+			{name: "test case 5: smallest subnormal", f: 1.0 / (1 << 24), h: 0x0001, back: 1.0 / (1 << 24)},
+			{name: "test case 6: underflow", f: 1.0 / (1 << 26), h: 0x0000, back: 0},
+			{name: "test case 7: round to nearest", f: 1 + 1.0/(1<<11) + 1.0/(1<<13), h: 0x3c01, back: 1 + 1.0/(1<<10)},
+			{name: "test case 8: tie to even", f: 1 + 1.0/(1<<11), h: 0x3c00, back: 1},
+			{name: "test case 9: rounding carry", f: 2047.0/1024 + 1.0/(1<<11) + 1.0/(1<<13), h: 0x4000, back: 2},
+		}
+
+		// run tests
+		for _, tt := range tests {
+			Convey(tt.name, func() {
+				So(NewFloat16(tt.f), ShouldEqual, tt.h)
+				So(tt.h.Float32(), ShouldEqual, tt.back)
+			})
+		}
+
+		Convey("test case 10: nan", func() {
+			So(math.IsNaN(float64(NewFloat16(float32(math.NaN())).Float32())), ShouldBeTrue)
+		})
+	})
+}